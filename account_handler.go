@@ -0,0 +1,378 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// account_handler.go houses the route handlers which let a user take their
+// data with them, or leave altogether. Exports are zip archives built in the
+// background, containing a JSON document of the users data along with the
+// media they uploaded.
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// exportDir is where export archives are kept until they expire. It
+	// must not be served publicly.
+	exportDir = "exports"
+	// exportTTL is how long an export can be downloaded for.
+	exportTTL = 7 * 24 * time.Hour
+	// maxExportRequests is how many exports a user may request per day.
+	maxExportRequests = 2
+	// deletedAuthor replaces the author of posts which are kept when their
+	// author deletes their account, because others replied to them.
+	deletedAuthor = "[deleted]"
+)
+
+// accountExport{} is the JSON document at the root of an export archive.
+// Media is listed by its path in the archive.
+type accountExport struct {
+	Exported time.Time   `json:"exported"`
+	Profile  *user       `json:"profile"`
+	Posts    []*post     `json:"posts"`
+	Replies  []*post     `json:"replies"`
+	Likes    []string    `json:"likes"`
+	Friends  []string    `json:"friends"`
+	Blocked  []string    `json:"blocked"`
+	Muted    []string    `json:"muted"`
+	Tokens   []*apiToken `json:"api_tokens"`
+	Media    []string    `json:"media"`
+}
+
+// requestExport() is the route handler used to start building an export of
+// the users data. The user is emailed when it's ready, and can check on it
+// with exportStatus().
+func requestExport(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	if !c.IsLoggedIn {
+		log.Println(status(w, "Not Logged In", nil))
+		return
+	}
+	if job, err := getExport(c); err == nil && job.Status == "pending" {
+		log.Println(status(w, "Export Already In Progress", nil))
+		return
+	}
+	n, err := incrExportRequests(c)
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	if n > maxExportRequests {
+		log.Println(status(w, "Too Many Exports, Try Again Tomorrow", nil))
+		return
+	}
+
+	job := &exportJob{Status: "pending", Requested: time.Now().Unix()}
+	if err = setExport(c, job, exportTTL); err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	go buildExport(&credentials{User: &user{ID: c.User.ID}}, job)
+	log.Println(status(w, "success", nil))
+}
+
+// exportStatus() is the route handler used to check on the users data
+// export. The status is "none" if they haven't requested one recently.
+func exportStatus(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	if !c.IsLoggedIn {
+		log.Println(status(w, "Not Logged In", nil))
+		return
+	}
+	job, err := getExport(c)
+	if err == redis.Nil {
+		log.Println(status(w, "none", nil))
+		return
+	}
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	log.Println(status(w, job.Status, nil))
+}
+
+// downloadExport() is the route handler used to download the users finished
+// export archive.
+func downloadExport(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	if !c.IsLoggedIn {
+		http.Error(w, "Not Logged In", http.StatusUnauthorized)
+		return
+	}
+	job, err := getExport(c)
+	if err != nil || job.Status != "ready" {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(job.File)
+	if err != nil {
+		log.Println(err)
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition",
+		`attachment; filename="`+AppName+`-export.zip"`)
+	http.ServeContent(w, r, "", time.Unix(job.Requested, 0), f)
+}
+
+// buildExport() builds the users export archive, and is run in the
+// background by requestExport(). The user is emailed once it's done.
+func buildExport(c *credentials, job *exportJob) {
+	err := writeExport(c, job)
+	if err != nil {
+		log.Println(err)
+		job.Status = "failed"
+		if job.File != "" {
+			os.Remove(job.File)
+		}
+	} else {
+		job.Status = "ready"
+	}
+	if err = setExport(c, job, exportTTL); err != nil {
+		log.Println(err)
+		return
+	}
+	if job.Status != "ready" {
+		return
+	}
+	err = mail.send(c.User.Email, "Your "+AppName+" data export is ready",
+		"The export of your "+AppName+" data you requested is ready. "+
+			"Download it from your profile within the next 7 days:\n\n"+
+			siteURL()+"/user/"+c.User.ID+"\n")
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// writeExport() gathers the users data and writes it to a new archive in
+// exportDir, setting job.File to its path.
+func writeExport(c *credentials, job *exportJob) error {
+	if err := scanProfile(c); err != nil {
+		return err
+	}
+	profile := *c.User
+	profile.Token = ""
+	ex := &accountExport{Exported: time.Now(), Profile: &profile}
+
+	ids, err := getUsersPostIDs(c)
+	if err != nil {
+		return err
+	}
+	// Media is kept in the archive under the ID of the post it's from, as
+	// the same file may be used by more than one. [path, name] pairs.
+	var media [][2]string
+	for _, id := range ids {
+		p, err := getPost(id)
+		if err != nil {
+			return err
+		}
+		for _, m := range p.blobPaths() {
+			media = append(media, [2]string{m, "media/" + p.ID + "/" + filepath.Base(m)})
+		}
+		if p.Parent == "" {
+			ex.Posts = append(ex.Posts, &p)
+		} else {
+			ex.Replies = append(ex.Replies, &p)
+		}
+	}
+	for _, m := range []string{c.User.ProfilePic, c.User.ProfileBG} {
+		media = append(media, [2]string{m, "media/profile/" + filepath.Base(m)})
+	}
+	if ex.Likes, err = getUsersLikeIDs(c); err != nil {
+		return err
+	}
+	if ex.Friends, err = getUsersFriendIDs(c); err != nil {
+		return err
+	}
+	if ex.Blocked, ex.Muted, err = getBlocks(c); err != nil {
+		return err
+	}
+	if ex.Tokens, err = getAPITokens(c); err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(exportDir, 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(exportDir, c.User.ID+"-*.zip")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	job.File = f.Name()
+
+	zw := zip.NewWriter(f)
+	added := map[string]bool{}
+	for _, m := range media {
+		path, name := m[0], m[1]
+		if !uploadedFile(path) || added[name] {
+			continue
+		}
+		added[name] = true
+		if err = addToZip(zw, path, name); err != nil {
+			return err
+		}
+		ex.Media = append(ex.Media, name)
+	}
+	jw, err := zw.Create("data.json")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(jw)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(ex); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// addToZip() copies the file at path into the archive as name. Files which
+// no longer exist are skipped.
+func addToZip(zw *zip.Writer, path, name string) error {
+	f, err := openUpload(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// uploadedFile() reports whether path is a file uploaded by a user, as
+// opposed to a default such as the stock profile picture, or anything else
+// on disk.
+func uploadedFile(path string) bool {
+	return (strings.HasPrefix(path, "public/temp/") || isBlob(path)) && !strings.Contains(path, "..")
+}
+
+// cleanExports() removes export archives older than exportTTL. It's run
+// periodically from main().
+func cleanExports() {
+	entries, err := os.ReadDir(exportDir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Println(err)
+		}
+		return
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < exportTTL {
+			continue
+		}
+		if err = os.Remove(filepath.Join(exportDir, e.Name())); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// deleteRequest{} is the request body sent by the client when deleting their
+// account. Users who sign in with a password must provide it. Those who only
+// sign in with an identity provider type their email instead.
+type deleteRequest struct {
+	Password string `json:"password"`
+	Email    string `json:"email"`
+}
+
+// deleteAccount() is the route handler used by a user to delete their
+// account. see: deleteUser()
+func deleteAccount(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	if !c.IsLoggedIn {
+		log.Println(status(w, "Not Logged In", nil))
+		return
+	}
+	dr := new(deleteRequest)
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(dr); err != nil {
+		log.Println(status(w, "Invalid Request", err))
+		return
+	}
+	hash, err := getPasswordHash(c)
+	switch {
+	case err == redis.Nil:
+		if !strings.EqualFold(strings.TrimSpace(dr.Email), c.User.Email) {
+			log.Println(status(w, "Type Your Email To Confirm", nil))
+			return
+		}
+	case err != nil:
+		log.Println(status(w, "Database Error", err))
+		return
+	case !checkPasswordHash(dr.Password, hash):
+		log.Println(status(w, "Bad Password", nil))
+		return
+	}
+
+	job, _ := getExport(c)
+	files, err := deleteUser(c)
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	if job != nil && job.File != "" {
+		files = append(files, job.File)
+	}
+	for _, f := range files {
+		if job != nil && f == job.File {
+			err = os.Remove(f)
+		} else {
+			err = releaseUpload(f)
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Println(err)
+		}
+	}
+
+	if err = mail.send(c.User.Email, "Your "+AppName+" account was deleted",
+		"Your "+AppName+" account and its data have been deleted.\n"); err != nil {
+		log.Println(err)
+	}
+	http.SetCookie(w, &http.Cookie{Name: "token", Path: "/", MaxAge: -1})
+	log.Println(status(w, "success", nil))
+}
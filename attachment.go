@@ -0,0 +1,156 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// attachment.go houses the helpers for post attachments. A post may have up
+// to maxAttachments files attached, each with its own alt text, which are
+// shown together as a gallery. Their records are kept as JSON in the post,
+// and the files themselves in the blob store. see: blob.go
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// maxAttachments is the most files a post may have attached.
+	maxAttachments = 4
+	// maxAltLength is the longest alt text we keep, in characters.
+	maxAltLength = 1000
+)
+
+// errTooManyAttachments is returned for uploads with more than
+// maxAttachments files.
+var errTooManyAttachments = errors.New("too many attachments")
+
+// Srcset() returns the srcset attribute listing the sizes of an image, by
+// width, or nothing if it only has the one.
+func (a *attachment) Srcset() string {
+	if len(a.Sizes) < 2 {
+		return ""
+	}
+	return srcset(a.Sizes)
+}
+
+// blobPaths() returns the paths of the blobs attached to the post.
+func (p *post) blobPaths() []string {
+	var paths []string
+	for _, a := range p.Attachments {
+		paths = append(paths, a.Blob)
+	}
+	return paths
+}
+
+// releaseAttachments() releases the blobs attached to a post which has been
+// removed, or which failed to be made. see: releaseUpload()
+func releaseAttachments(as attachments) {
+	for _, a := range as {
+		if err := releaseUpload(a.Blob); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// attachmentSize() returns the bytes stored for an attachment which doesn't
+// record them, by reading each of its sizes from the store. see: migrateUsage()
+func attachmentSize(a *attachment) int64 {
+	paths := []string{a.Blob}
+	if len(a.Sizes) > 0 {
+		paths = nil
+		for _, v := range a.Sizes {
+			paths = append(paths, v.Path)
+		}
+	}
+	var size int64
+	for _, path := range paths {
+		f, err := openUpload(path)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		n, err := io.Copy(io.Discard, f)
+		f.Close()
+		if err != nil {
+			log.Println(err)
+		}
+		size += n
+	}
+	return size
+}
+
+// cleanAlt() trims alt text to maxAltLength characters.
+func cleanAlt(alt string) string {
+	alt = strings.TrimSpace(alt)
+	if utf8.RuneCountInString(alt) > maxAltLength {
+		alt = string([]rune(alt)[:maxAltLength])
+	}
+	return alt
+}
+
+var (
+	// srcsetRe and sizeRe read the sizes of an image from the HTML posts
+	// had before attachments. see: legacyAttachment()
+	srcsetRe = regexp.MustCompile(`srcset='([^']*)'`)
+	sizeRe   = regexp.MustCompile(`width='(\d+)' height='(\d+)'`)
+)
+
+// legacyAttachment() returns the attachment{} for the single file a post had
+// before attachments, from its path and the HTML which showed it. Images made
+// by the image pipeline list their sizes in the HTML.
+func legacyAttachment(path, markup string) *attachment {
+	a := &attachment{Blob: path, Kind: "img"}
+	if mt := mediaTypeByExt(strings.TrimPrefix(filepath.Ext(path), ".")); mt != nil {
+		a.Kind, a.MIME = mt.Kind, mt.MIME
+	}
+	if m := sizeRe.FindStringSubmatch(markup); m != nil {
+		a.Width, _ = strconv.Atoi(m[1])
+		a.Height, _ = strconv.Atoi(m[2])
+	}
+	if m := srcsetRe.FindStringSubmatch(markup); m != nil && a.Width > 0 {
+		for _, entry := range strings.Split(m[1], ", ") {
+			src, w, ok := strings.Cut(entry, " ")
+			width, err := strconv.Atoi(strings.TrimSuffix(w, "w"))
+			if !ok || err != nil {
+				continue
+			}
+			// only the full size had its height in the HTML.
+			a.Sizes = append(a.Sizes, imageVariant{
+				Path:   strings.TrimPrefix(src, "/"),
+				Width:  width,
+				Height: a.Height * width / a.Width,
+			})
+		}
+	}
+	return a
+}
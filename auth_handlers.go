@@ -37,9 +37,12 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt"
@@ -50,6 +53,22 @@ import (
 ////////////////////////      Password Section      ///////////////////////////
 ///////////////////////////////////////////////////////////////////////////////
 
+// emailRegx is used to make sure a login email doesn't contain forbidden
+// symbols.
+var emailRegx = regexp.MustCompile(
+	"^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\\.[a-zA-Z]{2,}$")
+
+// validEmail() returns true if the email is acceptable as a login email.
+func validEmail(email string) bool {
+	return emailRegx.MatchString(email)
+}
+
+// validPassword() returns true if the password is long enough. We don't store
+// sensitive info or recommend users upload it, so seven works.
+func validPassword(password string) bool {
+	return len(password) >= 7
+}
+
 // hashPassword() takes a password string and returns a hash
 func hashPassword(password string) (string, error) {
 	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
@@ -79,55 +98,72 @@ func signup(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Make sure the username doesn't contain forbidden symbols
-	emailRegx := "^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\\.[a-zA-Z]{2,}$"
-	match, err := regexp.MatchString(emailRegx, c.Name)
-	if err != nil || !match {
-		log.Println(status(w, "Invalid Username (E1)", err))
-		return
-	}
-
-	// TODO: Move to dbcalls.go
-	if rdb.Exists(rdx, c.Name+":HASH").Val() > 0 {
-		log.Println(status(w, "User Exists", nil))
+	c.Name = strings.ToLower(c.Name)
+	if !validEmail(c.Name) {
+		log.Println(status(w, "Invalid Username (E1)", nil))
 		return
 	}
 
 	// Check to make sure the password is long enough. We don't store
 	// sensitive info or recommend users upload it, so seven works.
-	if len(c.Password) < 7 {
+	if !validPassword(c.Password) {
 		log.Println(status(w, "Invalid Password (E2)", nil))
 		return
 	}
 
 	// Save an ID to be used for posting so we don't expose
 	// the users email, save this in redis as an HSET, and
-	// store all the profile information here.
-	if c.User == nil {
-		c.User = new(user)
+	// store all the profile information here. The profile always starts
+	// fresh, so the client can't choose its own role.
+	c.User = &user{
+		ID:         genID(15),
+		Email:      c.Name,
+		Joined:     time.Now(),
+		Unverified: true,
+		ProfileBG:  "public/media/hubble.jpg",
+		ProfilePic: "public/media/ndt.jpg",
 	}
-	c.User.ID = genID(15)
-	c.User.ProfileBG = "public/media/hubble.jpg"
-	c.User.ProfilePic = "public/media/ndt.jpg"
 
-	// If username is unique and valid, we attempt to hash
-	// the password
+	// Check the signup mode allows the user in, and the invite code
+	// they sent, if any. see: invite.go
+	inv, refused := admitSignup(c)
+	if refused != "" {
+		log.Println(status(w, refused, nil))
+		return
+	}
+
+	// If username is valid, we attempt to hash the password
 	hash, err := hashPassword(c.Password)
 	if err != nil {
 		log.Println(status(w, "Invalid Password", err))
 		return
 	}
 	c.Password = ""
-	_, err = setHashToID(c, hash)
+
+	// Claim the email for the new user ID. This fails if the email is
+	// already in use.
+	ok, err := claimEmail(c.Name, c.User.ID)
 	if err != nil {
 		log.Println(status(w, "Database Error", err))
 		return
 	}
+	if !ok {
+		log.Println(status(w, "User Exists", nil))
+		return
+	}
+	if inv != nil {
+		if ok, err = useInvite(inv, c); err != nil || !ok {
+			if err := releaseEmail(c.Name); err != nil {
+				log.Println(err)
+			}
+			log.Println(status(w, "Invalid Invite Code", err))
+			return
+		}
+	}
 
-	// If the password is hashable, and we were able to add
-	// the user to the redis ZSET, we store the hash in the
-	// database with the username as the key and the hash
-	// as the value thats returned by the key.
-	if _, err = setPasswordHash(c, hash); err != nil {
+	// If the password is hashable, and we were able to claim the email,
+	// we store the hash in the users private credentials record.
+	if err = setPasswordHash(c, hash); err != nil {
 		log.Println(status(w, "Database Error", err))
 		return
 	}
@@ -140,6 +176,33 @@ func signup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Count the signup, so the proof-of-work challenge gets harder as
+	// more users sign up. see: pow.go
+	if err = incrSignups(); err != nil {
+		log.Println(err)
+	}
+
+	// Store the new users whole profile, including the securityFields
+	// that setProfile() leaves alone. see: createProfile()
+	if err = createProfile(c); err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+
+	// Users on the waitlist don't get a token until they're approved, but
+	// can verify their email while they wait.
+	if c.User.Waitlisted {
+		if err = addToWaitlist(c); err != nil {
+			log.Println(status(w, "Database Error", err))
+			return
+		}
+		if err = sendVerification(c.User); err != nil {
+			log.Println(err)
+		}
+		log.Println(status(w, "You're On The Waitlist, We'll Email You Once You're In", nil))
+		return
+	}
+
 	// renewToken() is used here to create a new token, which it's also
 	// capable of.
 	if _, err = renewToken(w, r, c); err != nil {
@@ -147,10 +210,113 @@ func signup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Send the verification email. The account already exists at this
+	// point, so a failure here isn't fatal, the user can ask for the
+	// email to be resent.
+	if err = sendVerification(c.User); err != nil {
+		log.Println(err)
+	}
+
 	// success.
 	log.Println(status(w, "success", nil))
 }
 
+///////////////////////////////////////////////////////////////////////////////
+////////////////////////    Verification Section    ///////////////////////////
+///////////////////////////////////////////////////////////////////////////////
+
+// maxVerifyResends is the number of verification emails a user may request
+// per hour.
+const maxVerifyResends int64 = 3
+
+// sendVerification() emails the user a signed link which, when followed,
+// marks their account as verified.
+func sendVerification(u *user) error {
+	t, err := signVerifyToken(u)
+	if err != nil {
+		return err
+	}
+	link := siteURL() + "/verify?t=" + url.QueryEscape(t)
+	return mail.send(u.Email, "Verify your "+AppName+" account",
+		"Follow the link below to verify your email address:\n\n"+
+			link+"\n\nThe link expires in 24 hours.\n")
+}
+
+// verify() is the route handler for the link sent by sendVerification(). If
+// the token is valid the users account is marked as verified, and they're
+// redirected to the home page.
+func verify(w http.ResponseWriter, r *http.Request) {
+	claims, err := parseVerifyToken(r.URL.Query().Get("t"))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Invalid or expired link", http.StatusBadRequest)
+		return
+	}
+
+	// Look up the user the token was issued to.
+	c := &credentials{User: &user{ID: claims.Subject}}
+	if err = scanProfile(c); err != nil || c.User.Email != claims.Email {
+		log.Println(err)
+		http.Error(w, "Invalid or expired link", http.StatusBadRequest)
+		return
+	}
+
+	if err = setVerified(c); err != nil {
+		log.Println(err)
+		http.Error(w, "Database Error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// resendVerification() is the route handler used by unverified users to
+// request a new verification email. Requests are rate limited to
+// maxVerifyResends per hour.
+func resendVerification(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	if !c.IsLoggedIn {
+		log.Println(status(w, "Not Logged In", nil))
+		return
+	}
+	if !c.User.Unverified {
+		log.Println(status(w, "Already Verified", nil))
+		return
+	}
+
+	n, err := incrVerifyResends(c)
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	if n > maxVerifyResends {
+		log.Println(status(w, "Too Many Requests, Try Again Later", nil))
+		return
+	}
+
+	if err = sendVerification(c.User); err != nil {
+		log.Println(status(w, "Mail Error", err))
+		return
+	}
+	log.Println(status(w, "success", nil))
+}
+
+// requireVerified is used as a middleware function, inside of checkAuth(),
+// for routes that require a logged in user with a verified email address.
+func requireVerified(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := r.Context().Value(ctxkey).(*credentials)
+		if !ok || !c.IsLoggedIn {
+			log.Println(status(w, "Not Logged In", nil))
+			return
+		}
+		if c.User.Unverified {
+			log.Println(status(w, "Please Verify Your Email", nil))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 ////////////////////////       Signin Section       ///////////////////////////
 ///////////////////////////////////////////////////////////////////////////////
@@ -167,8 +333,32 @@ func signin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get the passwords hash from the database by looking up the users
-	// name
+	// Count the attempt against the client IP up front, refusing it early
+	// if the IP is locked out. This is cheap, and saves us from spending
+	// bcrypt time on it. Every attempt counts as a failure until it
+	// succeeds, so unknown accounts count too. see: claimSigninAttempt()
+	ip := "IP:" + clientIP(r)
+	ipAttempts, ok := beginSigninAttempt(w, ip, ipFailLimit)
+	if !ok {
+		return
+	}
+
+	// Get the users ID from the database by looking up their login email,
+	// then use it to get the password hash from their credentials.
+	c.Name = strings.ToLower(c.Name)
+	id, err := getIDByEmail(c.Name)
+	if err != nil {
+		log.Println(status(w, "User doesn't exist", err))
+		return
+	}
+	c.User = &user{ID: id}
+
+	// Likewise, count the attempt against the account.
+	attempts, ok := beginSigninAttempt(w, id, accountFailLimit)
+	if !ok {
+		return
+	}
+
 	hash, err := getPasswordHash(c)
 	if err != nil {
 		log.Println(status(w, "User doesn't exist", err))
@@ -181,25 +371,52 @@ func signin(w http.ResponseWriter, r *http.Request) {
 		c.Password = "" // remove the password from credentials{}
 		// before doing anything else.
 
-		// Get the users ID from the database using the hash obtained
-		// previously.
-		id, err := getID(hash)
-		if err != nil {
-			log.Println(status(w, "Database Error", err))
-			return
+		// Forget the accounts failed attempts. Only this attempt is
+		// taken back from the IP, so an attacker can't reset its count
+		// by signing in to their own account.
+		if err = clearSigninFailures(id); err != nil {
+			log.Println(err)
+		}
+		if err = releaseSigninAttempt(ip, ipAttempts, ipFailLimit); err != nil {
+			log.Println(err)
 		}
 
-		// Create a user{} with an ID set to the ID obtained
-		// previously.
-		c.User = &user{ID: id}
-
-		// Use the previously created user{} to get the rest of the
+		// Use the user{} created previously to get the rest of the
 		// users profile information.
 		err = scanProfile(c)
 		if err != nil {
 			log.Println(status(w, "Scan Profile Error", err))
 			return
 		}
+		if c.User.Banned {
+			log.Println(status(w, "Account Banned", nil))
+			return
+		}
+		if c.User.Waitlisted {
+			log.Println(status(w, "You're Still On The Waitlist", nil))
+			return
+		}
+
+		// If the user has two-factor authentication enabled, we don't
+		// issue a token yet. Instead the client is given a short lived
+		// challenge to send back along with a code. see: signinTOTP()
+		twoFactor, err := hasTOTP(c)
+		if err != nil {
+			log.Println(status(w, "Database Error", err))
+			return
+		}
+		if twoFactor {
+			challenge, err := signChallengeToken(c.User.ID)
+			if err != nil {
+				log.Println(status(w, "Token Error", err))
+				return
+			}
+			ajaxResponse(w, map[string]string{
+				"status":    "2fa",
+				"challenge": challenge,
+			})
+			return
+		}
 
 		// issue/renew the users authentication token.
 		_, err = renewToken(w, r, c)
@@ -212,9 +429,386 @@ func signin(w http.ResponseWriter, r *http.Request) {
 		log.Println(status(w, "success", err))
 		return
 	}
+	// The user is notified by email the first time their account is
+	// locked.
+	if attempts == accountFailLimit {
+		go notifyLockout(c)
+	}
 	log.Println(status(w, "Bad Password", err))
 }
 
+///////////////////////////////////////////////////////////////////////////////
+////////////////////////       Lockout Section      ///////////////////////////
+///////////////////////////////////////////////////////////////////////////////
+
+const (
+	// accountFailLimit is the number of failed signin attempts allowed
+	// against an account in a day before it's locked out.
+	accountFailLimit int64 = 5
+	// ipFailLimit is the number of failed signin attempts allowed from a
+	// single IP in a day before it's locked out. This is higher than
+	// accountFailLimit since many users can share an IP.
+	ipFailLimit int64 = 20
+	// lockoutBase is the length of the first lockout. Each attempt after
+	// that doubles it, up to lockoutMax. see: claimSigninAttempt()
+	lockoutBase time.Duration = time.Minute
+	lockoutMax  time.Duration = time.Hour
+)
+
+// beginSigninAttempt() counts a signin attempt against the account or IP
+// identified by prefix, before the password is checked. If the account or IP
+// is locked out, it responds to the client, setting the Retry-After header,
+// and returns false. It returns the number of attempts in the last day.
+func beginSigninAttempt(w http.ResponseWriter, prefix string, limit int64) (int64, bool) {
+	n, ttl, err := claimSigninAttempt(prefix, limit, lockoutBase, lockoutMax)
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return 0, false
+	}
+	if n == 0 {
+		w.Header().Set("Retry-After", fmt.Sprint(int(ttl.Seconds())+1))
+		log.Println(status(w, "Too Many Attempts, Try Again Later", nil))
+		return 0, false
+	}
+	return n, true
+}
+
+// notifyLockout() lets a user know their account has been temporarily locked
+// because of failed signin attempts.
+func notifyLockout(c *credentials) {
+	if err := scanProfile(c); err != nil {
+		log.Println(err)
+		return
+	}
+	err := mail.send(c.User.Email, "Your "+AppName+" account was locked",
+		"We noticed several failed attempts to sign in to your account, "+
+			"so we've locked it temporarily.\n\nIf this wasn't you, "+
+			"consider changing your password once you're able to sign in.\n")
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+////////////////////////     Two-Factor Section     ///////////////////////////
+///////////////////////////////////////////////////////////////////////////////
+
+// maxTOTPAttempts is the number of failed second step signin attempts allowed
+// per user in a five minute window.
+const maxTOTPAttempts int64 = 5
+
+// totpRequest{} is the request body sent by the client during the second step
+// of signin, and when confirming enrollment. Code is either a TOTP code or a
+// recovery code.
+type totpRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+// marshalTOTPRequest() is used to convert a request body into a
+// totpRequest{}.
+func marshalTOTPRequest(r *http.Request) (*totpRequest, error) {
+	t := new(totpRequest)
+	defer r.Body.Close()
+	return t, json.NewDecoder(r.Body).Decode(t)
+}
+
+// checkSecondFactor() checks a code from the users authenticator, or one of
+// their recovery codes, making sure neither can be used twice.
+func checkSecondFactor(c *credentials, code string) (bool, error) {
+	secret, _, err := getTOTPSecrets(c)
+	if err != nil || secret == "" {
+		return false, err
+	}
+	if step, ok := checkTOTP(secret, code, time.Now()); ok {
+		return useTOTPStep(c, step)
+	}
+	return useRecoveryCode(c, hashRecoveryCode(code))
+}
+
+// signinTOTP() is the second step of signin for users with two-factor
+// authentication enabled. The client sends back the challenge it was given by
+// signin() along with a code, and if both are good the users token is issued.
+func signinTOTP(w http.ResponseWriter, r *http.Request) {
+	t, err := marshalTOTPRequest(r)
+	if err != nil {
+		log.Println(status(w, "Invalid Request", err))
+		return
+	}
+	id, err := parseChallengeToken(t.Challenge)
+	if err != nil {
+		log.Println(status(w, "Signin Expired, Try Again", err))
+		return
+	}
+
+	n, err := incrTOTPAttempts(id)
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	if n > maxTOTPAttempts {
+		log.Println(status(w, "Too Many Attempts, Try Again Later", nil))
+		return
+	}
+
+	c := &credentials{User: &user{ID: id}}
+	ok, err := checkSecondFactor(c, t.Code)
+	if err != nil || !ok {
+		log.Println(status(w, "Bad Code", err))
+		return
+	}
+	if err = clearTOTPAttempts(id); err != nil {
+		log.Println(err)
+	}
+
+	if err = scanProfile(c); err != nil {
+		log.Println(status(w, "Scan Profile Error", err))
+		return
+	}
+	c.Name = c.User.Email
+	if _, err = renewToken(w, r, c); err != nil {
+		log.Println(status(w, "Token Error", err))
+		return
+	}
+	log.Println(status(w, "success", nil))
+}
+
+// enrollTOTP() is the route handler used to begin enrolling in two-factor
+// authentication. It generates a new secret and responds with it, along with
+// the otpauth:// URI and a QR code of the URI for the user to scan.
+func enrollTOTP(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	if !c.IsLoggedIn {
+		log.Println(status(w, "Not Logged In", nil))
+		return
+	}
+	enabled, err := hasTOTP(c)
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	if enabled {
+		log.Println(status(w, "Already Enabled", nil))
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		log.Println(status(w, "Error", err))
+		return
+	}
+	if err = setTOTPPending(c, secret); err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+
+	uri := totpURI(secret, c.User.Email)
+	qr, err := qrSVG(uri)
+	if err != nil {
+		log.Println(status(w, "Error", err))
+		return
+	}
+	ajaxResponse(w, map[string]string{
+		"status": "success",
+		"secret": secret,
+		"uri":    uri,
+		"qr":     qr,
+	})
+}
+
+// confirmTOTP() is the route handler used to finish enrolling in two-factor
+// authentication. The user sends a code from their authenticator to prove it
+// was set up correctly, and in return receives their recovery codes, which
+// are only ever shown this once.
+func confirmTOTP(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	if !c.IsLoggedIn {
+		log.Println(status(w, "Not Logged In", nil))
+		return
+	}
+	t, err := marshalTOTPRequest(r)
+	if err != nil {
+		log.Println(status(w, "Invalid Request", err))
+		return
+	}
+
+	_, pending, err := getTOTPSecrets(c)
+	if err != nil || pending == "" {
+		log.Println(status(w, "Enrollment Not Started", err))
+		return
+	}
+	step, ok := checkTOTP(pending, t.Code, time.Now())
+	if !ok {
+		log.Println(status(w, "Bad Code", nil))
+		return
+	}
+
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		log.Println(status(w, "Error", err))
+		return
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = hashRecoveryCode(code)
+	}
+	if err = enableTOTP(c, pending, hashes); err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	// the code used to confirm can't be used again to sign in.
+	if _, err = useTOTPStep(c, step); err != nil {
+		log.Println(err)
+	}
+
+	c.User.TwoFactor = true
+	if _, err = renewToken(w, r, c); err != nil {
+		log.Println(status(w, "Token Error", err))
+		return
+	}
+	ajaxResponse(w, map[string]string{
+		"status": "success",
+		"codes":  strings.Join(codes, " "),
+	})
+}
+
+// disableTOTPHandler() is the route handler used to turn off two-factor
+// authentication. The user must provide their current password.
+func disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	if !c.IsLoggedIn {
+		log.Println(status(w, "Not Logged In", nil))
+		return
+	}
+	if _, err := reauthenticate(r, c); err != nil {
+		log.Println(status(w, "Bad Password", err))
+		return
+	}
+	if err := disableTOTP(c); err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+
+	c.User.TwoFactor = false
+	if _, err := renewToken(w, r, c); err != nil {
+		log.Println(status(w, "Token Error", err))
+		return
+	}
+	log.Println(status(w, "success", nil))
+}
+
+///////////////////////////////////////////////////////////////////////////////
+////////////////////////       Account Section      ///////////////////////////
+///////////////////////////////////////////////////////////////////////////////
+
+// credentialChange{} is the request body sent by the client when changing
+// their password or login email. Password is always the users current
+// password, which must be provided to make either change.
+type credentialChange struct {
+	Password    string `json:"password"`
+	NewPassword string `json:"new_password"`
+	NewEmail    string `json:"new_email"`
+}
+
+// reauthenticate() decodes a credentialChange{} from the request body, and
+// checks the current password it contains against the logged in users
+// password hash.
+func reauthenticate(r *http.Request, c *credentials) (*credentialChange, error) {
+	cc := new(credentialChange)
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(cc); err != nil {
+		return nil, err
+	}
+	hash, err := getPasswordHash(c)
+	if err != nil {
+		return nil, err
+	}
+	if !checkPasswordHash(cc.Password, hash) {
+		return nil, errors.New("Bad Password")
+	}
+	return cc, nil
+}
+
+// changePassword() is the route handler used by a logged in user to change
+// their password. Renewing the token afterwards signs out any other sessions.
+func changePassword(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	if !c.IsLoggedIn {
+		log.Println(status(w, "Not Logged In", nil))
+		return
+	}
+
+	cc, err := reauthenticate(r, c)
+	if err != nil {
+		log.Println(status(w, "Bad Password", err))
+		return
+	}
+	if !validPassword(cc.NewPassword) {
+		log.Println(status(w, "Invalid Password (E2)", nil))
+		return
+	}
+
+	hash, err := hashPassword(cc.NewPassword)
+	if err != nil {
+		log.Println(status(w, "Invalid Password", err))
+		return
+	}
+	if err = setPasswordHash(c, hash); err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+
+	if _, err = renewToken(w, r, c); err != nil {
+		log.Println(status(w, "Token Error", err))
+		return
+	}
+	log.Println(status(w, "success", nil))
+}
+
+// changeEmailHandler() is the route handler used by a logged in user to change
+// their login email. The new email has to be verified before the user can
+// post again.
+func changeEmailHandler(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	if !c.IsLoggedIn {
+		log.Println(status(w, "Not Logged In", nil))
+		return
+	}
+
+	cc, err := reauthenticate(r, c)
+	if err != nil {
+		log.Println(status(w, "Bad Password", err))
+		return
+	}
+	email := strings.ToLower(cc.NewEmail)
+	if !validEmail(email) {
+		log.Println(status(w, "Invalid Username (E1)", nil))
+		return
+	}
+
+	ok, err := changeEmail(c, email) // see: changeEmail()
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	if !ok {
+		log.Println(status(w, "User Exists", nil))
+		return
+	}
+
+	c.Name = email
+	c.User.Email = email
+	c.User.Unverified = true
+	if _, err = renewToken(w, r, c); err != nil {
+		log.Println(status(w, "Token Error", err))
+		return
+	}
+	if err = sendVerification(c.User); err != nil {
+		log.Println(err)
+	}
+	log.Println(status(w, "success", nil))
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 ////////////////////////       Auth Middleware      ///////////////////////////
 ///////////////////////////////////////////////////////////////////////////////
@@ -228,6 +822,21 @@ func signin(w http.ResponseWriter, r *http.Request) {
 // require authentication.
 func checkAuth(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// scripts and bots authenticate with an API token instead of
+		// the cookie. An invalid token is an error, rather than being
+		// served as a signed out user. see: token_handler.go
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			c, err := checkAPIToken(bearer)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				w.WriteHeader(http.StatusUnauthorized)
+				log.Println(status(w, "Invalid Token", err))
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxkey, c)))
+			return
+		}
+
 		// get the "token" cookie
 		token, err := r.Cookie("token")
 		log.Println(token)
@@ -325,13 +934,21 @@ func jwtkey_fn(token *jwt.Token) (interface{}, error) {
 // on the client, and adds it to the database.
 // TODO: FIX EXPIRY
 func renewToken(w http.ResponseWriter, r *http.Request, c *credentials) (context.Context, error) {
+	// banned users don't get a token, nor do those on the waitlist.
+	// see: moderation.go, invite.go
+	if c.User.Banned {
+		return nil, errors.New("Account Banned")
+	}
+	if c.User.Waitlisted {
+		return nil, errors.New("On The Waitlist")
+	}
 	c.User.Token = "" // make sure the old token is removed.
 
 	// use the functionality provided by the json web token module to renew
 	// the token using the jwt.StandardClaims{}.
 	ss, err := jwt.NewWithClaims(jwt.SigningMethodHS256,
-		&credentials{c.Name, "", true, c.User,
-			jwt.StandardClaims{
+		&credentials{Name: c.Name, IsLoggedIn: true, User: c.User,
+			StandardClaims: jwt.StandardClaims{
 				ExpiresAt: time.Now().Add(1 * time.Hour).Unix(),
 			},
 		}).SignedString(hmacSampleSecret)
@@ -358,6 +975,65 @@ func renewToken(w http.ResponseWriter, r *http.Request, c *credentials) (context
 	return context.WithValue(r.Context(), ctxkey, c), nil
 }
 
+// verifyClaims are the claims contained in an email verification token. The
+// users ID is stored as the Subject. Email is the address the link was sent
+// to, so that a link can't verify an address the user has since changed.
+type verifyClaims struct {
+	Email string `json:"email"`
+	jwt.StandardClaims
+}
+
+// signVerifyToken() returns a signed email verification token for the user,
+// valid for 24 hours.
+func signVerifyToken(u *user) (string, error) {
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, &verifyClaims{
+		u.Email,
+		jwt.StandardClaims{
+			Subject:   u.ID,
+			Audience:  "verify",
+			ExpiresAt: time.Now().Add(24 * time.Hour).Unix(),
+		},
+	}).SignedString(hmacSampleSecret)
+}
+
+// parseVerifyToken() checks the validity of an email verification token and
+// returns its claims.
+func parseVerifyToken(tokenString string) (*verifyClaims, error) {
+	claims := &verifyClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, jwtkey_fn)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid || !claims.VerifyAudience("verify", true) {
+		return nil, errors.New("Invalid Verification Token")
+	}
+	return claims, nil
+}
+
+// signChallengeToken() returns a signed token, valid for five minutes, which
+// proves the user with the ID has passed the password step of signin.
+func signChallengeToken(id string) (string, error) {
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, &jwt.StandardClaims{
+		Subject:   id,
+		Audience:  "totp",
+		ExpiresAt: time.Now().Add(5 * time.Minute).Unix(),
+	}).SignedString(hmacSampleSecret)
+}
+
+// parseChallengeToken() checks the validity of a challenge token and returns
+// the ID of the user it was issued to.
+func parseChallengeToken(tokenString string) (string, error) {
+	claims := &jwt.StandardClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, jwtkey_fn)
+	if err != nil {
+		return "", err
+	}
+	if !token.Valid || !claims.VerifyAudience("totp", true) {
+		return "", errors.New("Invalid Challenge Token")
+	}
+	return claims.Subject, nil
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 ////////////////////////     Marshal Credentials    ///////////////////////////
 ///////////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,269 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// blob.go houses the content-addressed media store. Uploads are staged in
+// public/temp while they're checked and processed, then moved to the
+// blobStore{}, named by the SHA-256 hash of their content, so identical
+// uploads are only stored once. see: storage.go. Each blob has a count of
+// the posts and profiles using it in redis, and once nothing uses a blob
+// it's garbage-collected by collectBlobs(). Files uploaded before the store
+// existed are left in public/temp, and removed directly.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// blobDir is where blobs are linked to from posts, and where the
+	// localStore{} keeps them, in directories named by the first two
+	// characters of their hash, to keep each one small.
+	blobDir = "public/blobs"
+	// blobGrace is how long an unused blob is kept before it's removed.
+	blobGrace = time.Hour
+	// blobLockTTL is how long a blob may be locked, and blobLockWait how
+	// long storeBlob() waits for the lock. see: lockBlob()
+	blobLockTTL  = time.Minute
+	blobLockWait = 2 * blobLockTTL
+)
+
+// errBlobLocked is returned when a blob stays locked for blobLockWait.
+var errBlobLocked = errors.New("blob locked")
+
+// storeBlob() moves the staged upload at path, along with any other sizes
+// of it made by the image pipeline, into the blobStore{}, and counts a
+// reference to it. If the same file is already stored, the copies are the
+// same, so it's simply replaced. It returns the blobs path, and the sizes
+// at their new paths.
+func storeBlob(path string, variants []imageVariant) (string, []imageVariant, error) {
+	staged := []string{path}
+	for _, v := range variants {
+		staged = append(staged, v.Path)
+	}
+	defer func() {
+		for _, f := range staged {
+			os.Remove(f)
+		}
+	}()
+
+	sum, err := hashFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	ext := filepath.Ext(path)
+	blob := blobDir + "/" + sum[:2] + "/" + sum + ext
+	// The reference is counted first, so the blob can't be collected
+	// while it's stored. It's counted under the blobs lock, so if it's
+	// being collected, that's finished before the blob is stored again.
+	if err = waitForBlob(blob); err != nil {
+		return "", nil, err
+	}
+	err = retainBlob(blob)
+	if uerr := unlockBlob(blob); uerr != nil {
+		log.Println(uerr)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	// The sizes are named after the full size, as in "[hash]-thumb.jpg".
+	base, stagedBase := strings.TrimSuffix(blob, ext), strings.TrimSuffix(path, ext)
+	moved := make([]imageVariant, len(variants))
+	for i, v := range variants {
+		moved[i] = v
+		moved[i].Path = base + strings.TrimPrefix(v.Path, stagedBase)
+		if err = putBlob(v.Path, moved[i].Path); err != nil {
+			break
+		}
+	}
+	if err == nil && len(variants) == 0 {
+		err = putBlob(path, blob)
+	}
+	if err != nil {
+		if err := unrefBlob(blob); err != nil {
+			log.Println(err)
+		}
+		return "", nil, err
+	}
+	return blob, moved, nil
+}
+
+// waitForBlob() takes the lock on blob, waiting up to blobLockWait for it
+// if it's held. see: lockBlob()
+func waitForBlob(blob string) error {
+	deadline := time.Now().Add(blobLockWait)
+	for {
+		ok, err := lockBlob(blob, blobLockTTL)
+		if err != nil || ok {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return errBlobLocked
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// putBlob() copies the staged file at path into the blobStore{} as blob.
+func putBlob(path, blob string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	contentType := "application/octet-stream"
+	if mt := mediaTypeByExt(strings.TrimPrefix(filepath.Ext(path), ".")); mt != nil {
+		contentType = mt.MIME
+	}
+	return blobs.put(blobKey(blob), f, info.Size(), contentType)
+}
+
+// hashFile() returns the hex encoded SHA-256 hash of the file at path.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// isBlob() reports whether path is in the blob store.
+func isBlob(path string) bool {
+	return strings.HasPrefix(path, blobDir+"/") && !strings.Contains(path, "..")
+}
+
+// blobKey() returns the key of the blob at path in the blobStore{}.
+func blobKey(path string) string {
+	return strings.TrimPrefix(path, blobDir+"/")
+}
+
+// openUpload() opens an uploaded file, wherever it's kept.
+func openUpload(path string) (io.ReadCloser, error) {
+	if isBlob(path) {
+		return blobs.open(blobKey(path))
+	}
+	return os.Open(path)
+}
+
+// releaseUpload() is called when a post or profile stops using an uploaded
+// file. Blobs lose a reference, and are collected later if that was the
+// last, while files from before the blob store are removed directly.
+func releaseUpload(path string) error {
+	switch {
+	case isBlob(path):
+		return unrefBlob(path)
+	case uploadedFile(path):
+		return removeMediaFiles(path)
+	}
+	return nil
+}
+
+// removeMediaFiles() removes a file uploaded before the blob store existed
+// from disk, along with any other sizes of it made by the image pipeline.
+func removeMediaFiles(path string) error {
+	ext := filepath.Ext(path)
+	others, _ := filepath.Glob(strings.TrimSuffix(path, ext) + "-*" + ext)
+	for _, f := range append(others, path) {
+		if err := os.Remove(f); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeBlob() removes a blob from the blobStore{}, along with any other
+// sizes of it made by the image pipeline.
+func removeBlob(path string) error {
+	ext := filepath.Ext(path)
+	keys := []string{blobKey(path)}
+	for _, size := range imageSizes[:len(imageSizes)-1] {
+		keys = append(keys, blobKey(strings.TrimSuffix(path, ext)+"-"+size.Name+ext))
+	}
+	for _, key := range keys {
+		if err := blobs.remove(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectBlobs() removes blobs which have been unused for blobGrace. It's
+// run periodically from main().
+func collectBlobs() {
+	orphans, err := takeOrphanBlobs(time.Now().Add(-blobGrace))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, path := range orphans {
+		if !isBlob(path) {
+			continue
+		}
+		if err = collectBlob(path); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// collectBlob() removes the orphaned blob at path, unless it's been used
+// again since it was claimed. It holds the blobs lock while it checks and
+// removes it, so storeBlob() can't count a reference to it in between. A
+// locked blob is being stored again, so it's left alone.
+func collectBlob(path string) error {
+	ok, err := lockBlob(path, blobLockTTL)
+	if err != nil || !ok {
+		return err
+	}
+	defer func() {
+		if err := unlockBlob(path); err != nil {
+			log.Println(err)
+		}
+	}()
+	n, err := blobRefs(path)
+	if err != nil || n > 0 {
+		return err
+	}
+	return removeBlob(path)
+}
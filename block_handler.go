@@ -0,0 +1,192 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// block_handler.go houses blocking and muting. Blocking is mutual: neither
+// user sees the others posts, and they can't reply to, mention, or befriend
+// each other. Muting only hides the muted users posts from the user who muted
+// them. Any new way for users to interact, such as notifications or direct
+// messages, should check canInteract() first.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// errBlocked is returned when a user tries to interact with someone they've
+// blocked, or who has blocked them.
+var errBlocked = errors.New("Blocked")
+
+// canInteract() reports whether the user with ID from may interact with the
+// user with ID to, which they can't if either has blocked the other.
+func canInteract(from, to string) (bool, error) {
+	blocked, err := isBlocked(from, to)
+	return !blocked, err
+}
+
+// filterStream() returns a copy of posts, and their replies, without those
+// written by users hidden from the viewer, or shadow hidden by the spam
+// filter and written by someone else. The posts passed in are shared by
+// every request, and so aren't changed.
+func filterStream(posts []*post, c *credentials) []*post {
+	viewer, hidden := "", map[string]bool{}
+	if c != nil && c.IsLoggedIn {
+		var err error
+		viewer = c.User.ID
+		if hidden, err = getHiddenAuthors(c); err != nil {
+			log.Println(err)
+		}
+	}
+	return dropAuthors(posts, viewer, hidden)
+}
+
+// dropAuthors() is used by filterStream() to walk the stream.
+func dropAuthors(posts []*post, viewer string, hidden map[string]bool) []*post {
+	kept := make([]*post, 0, len(posts))
+	for _, p := range posts {
+		if hidden[p.Author] || (p.Shadow && p.Author != viewer) {
+			continue
+		}
+		cp := *p
+		cp.Comments = dropAuthors(p.Comments, viewer, hidden)
+		kept = append(kept, &cp)
+	}
+	return kept
+}
+
+// dropBlockedMentions() removes mentions of users who can't interact with
+// the author from a new post, along with mentions that don't resolve to a
+// user at all.
+func dropBlockedMentions(c *credentials, mentions rstring) rstring {
+	kept := mentions[:0]
+	for _, m := range mentions {
+		id, err := resolveMention(m)
+		if err != nil {
+			log.Println(err)
+		}
+		if id == "" {
+			continue
+		}
+		ok, err := canInteract(c.User.ID, id)
+		if err != nil {
+			log.Println(err)
+		}
+		if ok {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+// resolveMention() returns the ID of the user a mention names, either by their
+// ID or their email, or "" if there's no such user.
+func resolveMention(m string) (string, error) {
+	name := strings.TrimPrefix(strings.TrimSpace(m), "@")
+	if name == "" {
+		return "", nil
+	}
+	ok, err := userExists(name)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return name, nil
+	}
+	id, err := getIDByEmail(strings.ToLower(name))
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return id, err
+}
+
+// blockHandler() is the route handler for /block/[id], /unblock/[id],
+// /mute/[id] and /unmute/[id].
+func blockHandler(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	if !c.IsLoggedIn {
+		log.Println(status(w, "Not Logged In", nil))
+		return
+	}
+	parts := strings.Split(r.URL.Path, "/")
+	action, id := parts[1], parts[2]
+	if id == c.User.ID {
+		log.Println(status(w, "You Can't Block Or Mute Yourself", nil))
+		return
+	}
+	if ok, err := userExists(id); err != nil || !ok {
+		log.Println(status(w, "No Such User", err))
+		return
+	}
+
+	var err error
+	switch action {
+	case "block":
+		err = blockUser(c, id)
+	case "unblock":
+		err = unblockUser(c, id)
+	case "mute":
+		err = muteUser(c, id, true)
+	case "unmute":
+		err = muteUser(c, id, false)
+	}
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	log.Println(status(w, "success", nil))
+}
+
+// blocksHandler() is the route handler used to list the users the user has
+// blocked and muted, so they can manage them.
+func blocksHandler(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	if !c.IsLoggedIn {
+		log.Println(status(w, "Not Logged In", nil))
+		return
+	}
+	blocked, muted, err := getBlocks(c)
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(struct {
+		Status  string   `json:"status"`
+		Blocked []string `json:"blocked"`
+		Muted   []string `json:"muted"`
+	}{"success", blocked, muted})
+	if err != nil {
+		log.Println(err)
+	}
+}
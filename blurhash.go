@@ -0,0 +1,145 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// blurhash.go houses an encoder for BlurHash, a short string describing the
+// colours of an image, which the client draws as a blurred placeholder while
+// the image loads. The image is reduced to a few cosine components, like a
+// tiny JPEG, which are encoded in base 83. The decoder is in head.js. see:
+// https://github.com/woltapp/blurhash
+package main
+
+import (
+	"image"
+	"math"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// blurhashX and blurhashY are how many components are encoded across
+	// and down the image. More are more detailed, and longer.
+	blurhashX = 4
+	blurhashY = 3
+	// blurhashSample is the size the image is scaled down to before it's
+	// encoded, which is plenty for a blur.
+	blurhashSample = 32
+	base83Chars    = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+)
+
+// blurhash() returns the BlurHash of img.
+func blurhash(img image.Image) string {
+	b := img.Bounds()
+	w, h := min(b.Dx(), blurhashSample), min(b.Dy(), blurhashSample)
+	small := image.NewRGBA(image.Rect(0, 0, max(w, 1), max(h, 1)))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, b, draw.Src, nil)
+	w, h = small.Bounds().Dx(), small.Bounds().Dy()
+
+	// factors are the average colour of the image weighted by each
+	// component, the first being the average colour its self.
+	var factors [blurhashX * blurhashY][3]float64
+	for j := 0; j < blurhashY; j++ {
+		for i := 0; i < blurhashX; i++ {
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(w)) *
+						math.Cos(math.Pi*float64(j*y)/float64(h))
+					p := small.Pix[small.PixOffset(x, y):]
+					for c := 0; c < 3; c++ {
+						f[c] += basis * srgbToLinear(p[c])
+					}
+				}
+			}
+			for c := range f {
+				f[c] *= norm / float64(w*h)
+			}
+			factors[j*blurhashX+i] = f
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(base83((blurhashX-1)+(blurhashY-1)*9, 1))
+	var maxAC float64
+	for _, f := range factors[1:] {
+		for _, v := range f {
+			maxAC = max(maxAC, math.Abs(v))
+		}
+	}
+	quantMax := int(max(0, min(82, math.Floor(maxAC*166-0.5))))
+	maxValue := float64(quantMax+1) / 166
+	sb.WriteString(base83(quantMax, 1))
+
+	dc := factors[0]
+	sb.WriteString(base83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+	for _, f := range factors[1:] {
+		var q [3]int
+		for c, v := range f {
+			q[c] = int(max(0, min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		sb.WriteString(base83(q[0]*19*19+q[1]*19+q[2], 2))
+	}
+	return sb.String()
+}
+
+// base83() encodes n in length base 83 digits.
+func base83(n, length int) string {
+	b := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = base83Chars[n%83]
+		n /= 83
+	}
+	return string(b)
+}
+
+// srgbToLinear() converts an sRGB colour channel to linear light.
+func srgbToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+// linearToSRGB() converts linear light back to an sRGB colour channel.
+func linearToSRGB(v float64) int {
+	v = max(0, min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+// signPow() raises the magnitude of v to exp, keeping its sign.
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
@@ -0,0 +1,120 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// csrf.go houses the protections against cross-site request forgery. Since
+// the "token" cookie is sent with every request to the site, including those
+// started by other sites, routes which change state must:
+//   - only accept POST or DELETE requests,
+//   - come from a page on this site, as told by the Origin and Sec-Fetch-Site
+//     headers, and
+//   - carry the users CSRF token in the X-CSRF-Token header, which other
+//     sites can't read.
+//
+// Requests authenticated with an API token don't carry the cookie's ambient
+// authority, and so don't need a CSRF token.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// csrfToken() returns the users CSRF token. It's derived from their ID with
+// the servers secret, so it doesn't need to be stored, and stays the same
+// while the "token" cookie is renewed on every request.
+func csrfToken(c *credentials) string {
+	mac := hmac.New(sha256.New, hmacSampleSecret)
+	mac.Write([]byte("csrf:" + c.User.ID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// requireCSRF is used as a middleware function, inside of checkAuth(), for
+// routes which change state. Only POST and DELETE requests are allowed, and
+// users signed in with the "token" cookie must send their CSRF token.
+func requireCSRF(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "POST, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			log.Println(status(w, "Method Not Allowed", nil))
+			return
+		}
+		c, ok := r.Context().Value(ctxkey).(*credentials)
+		if ok && c.IsLoggedIn && c.Scopes == nil {
+			sent := r.Header.Get("X-CSRF-Token")
+			if !hmac.Equal([]byte(sent), []byte(csrfToken(c))) {
+				w.WriteHeader(http.StatusForbidden)
+				log.Println(status(w, "Invalid CSRF Token", nil))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkOrigin is used as a middleware function around the whole multiplexer.
+// It refuses requests which could change state when the browser says they
+// came from another site. Requests without either header, such as those
+// made by scripts, are let through.
+func checkOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch r.Header.Get("Sec-Fetch-Site") {
+		case "", "same-origin", "none":
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			log.Println(status(w, "Cross Site Request Refused", nil))
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" && !sameOrigin(origin, r) {
+			w.WriteHeader(http.StatusForbidden)
+			log.Println(status(w, "Cross Origin Request Refused", nil))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sameOrigin() reports whether the Origin header sent with a request names
+// this site, either as the host the request was sent to, or as configured in
+// bolt.conf.json.
+func sameOrigin(origin string, r *http.Request) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return u.Host == r.Host || u.Host == appConf.App.DomainName
+}
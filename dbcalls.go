@@ -41,15 +41,146 @@
 //                    USERS - KEY to ZSET containing reference keys to user
 //                            profile data, ranked by user score (for now).
 //
-//        [loginEmail]:HASH - KEY to VALUE which is the password HASH
-//                            associated with the loginEmail.
+//                   EMAILS - KEY to HASH mapping each login email to the
+//                            associated user ID, which is then used to look
+//                            up the users credentials and profile data.
 //
-//                   [HASH] - KEY to VALUE which is the authenticated users
-//                            user ID, which is then used to look up the users
-//                            profile data.
+//    [user.ID]:CREDENTIALS - KEY to HASH of the users private credentials,
+//                            such as their password hash and TOTP secret.
+//                            Unlike [user.ID], this is never sent to the
+//                            client.
+//
+//  [user.ID]:RECOVERYCODES - KEY to SET containing the hashes of the users
+//                            unused two-factor recovery codes.
+//
+//   [user.ID]:TOTPUSED:[n] - KEY to VALUE marking TOTP time step n as used,
+//                            so a code can't be replayed. Expires shortly.
+//
+//   [user.ID]:TOTPATTEMPTS - KEY to a counter of failed second step signin
+//                            attempts. Expires after a few minutes.
+//
+//    [user.ID]:SIGNINFAILS - KEY to a counter of signin attempts against an
+//  IP:[addr]:SIGNINFAILS     account, or from an IP address, which haven't
+//                            succeeded. Expires a day after the first one.
+//
+//        [user.ID]:LOCKOUT - KEY to VALUE marking an account, or an IP
+//        IP:[addr]:LOCKOUT   address, as locked out of signin. Expires when
+//                            the lockout ends.
+//
+//          OIDC:[provider] - KEY to HASH mapping the subject identifiers of
+//                            an external identity provider to user IDs.
+//
+//        OIDCSTATE:[state] - KEY to VALUE holding the JSON of an oidcState{},
+//                            remembered while the user signs in with an
+//                            identity provider. Expires after ten minutes.
+//
+//          APITOKEN:[hash] - KEY to HASH of an apiToken{}, found by the SHA-256
+//                            hash of the token. Expires with the token.
+//
+//      [user.ID]:APITOKENS - KEY to HASH mapping the IDs of the users API
+//                            tokens to their hashes.
+//
+//         [user.ID]:EXPORT - KEY to HASH of the users exportJob{}, which
+//                            expires along with the export archive.
+//
+// [user.ID]:EXPORTREQUESTS - KEY to a counter of data exports the user has
+//                            requested today. Expires daily.
+//
+//        [user.ID]:BLOCKED - KEY to SET containing the IDs of the users the
+//                            user has blocked.
+//
+//      [user.ID]:BLOCKEDBY - KEY to SET containing the IDs of the users who
+//                            have blocked the user, the reverse of BLOCKED.
+//
+//          [user.ID]:MUTED - KEY to SET containing the IDs of the users the
+//                            user has muted.
+//
+//  RATE:[action]:[user.ID] - KEY to HASH of the token bucket used to rate
+//  RATE:[action]:IP:[addr]   limit an action by a user, or an IP address.
+//                            Expires once the bucket is full again.
+//
+//       SPAM:WORDS:[label] - KEY to HASH mapping each token to the number of
+//                            posts labelled "spam" or "ham" containing it,
+//                            used by the spam filters classifier.
+//
+//                SPAM:DOCS - KEY to HASH of the number of posts the spam
+//                            filter has been trained on, by label.
+//
+//              SPAM:LABELS - KEY to HASH mapping the IDs of the posts the
+//                            spam filter has been trained on to their label.
+//
+//        SPAM:DUPES:[hash] - KEY to a counter of posts with the same text,
+//                            by its hash. Expires a day after the first.
+//
+//            INVITE:[code] - KEY to HASH of an invite{} code. Expires with the
+//                            code, if it does.
+//
+//        [user.ID]:INVITES - KEY to ZSET containing the users invite codes,
+//                            scored by when they were made.
+//
+//        [user.ID]:INVITED - KEY to ZSET containing the IDs of the users the
+//                            user invited, scored by when they signed up.
+//
+//                 WAITLIST - KEY to ZSET containing the IDs of the users
+//                            waiting for an admin to approve their signup,
+//                            scored by when they signed up.
+//
+//             POWUSED:[id] - KEY to VALUE marking a proof-of-work challenge as
+//                            used. Expires along with the challenge.
+//
+//           SIGNUPS:[hour] - KEY to a counter of signups during an hour, as
+//                            hours since the unix epoch. Expires after two.
+//
+//              UPLOAD:[id] - KEY to HASH of a resumable{} upload, while it's
+//                            sent in chunks. Expires a day after the last.
+//
+//          UPLOADLOCK:[id] - KEY to VALUE marking a chunk of an upload as
+//                            being written. Expires after a few minutes.
+//
+//                 BLOBREFS - KEY to HASH mapping the path of each stored media
+//                            blob to the number of posts and profiles which
+//                            use it.
+//
+//              BLOBORPHANS - KEY to ZSET containing the paths of blobs which
+//                            nothing uses any more, scored by when they were
+//                            let go, waiting to be garbage-collected.
+//
+//          BLOBLOCK:[path] - KEY to VALUE marking a blob as being referenced
+//                            or removed. Expires after a minute.
+//
+//          [user.ID]:USAGE - KEY to HASH of the storage{} the users uploads use,
+//                            in bytes and files. see: quota.go
+//
+// [user.ID]:PENDINGUPLOADS - KEY to ZSET of the users resumable uploads which
+//                            haven't finished, as [id]:[size], scored by
+//                            when they expire. They count against the quota.
+//
+//           MEDIABLOCKLIST - KEY to HASH mapping the perceptual hashes of blocked
+//                            images to the JSON of their blockedMedia{}.
+//
+//              REPORT:[id] - KEY to HASH of a report{} of an abusive post or
+//                            user.
+//
+//              REPORTQUEUE - KEY to ZSET containing the IDs of open and
+//                            claimed reports, scored by when they were made.
+//
+//              REPORTSDONE - KEY to ZSET containing the IDs of resolved
+//                            reports, scored by when they were resolved.
+//
+//    [user.ID]:REPORTSMADE - KEY to a counter of reports the user made in the
+//                            last hour. Expires hourly.
+//
+//                   MODLOG - KEY to LIST of the JSON of modAction{}s, the
+//                            audit trail of moderator actions, newest first.
+//
+//               MIGRATIONS - KEY to SET containing the names of the one-time
+//                            data migrations that have already been run.
 //
 //                [user.ID] - KEY to HASH of the associated users data.
 //
+//  [user.ID]:VERIFYRESENDS - KEY to a counter of verification emails sent to
+//                            the user in the last hour. Expires hourly.
+//
 //   [user.ID]:POSTSINORDER - KEY to ZSET containing reference keys to a
 //                            users posts (IDs) in chronological order.
 //
@@ -89,160 +220,1569 @@
 
 package main
 
-import (
-	"encoding/json"
-	"log"
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Instead of re-using string values that could be spelled incorrectly, we set
+// these redis identifiers as variables, so that any incorrect spelling should
+// cause the code to error.
+var (
+	TAGSBYSCORE    string = "TAGSBYSCORE"
+	POSTSBYSCORE   string = "POSTSBYSCORE"
+	LIKESINORDER   string = ":LIKESINORDER"
+	REPLIESINORDER string = ":REPLIESINORDER"
+	POSTSINORDER   string = ":POSTSINORDER"
+	ALLPOSTS       string = "POSTSINORDER"
+	USERPOSTSSCORE string = ":POSTSBYSCORE"
+	FRIENDSINORDER string = ":FRIENDSINORDER"
+	HASH           string = ":HASH"
+	USERS          string = "USERS"
+	EMAILS         string = "EMAILS"
+	CREDENTIALS    string = ":CREDENTIALS"
+	MIGRATIONS     string = "MIGRATIONS"
+	RECOVERYCODES  string = ":RECOVERYCODES"
+	TOTPUSED       string = ":TOTPUSED:"
+	TOTPATTEMPTS   string = ":TOTPATTEMPTS"
+	SIGNINFAILS    string = ":SIGNINFAILS"
+	LOCKOUT        string = ":LOCKOUT"
+	OIDC           string = "OIDC:"
+	OIDCSTATE      string = "OIDCSTATE:"
+	VERIFYRESENDS  string = ":VERIFYRESENDS"
+	APITOKEN       string = "APITOKEN:"
+	APITOKENS      string = ":APITOKENS"
+	EXPORT         string = ":EXPORT"
+	EXPORTREQUESTS string = ":EXPORTREQUESTS"
+	REPORT         string = "REPORT:"
+	REPORTQUEUE    string = "REPORTQUEUE"
+	REPORTSDONE    string = "REPORTSDONE"
+	REPORTSMADE    string = ":REPORTSMADE"
+	MODLOG         string = "MODLOG"
+	BLOCKED        string = ":BLOCKED"
+	BLOCKEDBY      string = ":BLOCKEDBY"
+	MUTED          string = ":MUTED"
+	RATE           string = "RATE:"
+	SPAMWORDS      string = "SPAM:WORDS:"
+	SPAMDOCS       string = "SPAM:DOCS"
+	SPAMLABELS     string = "SPAM:LABELS"
+	SPAMDUPES      string = "SPAM:DUPES:"
+	POWUSED        string = "POWUSED:"
+	INVITE         string = "INVITE:"
+	INVITES        string = ":INVITES"
+	INVITED        string = ":INVITED"
+	WAITLIST       string = "WAITLIST"
+	SIGNUPS        string = "SIGNUPS:"
+	UPLOAD         string = "UPLOAD:"
+	UPLOADLOCK     string = "UPLOADLOCK:"
+	BLOBREFS       string = "BLOBREFS"
+	BLOBORPHANS    string = "BLOBORPHANS"
+	BLOBLOCK       string = "BLOBLOCK:"
+	USAGE          string = ":USAGE"
+	PENDINGUPLOADS string = ":PENDINGUPLOADS"
+	MEDIABLOCKLIST string = "MEDIABLOCKLIST"
+	LIKESBYRANK    string = ":LIKESBYRANK"
+)
+
+// cache() is used in the main() function to cache the database occasionally.
+// This is a crude implementation, and the final cacheing mechanism will be
+// much more optimized and robust. Currently we just get the post IDs, which
+// are stored in a sorted set and ranked numerically, and then get each post by
+// using the keys returned, which are the post IDs in order of rank (score).
+func cache() {
+	postIDs, err := zrangePostsByScore() // see: zrangePostsByScore()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	getPostsByID(postIDs) // see: getPostsByID()
+}
+
+// getIDByEmail() is used to get the user ID associated with a login email.
+// This is used to look up the users credentials and data/profile info.
+func getIDByEmail(email string) (string, error) {
+	return rdb.HGet(rdx, EMAILS, email).Result()
+}
+
+// claimEmail() associates a login email with a user ID, but only if the email
+// isn't already in use. It returns false if the email is taken.
+func claimEmail(email, id string) (bool, error) {
+	return rdb.HSetNX(rdx, EMAILS, email, id).Result()
+}
+
+// changeEmail() moves a user to a new login email. The new email is claimed
+// first so two users can't race for it, then the users profile is updated and
+// the old email is released. The new email must be verified again. It returns
+// false if the new email is taken.
+func changeEmail(c *credentials, email string) (bool, error) {
+	ok, err := claimEmail(email, c.User.ID)
+	if err != nil || !ok {
+		return ok, err
+	}
+	_, err = rdb.TxPipelined(rdx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(rdx, c.User.ID, "email", email, "unverified", true)
+		pipe.HDel(rdx, EMAILS, c.User.Email)
+		return nil
+	})
+	return err == nil, err
+}
+
+// zhPost(*post) is used as a one-liner to add a post to the database. This
+// will add the posts ID to the ranked set, the chronological set, and add the
+// post data to the database using HMSet.
+func zhPost(p *post) error {
+	_, err := zaddPostsChron(p) // see: zaddPostsChron()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	_, err = zaddPostsScore(p) // see: zaddPostsScore()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	return setPost(p) // see: setPost()
+}
+
+// getPostsByID() takes a slice of IDs (use a one item slice for 1 ID) and uses
+// getPost() to marshal the post data into a post{} that can be passed around
+// by our program. It furthermore recursively checks each post for comments
+// stored in a zset of the following pattern: post.ID:REPLIESINORDER where
+// post.ID is the posts ID that which we query. Finally, we set the stream
+// variable to the new []*post{}.
+// TODO: Add option to sort replies by likes/score using post.ID:REPLIESBYSCORE
+func getPostsByID(ids []string) []*post {
+	items := postsByID(ids, false)
+
+	// set the stream to the new slice of posts.
+	stream = items
+
+	return items
+}
+
+// postsByID() does the work of getPostsByID(), without setting the stream.
+// Posts hidden by a moderator are left out, unless withHidden is set, for
+// moderators.
+func postsByID(ids []string, withHidden bool) []*post {
+	// get the "root" level post(s).
+	var items []*post = []*post{}
+	for _, id := range ids {
+		i, err := getPost(id) // see: getPost()
+		if err != nil {
+			log.Println(err)
+		}
+		if i.Hidden && !withHidden {
+			continue
+		}
+		items = append(items, &i)
+	}
+
+	// get the comments from each post. TODO: Update the amount returned
+	// so it only goes a few comments deep.
+	for _, p := range items {
+		replies, err := rdb.ZRange(
+			rdx, p.ID+REPLIESINORDER, 0, -1,
+		).Result()
+		if err != nil {
+			log.Println(err)
+		}
+		p.Comments = append(p.Comments, postsByID(replies, withHidden)...)
+	}
+	return items
+}
+
+// setPasswordHash() is used to store the password hash in the users private
+// credentials record, so that when a user logs in, their user ID (looked up
+// by email) can be used to look up the hash. Passwords are never stored in
+// plain text.
+func setPasswordHash(c *credentials, hash string) error {
+	return rdb.HSet(rdx, c.User.ID+CREDENTIALS, "hash", hash).Err()
+}
+
+// getPasswordHash() is used to get the password hash from the users private
+// credentials record, to verify the password.
+func getPasswordHash(c *credentials) (string, error) {
+	return rdb.HGet(rdx, c.User.ID+CREDENTIALS, "hash").Result()
+}
+
+// credentialsMigration is the reporter of the reports made for accounts
+// whose login email collided with another when it was lowercased.
+const credentialsMigration = "credentials-migration"
+
+// migrateCredentials() is a one-time migration from the original credential
+// layout, where [loginEmail]:HASH held the password hash and the hash itself
+// was a key holding the user ID, to the EMAILS index and the private
+// [user.ID]:CREDENTIALS record. It's run at startup and does nothing once it
+// has completed. Accounts whose lowercased email is already taken are
+// migrated under fallbackEmail(), and reported so an admin can sort them
+// out. Any other failure leaves the migration to be run again next time.
+func migrateCredentials() error {
+	done, err := rdb.SIsMember(rdx, MIGRATIONS, "credentials").Result()
+	if err != nil || done {
+		return err
+	}
+
+	failed := 0
+	iter := rdb.Scan(rdx, 0, "*"+HASH, 0).Iterator()
+	for iter.Next(rdx) {
+		key := iter.Val()
+		original := strings.TrimSuffix(key, HASH)
+		hash, err := rdb.Get(rdx, key).Result()
+		if err != nil {
+			log.Println(key, err)
+			failed++
+			continue
+		}
+		id, err := rdb.Get(rdx, hash).Result()
+		if err != nil {
+			log.Println(key, err)
+			failed++
+			continue
+		}
+		email := strings.ToLower(original)
+		ok, err := claimOwnEmail(email, id)
+		if err == nil && !ok {
+			email = fallbackEmail(email, id)
+			if ok, err = claimOwnEmail(email, id); ok {
+				reportEmailCollision(id, original, email)
+			}
+		}
+		if err != nil || !ok {
+			log.Println("couldn't migrate", original, err)
+			failed++
+			continue
+		}
+		_, err = rdb.TxPipelined(rdx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(rdx, id+CREDENTIALS, "hash", hash)
+			pipe.HSet(rdx, id, "email", email)
+			pipe.Del(rdx, key, hash)
+			return nil
+		})
+		if err != nil {
+			log.Println(key, err)
+			failed++
+		}
+	}
+	if err = iter.Err(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("couldn't migrate the credentials of %d accounts", failed)
+	}
+	return rdb.SAdd(rdx, MIGRATIONS, "credentials").Err()
+}
+
+// claimOwnEmail() claims a login email for the user, as claimEmail() does,
+// but also returns true if they already have it, as they would if an earlier
+// run of migrateCredentials() stopped partway.
+func claimOwnEmail(email, id string) (bool, error) {
+	ok, err := claimEmail(email, id)
+	if err != nil || ok {
+		return ok, err
+	}
+	owner, err := getIDByEmail(email)
+	return owner == id, err
+}
+
+// fallbackEmail() returns the login email an account is migrated under when
+// its own is taken, which is its own with the users ID added as a sub
+// address, such as name+[user.ID]@example.com, so it's the same every time.
+func fallbackEmail(email, id string) string {
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok {
+		return email + "+" + id
+	}
+	return local + "+" + id + "@" + domain
+}
+
+// reportEmailCollision() reports an account which was migrated under its
+// fallbackEmail(), so an admin can let the user know how to sign in.
+func reportEmailCollision(id, original, fallback string) {
+	err := addReport(&report{
+		ID:         genID(15),
+		Reporter:   credentialsMigration,
+		TargetType: "user",
+		Target:     id,
+		Reason:     "other",
+		Text: fmt.Sprintf("%s is taken by another account once lowercased, "+
+			"so this account now signs in with %s", original, fallback),
+		Created: time.Now().Unix(),
+		Status:  "open",
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// migrateBlobs() is a one-time migration moving the files uploaded before
+// the blob store existed into it, so duplicates of them are stored once, and
+// they're garbage-collected like any other. see: blob.go
+func migrateBlobs() error {
+	done, err := rdb.SIsMember(rdx, MIGRATIONS, "blobs").Result()
+	if err != nil || done {
+		return err
+	}
+
+	ids, err := rdb.ZRange(rdx, ALLPOSTS, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		// the fields posts had before attachments. see: migrateAttachments()
+		vals, err := rdb.HMGet(rdx, id, "temp_file_name", "media_type").Result()
+		if err != nil {
+			log.Println(id, err)
+			continue
+		}
+		path, _ := vals[0].(string)
+		markup, _ := vals[1].(string)
+		if isBlob(path) || !uploadedFile(path) {
+			continue
+		}
+		blob, _, err := storeBlob(path, nil)
+		if err != nil {
+			log.Println("couldn't migrate", path, err)
+			continue
+		}
+		err = rdb.HSet(rdx, id, "temp_file_name", blob, "media_type",
+			strings.ReplaceAll(markup, path, blob)).Err()
+		if err != nil {
+			log.Println(id, err)
+		}
+	}
+	return rdb.SAdd(rdx, MIGRATIONS, "blobs").Err()
+}
+
+// migrateAttachments() is a one-time migration from the single file posts
+// had, kept as its path in temp_file_name and the HTML showing it in
+// media_type, to their list of attachments. see: legacyAttachment()
+func migrateAttachments() error {
+	done, err := rdb.SIsMember(rdx, MIGRATIONS, "attachments").Result()
+	if err != nil || done {
+		return err
+	}
+
+	ids, err := rdb.ZRange(rdx, ALLPOSTS, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		vals, err := rdb.HMGet(rdx, id, "temp_file_name", "media_type").Result()
+		if err != nil {
+			log.Println(id, err)
+			continue
+		}
+		path, _ := vals[0].(string)
+		markup, _ := vals[1].(string)
+		var as attachments
+		if path != "" {
+			as = attachments{legacyAttachment(path, markup)}
+		}
+		_, err = rdb.TxPipelined(rdx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(rdx, id, "attachments", as)
+			pipe.HDel(rdx, id, "temp_file_name", "media_type", "Media")
+			return nil
+		})
+		if err != nil {
+			log.Println(id, err)
+		}
+	}
+	return rdb.SAdd(rdx, MIGRATIONS, "attachments").Err()
+}
+
+// securityFields are the fields of a users profile which decide what they're
+// allowed to do. They're written once by createProfile(), and after that only
+// by the targeted HSet()s that change them, such as enableTOTP() or setRole(),
+// so a stale copy of the profile saved by setProfile() can't undo a ban, or
+// hand back a role.
+var securityFields = []string{
+	"two_factor", "unverified", "level", "suspended_until", "banned",
+	"warnings", "throttle", "invited_by", "waitlisted",
+}
+
+// profileMap() converts a users profile data into a map[string]any by first
+// marshalling it into a []byte{} containing its JSON representation, then
+// unmarshalling that into the map.
+// TODO: There's a way to do this without a map.
+func profileMap(u *user) (map[string]any, error) {
+	// Marshal the user/profile data into its JSON representation in []byte
+	// form.
+	b, err := json.Marshal(u)
+	if err != nil {
+		return nil, err
+	}
+
+	// initialize our map.
+	var pmap map[string]any = make(map[string]any)
+
+	// Unmarshal the JSON representation into the map
+	err = json.Unmarshal(b, &pmap)
+	return pmap, err
+}
+
+// createProfile() stores a new users whole profile, including the
+// securityFields they start out with, using the redis HMSet() functionality.
+// It's only called once, at signup.
+func createProfile(c *credentials) error {
+	pmap, err := profileMap(c.User)
+	if err != nil {
+		return err
+	}
+	return rdb.HMSet(rdx, c.User.ID, pmap).Err()
+}
+
+// setProfile() saves changes to a users profile data in the database using
+// the redis HMSet() functionality. The securityFields are left out, see:
+// securityFields.
+func setProfile(c *credentials) error {
+	pmap, err := profileMap(c.User)
+	if err != nil {
+		return err
+	}
+	for _, f := range securityFields {
+		delete(pmap, f)
+	}
+
+	// Add the data using HMSet(), returning any errors.
+	return rdb.HMSet(rdx, c.User.ID, pmap).Err()
+}
+
+// setPost() sets a post in the database using the redis HMSet() functionality.
+func setPost(i *post) error {
+	// Add the post data using HMSet(), returning any errors.
+	return rdb.HMSet(rdx, i.ID, *i).Err()
+}
+
+// scanProfile() is used to scan a users profile into the &user{} struct to
+// be passed around by in credentials{}.
+func scanProfile(c *credentials) error {
+	return rdb.HGetAll(rdx, c.User.ID).Scan(c.User)
+}
+
+// setVerified() clears the users "unverified" flag, marking their email
+// address as verified.
+func setVerified(c *credentials) error {
+	return rdb.HSet(rdx, c.User.ID, "unverified", false).Err()
+}
+
+// incrExpire() increments and returns a counter, which expires ttl after it
+// was first incremented. It's used for simple rate limiting.
+func incrExpire(key string, ttl time.Duration) (int64, error) {
+	n, err := rdb.Incr(rdx, key).Result()
+	if err != nil {
+		return n, err
+	}
+	if n == 1 {
+		err = rdb.Expire(rdx, key, ttl).Err()
+	}
+	return n, err
+}
+
+// incrVerifyResends() increments and returns the number of verification
+// emails requested by a user in the current hour. The counter expires an hour
+// after the first request.
+func incrVerifyResends(c *credentials) (int64, error) {
+	return incrExpire(c.User.ID+VERIFYRESENDS, time.Hour)
+}
+
+// incrTOTPAttempts() increments and returns the number of failed second step
+// signin attempts for a user in the last five minutes. Each attempt is
+// counted before its code is checked, and forgotten if it's good. see:
+// clearTOTPAttempts()
+func incrTOTPAttempts(id string) (int64, error) {
+	return incrExpire(id+TOTPATTEMPTS, 5*time.Minute)
+}
+
+// clearTOTPAttempts() forgets a users failed second step signin attempts,
+// once they've signed in.
+func clearTOTPAttempts(id string) error {
+	return rdb.Del(rdx, id+TOTPATTEMPTS).Err()
+}
+
+// signinAttempt counts a signin attempt against the account or IP whose
+// failure counter is KEYS[1] and lockout is KEYS[2], unless it's locked out.
+// The attempt which reaches the limit, ARGV[2], locks it out for ARGV[3]
+// milliseconds, doubling with each attempt after that up to ARGV[4]. It
+// returns the number of attempts, or 0 and the milliseconds left if it's
+// locked out. Doing this in one step means attempts made at the same time
+// can't all get past the lockout.
+var signinAttempt = redis.NewScript(`
+local ttl = redis.call("PTTL", KEYS[2])
+if ttl > 0 then
+	return {0, ttl}
+end
+local n = redis.call("INCR", KEYS[1])
+if n == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+local limit = tonumber(ARGV[2])
+if n >= limit then
+	local d = math.min(tonumber(ARGV[3]) * 2 ^ (n - limit), tonumber(ARGV[4]))
+	redis.call("SET", KEYS[2], 1, "PX", math.floor(d))
+end
+return {n, 0}
+`)
+
+// claimSigninAttempt() counts a signin attempt against the account or IP
+// identified by prefix before the password is checked, locking it out once
+// the limit is reached. It returns the number of attempts in the last day, or
+// 0 and how much longer it's locked out for.
+func claimSigninAttempt(prefix string, limit int64, base, longest time.Duration) (int64, time.Duration, error) {
+	res, err := signinAttempt.Run(rdx, rdb, []string{prefix + SIGNINFAILS, prefix + LOCKOUT},
+		(24 * time.Hour).Milliseconds(), limit, base.Milliseconds(), longest.Milliseconds()).Int64Slice()
+	if err != nil {
+		return 0, 0, err
+	}
+	return res[0], time.Duration(res[1]) * time.Millisecond, nil
+}
+
+// releaseAttempt takes back a signin attempt from the counter at KEYS[1],
+// unless it's expired since, and if ARGV[1] is 1, the lockout at KEYS[2].
+var releaseAttempt = redis.NewScript(`
+if (tonumber(redis.call("GET", KEYS[1])) or 0) > 0 then
+	redis.call("DECR", KEYS[1])
+end
+if ARGV[1] == "1" then
+	redis.call("DEL", KEYS[2])
+end
+return 0
+`)
+
+// releaseSigninAttempt() takes back an attempt which succeeded from the IP
+// identified by prefix, along with the lockout it set, if it set one. n is
+// what claimSigninAttempt() returned for it.
+func releaseSigninAttempt(prefix string, n, limit int64) error {
+	locked := 0
+	if n >= limit {
+		locked = 1
+	}
+	return releaseAttempt.Run(rdx, rdb, []string{prefix + SIGNINFAILS, prefix + LOCKOUT}, locked).Err()
+}
+
+// clearSigninFailures() forgets the failed signin attempts against the
+// account or IP identified by prefix.
+func clearSigninFailures(prefix string) error {
+	return rdb.Del(rdx, prefix+SIGNINFAILS, prefix+LOCKOUT).Err()
+}
+
+// setOIDCState() remembers the state of an identity provider login for ten
+// minutes, under the state parameter sent to the provider.
+func setOIDCState(state string, st *oidcState) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return rdb.Set(rdx, OIDCSTATE+state, b, 10*time.Minute).Err()
+}
+
+// takeOIDCState() returns and forgets the state of an identity provider
+// login, so that it can only be used once.
+func takeOIDCState(state string) (*oidcState, error) {
+	b, err := rdb.GetDel(rdx, OIDCSTATE+state).Bytes()
+	if err != nil {
+		return nil, err
+	}
+	st := new(oidcState)
+	return st, json.Unmarshal(b, st)
+}
+
+// getOIDCLink() returns the ID of the user linked to the providers subject,
+// or an empty string if there isn't one.
+func getOIDCLink(provider, sub string) (string, error) {
+	id, err := rdb.HGet(rdx, OIDC+provider, sub).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return id, err
+}
+
+// linkOIDC() links the providers subject to a user ID, unless it's already
+// linked to someone. It returns false if it was.
+func linkOIDC(provider, sub, id string) (bool, error) {
+	return rdb.HSetNX(rdx, OIDC+provider, sub, id).Result()
+}
+
+// setAPIToken() stores a new API token under its hash, and adds it to the
+// users list of tokens.
+func setAPIToken(hash string, t *apiToken) error {
+	_, err := rdb.TxPipelined(rdx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(rdx, APITOKEN+hash, t)
+		if t.Expires > 0 {
+			pipe.ExpireAt(rdx, APITOKEN+hash, time.Unix(t.Expires, 0))
+		}
+		pipe.HSet(rdx, t.UserID+APITOKENS, t.ID, hash)
+		return nil
+	})
+	return err
+}
+
+// getAPIToken() returns the API token with the given hash, or redis.Nil if
+// there isn't one.
+func getAPIToken(hash string) (*apiToken, error) {
+	t := new(apiToken)
+	if err := rdb.HGetAll(rdx, APITOKEN+hash).Scan(t); err != nil {
+		return nil, err
+	}
+	if t.ID == "" {
+		return nil, redis.Nil
+	}
+	return t, nil
+}
+
+// getAPITokens() returns the users API tokens. Tokens which have expired are
+// removed from their list as they're found.
+func getAPITokens(c *credentials) ([]*apiToken, error) {
+	ids, err := rdb.HGetAll(rdx, c.User.ID+APITOKENS).Result()
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]*apiToken, 0, len(ids))
+	for id, hash := range ids {
+		t, err := getAPIToken(hash)
+		if err == redis.Nil {
+			rdb.HDel(rdx, c.User.ID+APITOKENS, id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, nil
+}
+
+// countAPITokens() returns how many API tokens the user has, including any
+// expired tokens not yet removed from their list.
+func countAPITokens(c *credentials) (int64, error) {
+	return rdb.HLen(rdx, c.User.ID+APITOKENS).Result()
+}
+
+// touchAPIToken() records when an API token was last used.
+func touchAPIToken(hash string, t time.Time) error {
+	return rdb.HSet(rdx, APITOKEN+hash, "last_used", t.Unix()).Err()
+}
+
+// revokeAPIToken() deletes one of the users API tokens. It returns false if
+// the user has no token with that ID.
+func revokeAPIToken(c *credentials, id string) (bool, error) {
+	hash, err := rdb.HGet(rdx, c.User.ID+APITOKENS, id).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = rdb.TxPipelined(rdx, func(pipe redis.Pipeliner) error {
+		pipe.Del(rdx, APITOKEN+hash)
+		pipe.HDel(rdx, c.User.ID+APITOKENS, id)
+		return nil
+	})
+	return err == nil, err
+}
+
+// incrExportRequests() counts the data exports the user has requested today.
+func incrExportRequests(c *credentials) (int64, error) {
+	return incrExpire(c.User.ID+EXPORTREQUESTS, 24*time.Hour)
+}
+
+// setExport() stores the state of the users data export, which is forgotten
+// after ttl.
+func setExport(c *credentials, job *exportJob, ttl time.Duration) error {
+	_, err := rdb.TxPipelined(rdx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(rdx, c.User.ID+EXPORT, job)
+		pipe.Expire(rdx, c.User.ID+EXPORT, ttl)
+		return nil
+	})
+	return err
+}
+
+// getExport() returns the state of the users data export, or redis.Nil if
+// they haven't requested one recently.
+func getExport(c *credentials) (*exportJob, error) {
+	job := new(exportJob)
+	if err := rdb.HGetAll(rdx, c.User.ID+EXPORT).Scan(job); err != nil {
+		return nil, err
+	}
+	if job.Status == "" {
+		return nil, redis.Nil
+	}
+	return job, nil
+}
+
+// getUsersPostIDs() returns the IDs of all of the users posts and replies, in
+// chronological order.
+func getUsersPostIDs(c *credentials) ([]string, error) {
+	return rdb.ZRange(rdx, c.User.ID+POSTSINORDER, 0, -1).Result()
+}
+
+// getUsersLikeIDs() returns the IDs of all of the posts the user likes.
+func getUsersLikeIDs(c *credentials) ([]string, error) {
+	return rdb.ZRange(rdx, c.User.ID+LIKESINORDER, 0, -1).Result()
+}
+
+// getUsersFriendIDs() returns the IDs of all of the users friends.
+func getUsersFriendIDs(c *credentials) ([]string, error) {
+	return rdb.ZRange(rdx, c.User.ID+FRIENDSINORDER, 0, -1).Result()
+}
+
+// removePost() removes a post from the database. Posts which others have
+// replied to are kept so the replies aren't lost, but their content is
+// removed, and their author replaced with author. It returns true if the post
+// was removed entirely.
+func removePost(p *post, author string) (bool, error) {
+	n, err := rdb.ZCard(rdx, p.ID+REPLIESINORDER).Result()
+	if err != nil {
+		return false, err
+	}
+	if n > 0 {
+		return false, rdb.HSet(rdx, p.ID, "author", author, "uptext", "",
+			"attachments", "").Err()
+	}
+	_, err = rdb.TxPipelined(rdx, func(pipe redis.Pipeliner) error {
+		pipe.Del(rdx, p.ID)
+		pipe.ZRem(rdx, ALLPOSTS, p.ID)
+		pipe.ZRem(rdx, POSTSBYSCORE, p.ID)
+		pipe.ZRem(rdx, p.Author+POSTSINORDER, p.ID)
+		if p.Parent != "" {
+			pipe.ZRem(rdx, p.Parent+REPLIESINORDER, p.ID)
+		}
+		return nil
+	})
+	return err == nil, err
+}
+
+// forgetLikes() removes the IDs of removed posts from every users likes.
+// There's no index of who likes a post, so we look through all of them.
+func forgetLikes(ids ...any) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	iter := rdb.Scan(rdx, 0, "*"+LIKESINORDER, 0).Iterator()
+	for iter.Next(rdx) {
+		if err := rdb.ZRem(rdx, iter.Val(), ids...).Err(); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+// deleteUser() removes a user and everything keyed by their ID from the
+// database. Their likes are undone, and they're removed from other users
+// friends. Their posts are removed, except those which others have replied
+// to, which are anonymized so the replies aren't lost. It returns the files
+// the user uploaded, so the caller can remove them from disk.
+func deleteUser(c *credentials) ([]string, error) {
+	id := c.User.ID
+	files := []string{c.User.ProfilePic, c.User.ProfileBG}
+
+	// undo the users likes. setLike() toggles, so this removes each one
+	// and lowers the posts score.
+	likes, err := getUsersLikeIDs(c)
+	if err != nil {
+		return nil, err
+	}
+	for _, pid := range likes {
+		if _, err = setLike(c, pid); err != nil {
+			return nil, err
+		}
+	}
+
+	posts, err := getUsersPostIDs(c)
+	if err != nil {
+		return nil, err
+	}
+	var removed []any
+	for _, pid := range posts {
+		p, err := getPost(pid)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, p.blobPaths()...)
+		// the post data may be missing if its upload failed.
+		p.ID = pid
+		ok, err := removePost(&p, deletedAuthor)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			removed = append(removed, pid)
+		}
+	}
+
+	// There's no index of who has a user as a friend, so we look through
+	// every users friends.
+	iter := rdb.Scan(rdx, 0, "*"+FRIENDSINORDER, 0).Iterator()
+	for iter.Next(rdx) {
+		if err = rdb.ZRem(rdx, iter.Val(), id).Err(); err != nil {
+			return nil, err
+		}
+	}
+	if err = iter.Err(); err != nil {
+		return nil, err
+	}
+	if err = forgetLikes(removed...); err != nil {
+		return nil, err
+	}
+
+	// remove the user from others blocks and mutes.
+	blocked, err := rdb.SMembers(rdx, id+BLOCKED).Result()
+	if err != nil {
+		return nil, err
+	}
+	blockedBy, err := rdb.SMembers(rdx, id+BLOCKEDBY).Result()
+	if err != nil {
+		return nil, err
+	}
+	_, err = rdb.Pipelined(rdx, func(pipe redis.Pipeliner) error {
+		for _, b := range blocked {
+			pipe.SRem(rdx, b+BLOCKEDBY, id)
+		}
+		for _, b := range blockedBy {
+			pipe.SRem(rdx, b+BLOCKED, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	iter = rdb.Scan(rdx, 0, "*"+MUTED, 0).Iterator()
+	for iter.Next(rdx) {
+		if err = rdb.SRem(rdx, iter.Val(), id).Err(); err != nil {
+			return nil, err
+		}
+	}
+	if err = iter.Err(); err != nil {
+		return nil, err
+	}
+
+	// unlink any identity providers.
+	for _, p := range appConf.OIDC {
+		subs, err := rdb.HGetAll(rdx, OIDC+p.Name).Result()
+		if err != nil {
+			return nil, err
+		}
+		for sub, uid := range subs {
+			if uid == id {
+				rdb.HDel(rdx, OIDC+p.Name, sub)
+			}
+		}
+	}
+
+	tokens, err := rdb.HVals(rdx, id+APITOKENS).Result()
+	if err != nil {
+		return nil, err
+	}
+	invites, err := rdb.ZRange(rdx, id+INVITES, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{
+		id, id + CREDENTIALS, id + RECOVERYCODES, id + TOTPATTEMPTS,
+		id + SIGNINFAILS, id + LOCKOUT, id + VERIFYRESENDS, id + APITOKENS,
+		id + EXPORT, id + EXPORTREQUESTS, id + POSTSINORDER,
+		id + USERPOSTSSCORE, id + LIKESINORDER, id + LIKESBYRANK,
+		id + FRIENDSINORDER, id + BLOCKED, id + BLOCKEDBY, id + MUTED,
+		id + INVITES, id + INVITED, id + USAGE, id + PENDINGUPLOADS,
+	}
+	for _, hash := range tokens {
+		keys = append(keys, APITOKEN+hash)
+	}
+	for _, code := range invites {
+		keys = append(keys, INVITE+code)
+	}
+	iter = rdb.Scan(rdx, 0, id+TOTPUSED+"*", 0).Iterator()
+	for iter.Next(rdx) {
+		keys = append(keys, iter.Val())
+	}
+	if err = iter.Err(); err != nil {
+		return nil, err
+	}
+
+	_, err = rdb.TxPipelined(rdx, func(pipe redis.Pipeliner) error {
+		pipe.Del(rdx, keys...)
+		pipe.ZRem(rdx, USERS, id)
+		pipe.ZRem(rdx, WAITLIST, id)
+		pipe.HDel(rdx, EMAILS, c.User.Email)
+		return nil
+	})
+	return files, err
+}
+
+// userExists() reports whether there's a user with the given ID. Posts are
+// also keyed by their ID, so we check the "USERS" zset.
+func userExists(id string) (bool, error) {
+	err := rdb.ZScore(rdx, USERS, id).Err()
+	if err == redis.Nil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// setThrottle() sets the rate limit adjustment of the user with the given
+// ID. see: ratelimit.go
+func setThrottle(id string, percent int) error {
+	ok, err := userExists(id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return redis.Nil
+	}
+	return rdb.HSet(rdx, id, "throttle", percent).Err()
+}
+
+// setRole() sets the role of the user with the given ID. see: roles.go
+func setRole(id string, level int) error {
+	ok, err := userExists(id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return redis.Nil
+	}
+	return rdb.HSet(rdx, id, "level", level).Err()
+}
+
+// getUsers() returns the profiles of the users ranked start through stop in
+// the "USERS" zset.
+func getUsers(start, stop int64) ([]*user, error) {
+	ids, err := rdb.ZRange(rdx, USERS, start, stop).Result()
+	if err != nil {
+		return nil, err
+	}
+	users := make([]*user, 0, len(ids))
+	for _, id := range ids {
+		u := new(user)
+		if err = rdb.HGetAll(rdx, id).Scan(u); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+// blockUser() blocks the user with the given ID, and removes them from each
+// others friends. see: block_handler.go
+func blockUser(c *credentials, id string) error {
+	_, err := rdb.TxPipelined(rdx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(rdx, c.User.ID+BLOCKED, id)
+		pipe.SAdd(rdx, id+BLOCKEDBY, c.User.ID)
+		pipe.ZRem(rdx, c.User.ID+FRIENDSINORDER, id)
+		pipe.ZRem(rdx, id+FRIENDSINORDER, c.User.ID)
+		return nil
+	})
+	return err
+}
+
+// unblockUser() unblocks the user with the given ID.
+func unblockUser(c *credentials, id string) error {
+	_, err := rdb.TxPipelined(rdx, func(pipe redis.Pipeliner) error {
+		pipe.SRem(rdx, c.User.ID+BLOCKED, id)
+		pipe.SRem(rdx, id+BLOCKEDBY, c.User.ID)
+		return nil
+	})
+	return err
+}
+
+// muteUser() mutes or unmutes the user with the given ID.
+func muteUser(c *credentials, id string, mute bool) error {
+	if mute {
+		return rdb.SAdd(rdx, c.User.ID+MUTED, id).Err()
+	}
+	return rdb.SRem(rdx, c.User.ID+MUTED, id).Err()
+}
+
+// getBlocks() returns the IDs of the users the user has blocked and muted.
+func getBlocks(c *credentials) (blocked, muted []string, err error) {
+	if blocked, err = rdb.SMembers(rdx, c.User.ID+BLOCKED).Result(); err != nil {
+		return nil, nil, err
+	}
+	muted, err = rdb.SMembers(rdx, c.User.ID+MUTED).Result()
+	return blocked, muted, err
+}
+
+// getHiddenAuthors() returns the IDs of the users whose posts are hidden from
+// the user: those they blocked or muted, and those who blocked them.
+func getHiddenAuthors(c *credentials) (map[string]bool, error) {
+	ids, err := rdb.SUnion(rdx, c.User.ID+BLOCKED, c.User.ID+BLOCKEDBY,
+		c.User.ID+MUTED).Result()
+	if err != nil {
+		return nil, err
+	}
+	hidden := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		hidden[id] = true
+	}
+	return hidden, nil
+}
+
+// hasBlocked() reports whether user a has blocked user b.
+func hasBlocked(a, b string) (bool, error) {
+	return rdb.SIsMember(rdx, a+BLOCKED, b).Result()
+}
+
+// isBlocked() reports whether either user has blocked the other.
+func isBlocked(a, b string) (bool, error) {
+	cmds, err := rdb.Pipelined(rdx, func(pipe redis.Pipeliner) error {
+		pipe.SIsMember(rdx, a+BLOCKED, b)
+		pipe.SIsMember(rdx, b+BLOCKED, a)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return cmds[0].(*redis.BoolCmd).Val() || cmds[1].(*redis.BoolCmd).Val(), nil
+}
+
+// tokenBucket takes a token from the bucket at KEYS[1], which holds up to
+// ARGV[1] tokens and refills at ARGV[2] tokens per millisecond. ARGV[3] is
+// the current time in milliseconds. It returns 1 if a token was taken, or 0
+// and the milliseconds until one will be available.
+var tokenBucket = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local b = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(b[1]) or capacity
+local ts = tonumber(b[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate)
+local taken, wait = 0, 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	taken = 1
+else
+	wait = math.ceil((1 - tokens) / rate)
+end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil((capacity - tokens) / rate) + 1)
+return {taken, wait}
+`)
+
+// takeToken() takes a token from the bucket rate limiting action for the
+// subject, a user ID or IP address. It returns false, and how long to wait,
+// if the bucket is empty. see: ratelimit.go
+func takeToken(action, subject string, l rateLimit) (bool, time.Duration, error) {
+	rate := float64(l.Burst) / float64(l.Per.Milliseconds())
+	res, err := tokenBucket.Run(rdx, rdb, []string{RATE + action + ":" + subject},
+		l.Burst, rate, time.Now().UnixMilli()).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	return res[0] == 1, time.Duration(res[1]) * time.Millisecond, nil
+}
+
+// incrReportsMade() counts the reports the user made in the last hour.
+func incrReportsMade(c *credentials) (int64, error) {
+	return incrExpire(c.User.ID+REPORTSMADE, time.Hour)
+}
+
+// addReport() stores a new report and adds it to the moderation queue.
+func addReport(rp *report) error {
+	_, err := rdb.TxPipelined(rdx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(rdx, REPORT+rp.ID, rp)
+		pipe.ZAdd(rdx, REPORTQUEUE, redis.Z{Member: rp.ID, Score: float64(rp.Created)})
+		return nil
+	})
+	return err
+}
 
-	"github.com/redis/go-redis/v9"
-)
+// getReport() returns the report with the given ID, or redis.Nil if there
+// isn't one.
+func getReport(id string) (*report, error) {
+	rp := new(report)
+	if err := rdb.HGetAll(rdx, REPORT+id).Scan(rp); err != nil {
+		return nil, err
+	}
+	if rp.ID == "" {
+		return nil, redis.Nil
+	}
+	return rp, nil
+}
 
-// Instead of re-using string values that could be spelled incorrectly, we set
-// these redis identifiers as variables, so that any incorrect spelling should
-// cause the code to error.
-var (
-	TAGSBYSCORE    string = "TAGSBYSCORE"
-	POSTSBYSCORE   string = "POSTSBYSCORE"
-	LIKESINORDER   string = ":LIKESINORDER"
-	REPLIESINORDER string = ":REPLIESINORDER"
-	POSTSINORDER   string = ":POSTSINORDER"
-	FRIENDSINORDER string = ":FRIENDSINORDER"
-	HASH           string = ":HASH"
-	USERS          string = "USERS"
-)
+// getReports() returns the reports ranked start through stop in the zset at
+// key, which is either REPORTQUEUE (oldest first) or REPORTSDONE (newest
+// first).
+func getReports(key string, start, stop int64) ([]*report, error) {
+	get := rdb.ZRange
+	if key == REPORTSDONE {
+		get = rdb.ZRevRange
+	}
+	ids, err := get(rdx, key, start, stop).Result()
+	if err != nil {
+		return nil, err
+	}
+	reports := make([]*report, 0, len(ids))
+	for _, id := range ids {
+		rp, err := getReport(id)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, rp)
+	}
+	return reports, nil
+}
 
-// cache() is used in the main() function to cache the database occasionally.
-// This is a crude implementation, and the final cacheing mechanism will be
-// much more optimized and robust. Currently we just get the post IDs, which
-// are stored in a sorted set and ranked numerically, and then get each post by
-// using the keys returned, which are the post IDs in order of rank (score).
-func cache() {
-	postIDs, err := zrangePostsByScore() // see: zrangePostsByScore()
+// claimReport() claims a report for a moderator. It returns false if another
+// moderator has already claimed it.
+func claimReport(id, moderator string) (bool, error) {
+	ok, err := rdb.HSetNX(rdx, REPORT+id, "moderator", moderator).Result()
 	if err != nil {
-		log.Println(err)
-		return
+		return false, err
 	}
-	getPostsByID(postIDs) // see: getPostsByID()
+	if !ok {
+		current, err := rdb.HGet(rdx, REPORT+id, "moderator").Result()
+		return current == moderator, err
+	}
+	return true, rdb.HSet(rdx, REPORT+id, "status", "claimed",
+		"claimed", time.Now().Unix()).Err()
 }
 
-// getID() is using to get the user ID associated with the password hash of a
-// user whose just been authenticated. This is used to look up the users
-// data/profile info.
-func getID(hash string) (string, error) {
-	return rdb.Get(rdx, hash).Result()
+// releaseReport() returns a claimed report to the queue, so that another
+// moderator can claim it.
+func releaseReport(id string) error {
+	_, err := rdb.TxPipelined(rdx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(rdx, REPORT+id, "moderator", "claimed")
+		pipe.HSet(rdx, REPORT+id, "status", "open")
+		return nil
+	})
+	return err
 }
 
-// zhPost(*post) is used as a one-liner to add a post to the database. This
-// will add the posts ID to the ranked set, the chronological set, and add the
-// post data to the database using HMSet.
-func zhPost(p *post) error {
-	_, err := zaddPostsChron(p) // see: zaddPostsChron()
+// resolveReport() stores the resolution of a report, and moves it from the
+// queue to the resolved reports.
+func resolveReport(rp *report) error {
+	_, err := rdb.TxPipelined(rdx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(rdx, REPORT+rp.ID, "status", "resolved",
+			"resolved", rp.Resolved, "action", rp.Action, "note", rp.Note)
+		pipe.ZRem(rdx, REPORTQUEUE, rp.ID)
+		pipe.ZAdd(rdx, REPORTSDONE, redis.Z{Member: rp.ID, Score: float64(rp.Resolved)})
+		return nil
+	})
+	return err
+}
+
+// logModAction() adds an action to the moderation audit trail. The trail
+// keeps the last 10000 actions.
+func logModAction(a *modAction) error {
+	b, err := json.Marshal(a)
 	if err != nil {
-		log.Println(err)
 		return err
 	}
+	_, err = rdb.TxPipelined(rdx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(rdx, MODLOG, b)
+		pipe.LTrim(rdx, MODLOG, 0, 9999)
+		return nil
+	})
+	return err
+}
 
-	_, err = zaddPostsScore(p) // see: zaddPostsScore()
+// addBlockedMedia() adds images to the media blocklist.
+func addBlockedMedia(blocked ...*blockedMedia) error {
+	_, err := rdb.Pipelined(rdx, func(pipe redis.Pipeliner) error {
+		for _, b := range blocked {
+			j, err := json.Marshal(b)
+			if err != nil {
+				return err
+			}
+			pipe.HSet(rdx, MEDIABLOCKLIST, b.Hash, j)
+		}
+		return nil
+	})
+	return err
+}
+
+// getBlockedMedia() returns the media blocklist, most recently added first.
+func getBlockedMedia() ([]*blockedMedia, error) {
+	entries, err := rdb.HVals(rdx, MEDIABLOCKLIST).Result()
 	if err != nil {
-		log.Println(err)
-		return err
+		return nil, err
 	}
-	return setPost(p) // see: setPost()
+	blocked := make([]*blockedMedia, 0, len(entries))
+	for _, e := range entries {
+		b := new(blockedMedia)
+		if err = json.Unmarshal([]byte(e), b); err != nil {
+			return nil, err
+		}
+		blocked = append(blocked, b)
+	}
+	slices.SortFunc(blocked, func(a, b *blockedMedia) int {
+		return cmp.Compare(b.Added, a.Added)
+	})
+	return blocked, nil
 }
 
-// getPostsByID() takes a slice of IDs (use a one item slice for 1 ID) and uses
-// getPost() to marshal the post data into a post{} that can be passed around
-// by our program. It furthermore recursively checks each post for comments
-// stored in a zset of the following pattern: post.ID:REPLIESINORDER where
-// post.ID is the posts ID that which we query. Finally, we set the stream
-// variable to the new []*post{}.
-// TODO: Add option to sort replies by likes/score using post.ID:REPLIESBYSCORE
-func getPostsByID(ids []string) []*post {
-	// get the "root" level post(s).
-	var items []*post = []*post{}
-	for _, id := range ids {
-		i, err := getPost(id) // see: getPost()
-		if err != nil {
-			log.Println(err)
+// removeBlockedMedia() takes an image off the media blocklist, returning
+// false if it wasn't on it.
+func removeBlockedMedia(hash string) (bool, error) {
+	n, err := rdb.HDel(rdx, MEDIABLOCKLIST, hash).Result()
+	return n > 0, err
+}
+
+// getModLog() returns the most recent n moderator actions.
+func getModLog(n int64) ([]*modAction, error) {
+	entries, err := rdb.LRange(rdx, MODLOG, 0, n-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	actions := make([]*modAction, 0, len(entries))
+	for _, e := range entries {
+		a := new(modAction)
+		if err = json.Unmarshal([]byte(e), a); err != nil {
+			return nil, err
 		}
-		items = append(items, &i)
+		actions = append(actions, a)
 	}
+	return actions, nil
+}
 
-	// get the comments from each post. TODO: Update the amount returned
-	// so it only goes a few comments deep.
-	for _, p := range items {
-		replies, err := rdb.ZRange(
-			rdx, p.ID+REPLIESINORDER, 0, -1,
-		).Result()
+// setPostHidden() hides or unhides a post. Unhiding a post also shows it to
+// everyone again if the spam filter shadow hid it.
+func setPostHidden(id string, hidden bool) error {
+	if hidden {
+		return rdb.HSet(rdx, id, "hidden", true).Err()
+	}
+	return rdb.HSet(rdx, id, "hidden", false, "shadow", false).Err()
+}
+
+// setInvite() stores a new invite code, and adds it to its creators list.
+// see: invite.go
+func setInvite(inv *invite) error {
+	_, err := rdb.TxPipelined(rdx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(rdx, INVITE+inv.Code, inv)
+		if inv.Expires > 0 {
+			pipe.ExpireAt(rdx, INVITE+inv.Code, time.Unix(inv.Expires, 0))
+		}
+		pipe.ZAdd(rdx, inv.Creator+INVITES, redis.Z{Member: inv.Code, Score: float64(inv.Created)})
+		return nil
+	})
+	return err
+}
+
+// getInvite() returns the invite with the given code, or redis.Nil if there
+// isn't one.
+func getInvite(code string) (*invite, error) {
+	inv := new(invite)
+	if err := rdb.HGetAll(rdx, INVITE+code).Scan(inv); err != nil {
+		return nil, err
+	}
+	if inv.Code == "" {
+		return nil, redis.Nil
+	}
+	return inv, nil
+}
+
+// getInvites() returns the users invite codes, newest first. Codes which
+// have expired are removed from their list as they're found.
+func getInvites(c *credentials) ([]*invite, error) {
+	codes, err := rdb.ZRevRange(rdx, c.User.ID+INVITES, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	invites := make([]*invite, 0, len(codes))
+	for _, code := range codes {
+		inv, err := getInvite(code)
+		if err == redis.Nil {
+			rdb.ZRem(rdx, c.User.ID+INVITES, code)
+			continue
+		}
 		if err != nil {
-			log.Println(err)
+			return nil, err
 		}
-		p.Comments = append(p.Comments, getPostsByID(replies)...)
+		invites = append(invites, inv)
 	}
+	return invites, nil
+}
 
-	// set the stream to the new slice of posts.
-	stream = items
+// deleteInvite() deletes one of the users invite codes. It returns false if
+// the user has no such code.
+func deleteInvite(c *credentials, code string) (bool, error) {
+	n, err := rdb.ZRem(rdx, c.User.ID+INVITES, code).Result()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	return true, rdb.Del(rdx, INVITE+code).Err()
+}
 
-	return items
+// redeemInvite takes a use of the invite at KEYS[1], if it has one left and
+// hasn't expired by ARGV[1], the current unix time. It returns 1 if it did.
+var redeemInvite = redis.NewScript(`
+local v = redis.call("HMGET", KEYS[1], "uses", "max_uses", "expires")
+if not v[2] then
+	return 0
+end
+local expires = tonumber(v[3]) or 0
+if (tonumber(v[1]) or 0) >= tonumber(v[2]) or (expires > 0 and expires <= tonumber(ARGV[1])) then
+	return 0
+end
+redis.call("HINCRBY", KEYS[1], "uses", 1)
+return 1
+`)
+
+// useInvite() takes a use of an invite code for the new user, and records
+// who invited them. It returns false if the code was used up first.
+func useInvite(inv *invite, c *credentials) (bool, error) {
+	n, err := redeemInvite.Run(rdx, rdb, []string{INVITE + inv.Code}, time.Now().Unix()).Int()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	c.User.InvitedBy = inv.Creator
+	err = rdb.ZAdd(rdx, inv.Creator+INVITED, redis.Z{Member: c.User.ID,
+		Score: float64(time.Now().Unix())}).Err()
+	return err == nil, err
 }
 
-// setPasswordHash() is used to store the password hash in redis so that when
-// a user logs in, his login name (email) can be used to look up the hash.
-// Passwords are never stored in plain text.
-func setPasswordHash(c *credentials, hash string) (string, error) {
-	return rdb.Set(rdx, c.Name+HASH, hash, 0).Result()
+// releaseEmail() frees a login email claimed by a signup which couldn't be
+// finished.
+func releaseEmail(email string) error {
+	return rdb.HDel(rdx, EMAILS, email).Err()
 }
 
-// getPasswordHash() is used to get the hash associated with a users login
-// name, to verify the password, and to look up their ID, so that we may look
-// up the user data using the hash as the key.
-func getPasswordHash(c *credentials) (string, error) {
-	return rdb.Get(rdx, c.Name+HASH).Result()
+// abandonSignup() undoes a signup which couldn't be finished, so its email,
+// and identity if linked is set, can be used again. The use of an invite code
+// isn't given back, but the user is taken off the inviters list.
+func abandonSignup(c *credentials, provider, sub string, linked bool) error {
+	_, err := rdb.TxPipelined(rdx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(rdx, EMAILS, c.User.Email)
+		if linked {
+			pipe.HDel(rdx, OIDC+provider, sub)
+		}
+		pipe.ZRem(rdx, USERS, c.User.ID)
+		pipe.ZRem(rdx, WAITLIST, c.User.ID)
+		if c.User.InvitedBy != "" {
+			pipe.ZRem(rdx, c.User.InvitedBy+INVITED, c.User.ID)
+		}
+		pipe.Del(rdx, c.User.ID, c.User.ID+CREDENTIALS)
+		return nil
+	})
+	return err
 }
 
-// setHashToID() is used to look up a user ID based on the hash returned by
-// getPasswordHash(). This is necessary to allow us to look up the user ID
-// without needing an email, which is only used for login/verification
-// purposes unless the user chooses to make it public.
-func setHashToID(c *credentials, hash string) (string, error) {
-	return rdb.Set(rdx, hash, c.User.ID, 0).Result()
+// getInvited() returns the IDs of the users the user invited, newest first.
+func getInvited(c *credentials) ([]string, error) {
+	return rdb.ZRevRange(rdx, c.User.ID+INVITED, 0, -1).Result()
 }
 
-// setProfile() sets a users profile data in the database by first marshalling
-// it into a []byte{} containing its JSON representation, then unmarshalling it
-// into a map[string]any type, which is then added to the database using the
-// redis HMSet() functionality.
-// TODO: There's a way to do this without a map.
-func setProfile(c *credentials) error {
-	// Marshal the user/profile data into its JSON representation in []byte
-	// form.
-	b, err := json.Marshal(c.User)
+// addToWaitlist() adds a new user to the waitlist.
+func addToWaitlist(c *credentials) error {
+	return rdb.ZAdd(rdx, WAITLIST, redis.Z{Member: c.User.ID,
+		Score: float64(time.Now().Unix())}).Err()
+}
+
+// removeFromWaitlist() takes a user off the waitlist, letting them sign in.
+// It returns false if they weren't on it.
+func removeFromWaitlist(id string) (bool, error) {
+	n, err := rdb.ZRem(rdx, WAITLIST, id).Result()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	return true, rdb.HSet(rdx, id, "waitlisted", false).Err()
+}
+
+// getWaitlist() returns the users on the waitlist, oldest first.
+func getWaitlist(start, stop int64) ([]*user, error) {
+	ids, err := rdb.ZRange(rdx, WAITLIST, start, stop).Result()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	users := make([]*user, 0, len(ids))
+	for _, id := range ids {
+		c := &credentials{User: &user{ID: id}}
+		if err = scanProfile(c); err != nil {
+			return nil, err
+		}
+		users = append(users, c.User)
+	}
+	return users, nil
+}
 
-	// initialize our map.
-	var pmap map[string]any = make(map[string]any)
+// spendChallenge() marks the proof-of-work challenge with the given ID as
+// used, returning false if it already was. see: pow.go
+func spendChallenge(id string, ttl time.Duration) (bool, error) {
+	return rdb.SetNX(rdx, POWUSED+id, 1, max(ttl, time.Second)).Result()
+}
 
-	// Unmarshal the JSON representation into the map
-	err = json.Unmarshal(b, &pmap)
+// incrSignups() counts a signup during the current hour.
+func incrSignups() error {
+	_, err := incrExpire(SIGNUPS+fmt.Sprint(time.Now().Unix()/3600), 2*time.Hour)
+	return err
+}
+
+// getRecentSignups() returns the number of signups during this hour and the
+// last.
+func getRecentSignups() (int64, error) {
+	hour := time.Now().Unix() / 3600
+	vals, err := rdb.MGet(rdx, SIGNUPS+fmt.Sprint(hour), SIGNUPS+fmt.Sprint(hour-1)).Result()
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, v := range int64s(vals) {
+		n += v
+	}
+	return n, nil
+}
+
+// getSpamCounts() returns the number of posts the spam filter has been
+// trained on for each label, and how many of them contained each of the
+// tokens. see: spam.go
+func getSpamCounts(tokens []string) (docs map[string]int64, counts map[string][]int64, err error) {
+	cmds, err := rdb.Pipelined(rdx, func(pipe redis.Pipeliner) error {
+		pipe.HMGet(rdx, SPAMDOCS, spamLabels...)
+		for _, label := range spamLabels {
+			pipe.HMGet(rdx, SPAMWORDS+label, tokens...)
+		}
+		return nil
+	})
 	if err != nil {
+		return nil, nil, err
+	}
+	docs, counts = map[string]int64{}, map[string][]int64{}
+	for i, n := range int64s(cmds[0].(*redis.SliceCmd).Val()) {
+		docs[spamLabels[i]] = n
+	}
+	for i, label := range spamLabels {
+		counts[label] = int64s(cmds[i+1].(*redis.SliceCmd).Val())
+	}
+	return docs, counts, nil
+}
+
+// int64s() converts the values returned by HMGet to int64s, with missing
+// values as zero.
+func int64s(vals []any) []int64 {
+	ns := make([]int64, len(vals))
+	for i, v := range vals {
+		if s, ok := v.(string); ok {
+			ns[i], _ = strconv.ParseInt(s, 10, 64)
+		}
+	}
+	return ns
+}
+
+// trainSpam() trains the spam filter on the tokens of the post with the
+// given ID, under label. A post that was trained on under the other label
+// is moved, so moderators can change their minds.
+func trainSpam(id, label string, tokens []string) error {
+	prev, err := rdb.HGet(rdx, SPAMLABELS, id).Result()
+	if err != nil && err != redis.Nil {
 		return err
 	}
+	if prev == label {
+		return nil
+	}
+	_, err = rdb.TxPipelined(rdx, func(pipe redis.Pipeliner) error {
+		if prev != "" {
+			pipe.HIncrBy(rdx, SPAMDOCS, prev, -1)
+			for _, t := range tokens {
+				pipe.HIncrBy(rdx, SPAMWORDS+prev, t, -1)
+			}
+		}
+		pipe.HIncrBy(rdx, SPAMDOCS, label, 1)
+		for _, t := range tokens {
+			pipe.HIncrBy(rdx, SPAMWORDS+label, t, 1)
+		}
+		pipe.HSet(rdx, SPAMLABELS, id, label)
+		return nil
+	})
+	return err
+}
 
-	// Add the data using HMSet(), returning any errors.
-	return rdb.HMSet(rdx, c.User.ID, pmap).Err()
+// incrDuplicates() counts a post with text hashed to hash, returning how many
+// have been made in the last day.
+func incrDuplicates(hash string) (int64, error) {
+	return incrExpire(SPAMDUPES+hash, 24*time.Hour)
 }
 
-// setPost() sets a post in the database using the redis HMSet() functionality.
-func setPost(i *post) error {
-	// Add the post data using HMSet(), returning any errors.
-	return rdb.HMSet(rdx, i.ID, *i).Err()
+// setSuspended() suspends a user until the given unix time. Zero lifts a
+// suspension.
+func setSuspended(id string, until int64) error {
+	return rdb.HSet(rdx, id, "suspended_until", until).Err()
 }
 
-// scanProfile() is used to scan a users profile into the &user{} struct to
-// be passed around by in credentials{}.
-func scanProfile(c *credentials) error {
-	return rdb.HGetAll(rdx, c.User.ID).Scan(c.User)
+// setBanned() bans or unbans a user.
+func setBanned(id string, banned bool) error {
+	return rdb.HSet(rdx, id, "banned", banned).Err()
+}
+
+// incrWarnings() counts a warning given to a user.
+func incrWarnings(id string) (int64, error) {
+	return rdb.HIncrBy(rdx, id, "warnings", 1).Result()
+}
+
+// getTOTPSecrets() returns the users active TOTP secret, if two-factor
+// authentication is enabled, and the pending secret, if they're enrolling.
+func getTOTPSecrets(c *credentials) (active, pending string, err error) {
+	v, err := rdb.HMGet(rdx, c.User.ID+CREDENTIALS, "totp", "totp_pending").Result()
+	if err != nil {
+		return "", "", err
+	}
+	active, _ = v[0].(string)
+	pending, _ = v[1].(string)
+	return active, pending, nil
+}
+
+// hasTOTP() reports whether the user has two-factor authentication enabled,
+// going by whether an active TOTP secret is stored in their credentials,
+// rather than the two_factor flag in their profile.
+func hasTOTP(c *credentials) (bool, error) {
+	active, _, err := getTOTPSecrets(c)
+	return active != "", err
+}
+
+// setTOTPPending() stores a new TOTP secret which becomes active once the user
+// confirms it with a code from their authenticator.
+func setTOTPPending(c *credentials, secret string) error {
+	return rdb.HSet(rdx, c.User.ID+CREDENTIALS, "totp_pending", secret).Err()
+}
+
+// enableTOTP() activates the users TOTP secret, replaces their recovery codes
+// with the hashes provided, and flags their profile as using two-factor
+// authentication.
+func enableTOTP(c *credentials, secret string, hashes []string) error {
+	_, err := rdb.TxPipelined(rdx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(rdx, c.User.ID+CREDENTIALS, "totp", secret)
+		pipe.HDel(rdx, c.User.ID+CREDENTIALS, "totp_pending")
+		pipe.Del(rdx, c.User.ID+RECOVERYCODES)
+		for _, h := range hashes {
+			pipe.SAdd(rdx, c.User.ID+RECOVERYCODES, h)
+		}
+		pipe.HSet(rdx, c.User.ID, "two_factor", true)
+		return nil
+	})
+	return err
+}
+
+// disableTOTP() removes the users TOTP secret and recovery codes.
+func disableTOTP(c *credentials) error {
+	_, err := rdb.TxPipelined(rdx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(rdx, c.User.ID+CREDENTIALS, "totp", "totp_pending")
+		pipe.Del(rdx, c.User.ID+RECOVERYCODES)
+		pipe.HSet(rdx, c.User.ID, "two_factor", false)
+		return nil
+	})
+	return err
+}
+
+// useTOTPStep() marks a TOTP time step as used. It returns false if the step
+// was already used, meaning the code is being replayed.
+func useTOTPStep(c *credentials, step int64) (bool, error) {
+	return rdb.SetNX(rdx, c.User.ID+TOTPUSED+fmt.Sprint(step), 1,
+		(2*totpSkew+1)*totpPeriod*time.Second).Result()
+}
+
+// useRecoveryCode() removes a recovery code hash from the users set. It
+// returns false if the code wasn't found.
+func useRecoveryCode(c *credentials, hash string) (bool, error) {
+	n, err := rdb.SRem(rdx, c.User.ID+RECOVERYCODES, hash).Result()
+	return n == 1, err
 }
 
 // zaddUsers() is used to add a user to a sorted set called "USERS", allowing
@@ -254,7 +1794,7 @@ func zaddUsers(c *credentials) (int64, error) {
 // zaddPostsChron() is used to add a new post to the zset "POSTSINORDER", which
 // maintains a chronologically sorted set of posts.
 func zaddPostsChron(c *post) (int64, error) {
-	return rdb.ZAdd(rdx, POSTSINORDER[1:], makeZmem(c.ID)).Result()
+	return rdb.ZAdd(rdx, ALLPOSTS, makeZmem(c.ID)).Result()
 }
 
 // zaddPostsScore() is used to add a new post to the zset "POSTSBYSCORE", which
@@ -363,7 +1903,16 @@ func setFriend(c *credentials, id string) (int64, error) {
 	}
 
 	if num == 0 {
-		_, err := rdb.ZAdd(rdx, c.User.ID+FRIENDSINORDER,
+		// users can't befriend someone they've blocked, or who has
+		// blocked them.
+		blocked, err := isBlocked(c.User.ID, id)
+		if err != nil {
+			return -1, err
+		}
+		if blocked {
+			return -1, errBlocked
+		}
+		_, err = rdb.ZAdd(rdx, c.User.ID+FRIENDSINORDER,
 			makeZmem(id)).Result()
 		if err != nil {
 			log.Println(err)
@@ -452,3 +2001,276 @@ func zaddUsersLikesChron(c *credentials) (int64, error) {
 func zaddTagsScore(c *credentials) (int64, error) {
 	return rdb.ZAdd(rdx, TAGSBYSCORE, makeZmem(c.User.ID)).Result()
 }
+
+// retainBlob() counts a new reference to the blob at path, taking it off the
+// orphans if it was waiting to be garbage-collected. see: blob.go
+func retainBlob(path string) error {
+	_, err := rdb.TxPipelined(rdx, func(pipe redis.Pipeliner) error {
+		pipe.HIncrBy(rdx, BLOBREFS, path, 1)
+		pipe.ZRem(rdx, BLOBORPHANS, path)
+		return nil
+	})
+	return err
+}
+
+// releaseBlob drops a reference to a blob. Once none are left it's added to
+// the orphans, rather than removed straight away, so an upload of the same
+// file in the mean time can still use it.
+var releaseBlob = redis.NewScript(`
+local n = redis.call("HINCRBY", KEYS[1], ARGV[1], -1)
+if n <= 0 then
+	redis.call("HDEL", KEYS[1], ARGV[1])
+	redis.call("ZADD", KEYS[2], ARGV[2], ARGV[1])
+end
+return n
+`)
+
+// unrefBlob() drops a reference to the blob at path. see: releaseBlob
+func unrefBlob(path string) error {
+	return releaseBlob.Run(rdx, rdb, []string{BLOBREFS, BLOBORPHANS},
+		path, time.Now().Unix()).Err()
+}
+
+// blobRefs() returns the number of references to the blob at path.
+func blobRefs(path string) (int64, error) {
+	n, err := rdb.HGet(rdx, BLOBREFS, path).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return n, err
+}
+
+// lockBlob() marks the blob at path as being referenced or removed,
+// returning false if it already is, so a blob isn't removed as it's reused.
+func lockBlob(path string, ttl time.Duration) (bool, error) {
+	return rdb.SetNX(rdx, BLOBLOCK+path, 1, ttl).Result()
+}
+
+// unlockBlob() marks the blob at path as no longer being referenced or
+// removed.
+func unlockBlob(path string) error {
+	return rdb.Del(rdx, BLOBLOCK+path).Err()
+}
+
+// takeOrphans claims the orphans let go before ARGV[1], returning those which
+// are still unused.
+var takeOrphans = redis.NewScript(`
+local paths = redis.call("ZRANGEBYSCORE", KEYS[2], "-inf", ARGV[1])
+local orphans = {}
+for _, path in ipairs(paths) do
+	redis.call("ZREM", KEYS[2], path)
+	if tonumber(redis.call("HGET", KEYS[1], path) or "0") <= 0 then
+		table.insert(orphans, path)
+	end
+end
+return orphans
+`)
+
+// takeOrphanBlobs() returns the paths of blobs which have been unused since
+// before, so they can be removed from disk. see: collectBlobs()
+func takeOrphanBlobs(before time.Time) ([]string, error) {
+	return takeOrphans.Run(rdx, rdb, []string{BLOBREFS, BLOBORPHANS},
+		before.Unix()).StringSlice()
+}
+
+// pendingLua defines pending(), used by the scripts below to forget the
+// pending uploads in the ZSET key which expired before now, and return the
+// bytes and files of those left.
+const pendingLua = `
+local function pending(key, now)
+	redis.call("ZREMRANGEBYSCORE", key, "-inf", now)
+	local bytes, files = 0, 0
+	for _, m in ipairs(redis.call("ZRANGE", key, 0, -1)) do
+		bytes = bytes + tonumber(string.match(m, ":(%d+)$"))
+		files = files + 1
+	end
+	return bytes, files
+end
+`
+
+// addUsage adds ARGV[1] bytes and ARGV[2] files to a users usage at KEYS[1],
+// unless, along with their pending uploads at KEYS[2], it would take them
+// over ARGV[3] bytes or ARGV[4] files, where 0 is no limit. ARGV[5] is the
+// current unix time. Refunds are never refused, and usage never drops below
+// zero.
+var addUsage = redis.NewScript(pendingLua + `
+local bytes = tonumber(redis.call("HGET", KEYS[1], "bytes") or "0") + tonumber(ARGV[1])
+local files = tonumber(redis.call("HGET", KEYS[1], "files") or "0") + tonumber(ARGV[2])
+local maxBytes, maxFiles = tonumber(ARGV[3]), tonumber(ARGV[4])
+if tonumber(ARGV[1]) > 0 or tonumber(ARGV[2]) > 0 then
+	local pBytes, pFiles = pending(KEYS[2], ARGV[5])
+	if (maxBytes > 0 and bytes + pBytes > maxBytes) or (maxFiles > 0 and files + pFiles > maxFiles) then
+		return 0
+	end
+end
+redis.call("HSET", KEYS[1], "bytes", math.max(bytes, 0), "files", math.max(files, 0))
+return 1
+`)
+
+// chargeUsage() adds s to the users usage, returning false if it doesn't fit
+// in their quota q, along with their pending uploads. see: addUsage
+func chargeUsage(id string, s, q storage) (bool, error) {
+	return addUsage.Run(rdx, rdb, []string{id + USAGE, id + PENDINGUPLOADS},
+		s.Bytes, s.Files, q.Bytes, q.Files, time.Now().Unix()).Bool()
+}
+
+// reserveUpload adds the pending upload ARGV[1], of ARGV[2] bytes, to the
+// ZSET at KEYS[2], expiring at ARGV[6], unless along with the usage at
+// KEYS[1] and the other pending uploads it would take the user over ARGV[3]
+// bytes or ARGV[4] files. ARGV[5] is the current unix time.
+var reserveUpload = redis.NewScript(pendingLua + `
+local size = tonumber(ARGV[2])
+local maxBytes, maxFiles = tonumber(ARGV[3]), tonumber(ARGV[4])
+local pBytes, pFiles = pending(KEYS[2], ARGV[5])
+local bytes = tonumber(redis.call("HGET", KEYS[1], "bytes") or "0") + pBytes + size
+local files = tonumber(redis.call("HGET", KEYS[1], "files") or "0") + pFiles + 1
+if (maxBytes > 0 and bytes > maxBytes) or (maxFiles > 0 and files > maxFiles) then
+	return 0
+end
+redis.call("ZADD", KEYS[2], ARGV[6], ARGV[1] .. ":" .. ARGV[2])
+return 1
+`)
+
+// reserveUploadUsage() counts the size of a resumable upload against its
+// owners quota q until it finishes, is cancelled, or expires after ttl
+// without a chunk. It returns false if it doesn't fit. see: reserveUpload
+func reserveUploadUsage(u *resumable, q storage, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	return reserveUpload.Run(rdx, rdb, []string{u.Owner + USAGE, u.Owner + PENDINGUPLOADS},
+		u.ID, u.Size, q.Bytes, q.Files, now.Unix(), now.Add(ttl).Unix()).Bool()
+}
+
+// releaseUploadUsage() stops counting a resumable upload against its owners
+// quota.
+func releaseUploadUsage(u *resumable) error {
+	return rdb.ZRem(rdx, u.Owner+PENDINGUPLOADS, pendingMember(u)).Err()
+}
+
+// pendingMember() returns the member of the owners PENDINGUPLOADS an upload
+// is kept as.
+func pendingMember(u *resumable) string {
+	return u.ID + ":" + strconv.FormatInt(u.Size, 10)
+}
+
+// getPendingUsage() returns how much storage the users unfinished uploads
+// have reserved.
+func getPendingUsage(id string) (storage, error) {
+	var s storage
+	members, err := rdb.ZRangeByScore(rdx, id+PENDINGUPLOADS, &redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(time.Now().Unix(), 10), Max: "+inf"}).Result()
+	for _, m := range members {
+		n, _ := strconv.ParseInt(m[strings.LastIndex(m, ":")+1:], 10, 64)
+		s.Bytes += n
+		s.Files++
+	}
+	return s, err
+}
+
+// refundUsage() takes s from the users usage.
+func refundUsage(id string, s storage) error {
+	_, err := chargeUsage(id, storage{Bytes: -s.Bytes, Files: -s.Files}, storage{})
+	return err
+}
+
+// getUsage() returns how much storage the user is using.
+func getUsage(id string) (storage, error) {
+	var s storage
+	err := rdb.HGetAll(rdx, id+USAGE).Scan(&s)
+	return s, err
+}
+
+// migrateUsage() is a one-time migration charging the authors of posts made
+// before storage accounting for their attachments, recording the size of
+// each. see: quota.go
+func migrateUsage() error {
+	done, err := rdb.SIsMember(rdx, MIGRATIONS, "usage").Result()
+	if err != nil || done {
+		return err
+	}
+
+	ids, err := rdb.ZRange(rdx, ALLPOSTS, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		p, err := getPost(id)
+		if err != nil {
+			log.Println(id, err)
+			continue
+		}
+		if len(p.Attachments) == 0 || p.Author == "" {
+			continue
+		}
+		for _, a := range p.Attachments {
+			if a.Size == 0 {
+				a.Size = attachmentSize(a)
+			}
+		}
+		_, err = rdb.TxPipelined(rdx, func(pipe redis.Pipeliner) error {
+			s := p.storage()
+			pipe.HSet(rdx, id, "attachments", p.Attachments)
+			pipe.HIncrBy(rdx, p.Author+USAGE, "bytes", s.Bytes)
+			pipe.HIncrBy(rdx, p.Author+USAGE, "files", s.Files)
+			return nil
+		})
+		if err != nil {
+			log.Println(id, err)
+		}
+	}
+	return rdb.SAdd(rdx, MIGRATIONS, "usage").Err()
+}
+
+// setUpload() stores the state of a resumable upload, which expires after ttl
+// unless more of it arrives. see: resumable.go
+func setUpload(u *resumable, ttl time.Duration) error {
+	_, err := rdb.TxPipelined(rdx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(rdx, UPLOAD+u.ID, u)
+		pipe.Expire(rdx, UPLOAD+u.ID, ttl)
+		return nil
+	})
+	return err
+}
+
+// getUpload() returns the state of a resumable upload, or redis.Nil if there
+// isn't one, or it expired.
+func getUpload(id string) (*resumable, error) {
+	u := new(resumable)
+	if err := rdb.HGetAll(rdx, UPLOAD+id).Scan(u); err != nil {
+		return nil, err
+	}
+	if u.ID == "" {
+		return nil, redis.Nil
+	}
+	return u, nil
+}
+
+// advanceUpload() records that an upload has arrived up to offset, keeping
+// it, and the quota it has reserved, for another ttl.
+func advanceUpload(u *resumable, offset int64, ttl time.Duration) error {
+	_, err := rdb.TxPipelined(rdx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(rdx, UPLOAD+u.ID, "offset", offset)
+		pipe.Expire(rdx, UPLOAD+u.ID, ttl)
+		pipe.ZAddXX(rdx, u.Owner+PENDINGUPLOADS, redis.Z{Member: pendingMember(u),
+			Score: float64(time.Now().Add(ttl).Unix())})
+		return nil
+	})
+	return err
+}
+
+// lockUpload() marks a chunk of an upload as being written, returning false
+// if one already is, so chunks aren't written over each other.
+func lockUpload(id string, ttl time.Duration) (bool, error) {
+	return rdb.SetNX(rdx, UPLOADLOCK+id, 1, ttl).Result()
+}
+
+// unlockUpload() marks an upload as no longer being written.
+func unlockUpload(id string) error {
+	return rdb.Del(rdx, UPLOADLOCK+id).Err()
+}
+
+// deleteUpload() removes the state of a resumable upload, returning false if
+// it was already gone, so it can only be finished or cancelled once.
+func deleteUpload(id string) (bool, error) {
+	n, err := rdb.Del(rdx, UPLOAD+id).Result()
+	return n > 0, err
+}
@@ -0,0 +1,186 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// exif.go reads the orientation from the EXIF data of uploaded photos. The
+// image pipeline re-encodes every JPEG, PNG and WebP, which drops the EXIF
+// data, GPS coordinates and all, so the orientation the camera recorded is
+// applied to the pixels instead. see: imaging.go
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+)
+
+// exifOrientation() returns the EXIF orientation of an image, from 1 to 8,
+// or 1 if it has none. The EXIF data is kept in an APP1 segment in JPEGs,
+// an eXIf chunk in PNGs, and an EXIF chunk in WebPs.
+func exifOrientation(r io.Reader, mt *mediaType) int {
+	// The metadata is near the start of the file, in the files we take.
+	b, err := io.ReadAll(io.LimitReader(r, 1<<20))
+	if err != nil {
+		return 1
+	}
+	var tiff []byte
+	switch mt.MIME {
+	case "image/jpeg":
+		tiff = jpegExif(b)
+	case "image/png":
+		tiff = pngExif(b)
+	case "image/webp":
+		tiff = webpExif(b)
+	}
+	if o := tiffOrientation(tiff); o >= 1 && o <= 8 {
+		return o
+	}
+	return 1
+}
+
+// jpegExif() returns the EXIF data from the APP1 segment of a JPEG.
+func jpegExif(b []byte) []byte {
+	for i := 2; i+4 <= len(b) && b[i] == 0xff; {
+		marker := b[i+1]
+		n := int(binary.BigEndian.Uint16(b[i+2:]))
+		// the image data starts after SOS, so there's no more metadata.
+		if marker == 0xda || n < 2 || i+2+n > len(b) {
+			return nil
+		}
+		seg := b[i+4 : i+2+n]
+		if marker == 0xe1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return seg[6:]
+		}
+		i += 2 + n
+	}
+	return nil
+}
+
+// pngExif() returns the EXIF data from the eXIf chunk of a PNG.
+func pngExif(b []byte) []byte {
+	for i := 8; i+8 <= len(b); {
+		n := int(binary.BigEndian.Uint32(b[i:]))
+		typ := string(b[i+4 : i+8])
+		if n < 0 || i+12+n > len(b) || typ == "IDAT" {
+			return nil
+		}
+		if typ == "eXIf" {
+			return b[i+8 : i+8+n]
+		}
+		i += 12 + n
+	}
+	return nil
+}
+
+// webpExif() returns the EXIF data from the EXIF chunk of a WebP. Some
+// encoders keep the "Exif" header from JPEGs in front of it.
+func webpExif(b []byte) []byte {
+	for i := 12; i+8 <= len(b); {
+		n := int(binary.LittleEndian.Uint32(b[i+4:]))
+		if n < 0 || i+8+n > len(b) {
+			return nil
+		}
+		if string(b[i:i+4]) == "EXIF" {
+			return bytes.TrimPrefix(b[i+8:i+8+n], []byte("Exif\x00\x00"))
+		}
+		// chunks are padded to an even length.
+		i += 8 + n + n&1
+	}
+	return nil
+}
+
+// tiffOrientation() returns the Orientation tag, 0x0112, from the first IFD
+// of EXIF data, which is laid out like a TIFF file, or 0 if it's missing.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		e := ifd + 2 + i*12
+		if e+12 > len(tiff) {
+			return 0
+		}
+		// the tag must be a SHORT, which is stored in the entry its self.
+		if order.Uint16(tiff[e:]) == 0x0112 && order.Uint16(tiff[e+2:]) == 3 {
+			return int(order.Uint16(tiff[e+8:]))
+		}
+	}
+	return 0
+}
+
+// orient() returns img turned the right way up for the EXIF orientation o,
+// which says how the camera stored it. Orientations 5 to 8 are on their
+// side, so turning them swaps the width and height.
+func orient(img *image.RGBA, o int) *image.RGBA {
+	if o <= 1 || o > 8 {
+		return img
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch o {
+			case 2: // flip horizontally
+				dx, dy = w-1-x, y
+			case 3: // rotate 180 degrees
+				dx, dy = w-1-x, h-1-y
+			case 4: // flip vertically
+				dx, dy = x, h-1-y
+			case 5: // transpose
+				dx, dy = y, x
+			case 6: // rotate 90 degrees clockwise
+				dx, dy = h-1-y, x
+			case 7: // transverse
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotate 90 degrees anticlockwise
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):][:4], img.Pix[img.PixOffset(x, y):][:4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,275 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// gpsMarker is kept in the GPS IFD of the test photos, so we can tell if any
+// of it survives.
+const gpsMarker = "GPS-MARKER-51.5007N-0.1246W"
+
+// testExif() returns EXIF data, laid out like a big endian TIFF file, with an
+// Orientation of o and a GPS IFD holding gpsMarker.
+func testExif(o uint16) []byte {
+	var b bytes.Buffer
+	w := func(v any) { binary.Write(&b, binary.BigEndian, v) }
+	b.WriteString("MM")
+	w(uint16(42))
+	w(uint32(8))
+	// IFD0: Orientation, and the offset of the GPS IFD.
+	w(uint16(2))
+	w([]uint16{0x0112, 3})
+	w(uint32(1))
+	w([]uint16{o, 0})
+	w([]uint16{0x8825, 4})
+	w(uint32(1))
+	w(uint32(8 + 2 + 2*12 + 4))
+	w(uint32(0))
+	// GPS IFD: GPSMapDatum, whose value follows the IFD.
+	w(uint16(1))
+	w([]uint16{0x0012, 2})
+	w(uint32(len(gpsMarker) + 1))
+	w(uint32(b.Len() + 4 + 4))
+	w(uint32(0))
+	b.WriteString(gpsMarker + "\x00")
+	return b.Bytes()
+}
+
+// testImage() returns a w by h image, which is red along the top row so it's
+// clear which way up it is.
+func testImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{0, 0, 255, 255}
+			if y == 0 {
+				c = color.RGBA{255, 0, 0, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+// testJPEG() returns a JPEG with the EXIF data in an APP1 segment.
+func testJPEG(t *testing.T, img image.Image, exif []byte) []byte {
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	seg := append([]byte("Exif\x00\x00"), exif...)
+	app1 := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(seg)+2))
+	out := append([]byte{}, b.Bytes()[:2]...)
+	out = append(append(out, app1...), seg...)
+	return append(out, b.Bytes()[2:]...)
+}
+
+// testPNG() returns a PNG with the EXIF data in an eXIf chunk, which goes
+// before the image data.
+func testPNG(t *testing.T, img image.Image, exif []byte) []byte {
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		t.Fatal(err)
+	}
+	// The signature and IHDR chunk take up the first 33 bytes.
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(exif)))
+	chunk = append(append(chunk, "eXIf"...), exif...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	out := append([]byte{}, b.Bytes()[:33]...)
+	out = append(out, chunk...)
+	return append(out, b.Bytes()[33:]...)
+}
+
+func TestExifOrientation(t *testing.T) {
+	img := testImage(4, 2)
+	for _, tc := range []struct {
+		name string
+		b    []byte
+		mt   string
+		want int
+	}{
+		{"jpeg", testJPEG(t, img, testExif(6)), "image/jpeg", 6},
+		{"png", testPNG(t, img, testExif(3)), "image/png", 3},
+		{"empty exif", testJPEG(t, img, nil), "image/jpeg", 1},
+		{"out of range", testJPEG(t, img, testExif(9)), "image/jpeg", 1},
+	} {
+		mt := &mediaType{MIME: tc.mt}
+		if got := exifOrientation(bytes.NewReader(tc.b), mt); got != tc.want {
+			t.Errorf("%s: orientation %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+// TestProcessImageDropsGPS checks the image pipeline leaves none of the EXIF
+// data, GPS coordinates and all, in any of the sizes it makes, and applies
+// the orientation to the pixels instead.
+func TestProcessImageDropsGPS(t *testing.T) {
+	for _, tc := range []struct {
+		ext string
+		b   func(*testing.T, image.Image, []byte) []byte
+	}{
+		{"jpg", testJPEG},
+		{"png", testPNG},
+	} {
+		t.Run(tc.ext, func(t *testing.T) {
+			// Wide enough that a smaller size is made too.
+			src := tc.b(t, testImage(200, 100), testExif(6))
+			if !bytes.Contains(src, []byte(gpsMarker)) {
+				t.Fatal("test image has no GPS data")
+			}
+			path := filepath.Join(t.TempDir(), "photo."+tc.ext)
+			if err := os.WriteFile(path, src, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			mt, err := sniffMedia(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			variants, _, err := processImage(path, mt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(variants) != 2 {
+				t.Fatalf("got %d sizes, want 2", len(variants))
+			}
+			for _, v := range variants {
+				out, err := os.ReadFile(v.Path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if bytes.Contains(out, []byte(gpsMarker)) || bytes.Contains(out, []byte("Exif\x00\x00")) {
+					t.Errorf("%s still has EXIF data", filepath.Base(v.Path))
+				}
+				// Orientation 6 turns the picture on its side.
+				if v.Width != v.Height/2 {
+					t.Errorf("%s is %dx%d, want it turned on its side", filepath.Base(v.Path), v.Width, v.Height)
+				}
+			}
+		})
+	}
+}
+
+// isoBoxBytes() returns a box of type typ made up of the parts.
+func isoBoxBytes(typ string, parts ...[]byte) []byte {
+	body := bytes.Join(parts, nil)
+	b := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	return append(append(b, typ...), body...)
+}
+
+// testHEIC() returns a HEIC file holding image, and an Exif item holding
+// exif, both kept in the "mdat" box.
+func testHEIC(image, exif []byte) []byte {
+	infe := func(id uint16, typ string) []byte {
+		b := []byte{2, 0, 0, 0}
+		b = binary.BigEndian.AppendUint16(b, id)
+		b = append(b, 0, 0)
+		return isoBoxBytes("infe", b, []byte(typ+"\x00"))
+	}
+	ftyp := isoBoxBytes("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+	iinf := isoBoxBytes("iinf", []byte{0, 0, 0, 0, 0, 2}, infe(1, "hvc1"), infe(2, "Exif"))
+	iloc := func(imageOff, exifOff int) []byte {
+		// version 1, 4 byte offsets and lengths, with no base offset.
+		b := []byte{1, 0, 0, 0, 0x44, 0x00, 0, 2}
+		for _, item := range [][3]int{{1, imageOff, len(image)}, {2, exifOff, len(exif)}} {
+			b = binary.BigEndian.AppendUint16(b, uint16(item[0]))
+			b = append(b, 0, 0, 0, 0, 0, 1)
+			b = binary.BigEndian.AppendUint32(b, uint32(item[1]))
+			b = binary.BigEndian.AppendUint32(b, uint32(item[2]))
+		}
+		return isoBoxBytes("iloc", b)
+	}
+	meta := func(imageOff, exifOff int) []byte {
+		return isoBoxBytes("meta", []byte{0, 0, 0, 0}, iinf, iloc(imageOff, exifOff))
+	}
+	// The offsets don't change the size of the "meta" box.
+	start := len(ftyp) + len(meta(0, 0)) + 8
+	mdat := isoBoxBytes("mdat", image, exif)
+	return bytes.Join([][]byte{ftyp, meta(start, start+len(image)), mdat}, nil)
+}
+
+func TestStripHEIFMetadata(t *testing.T) {
+	pixels := bytes.Repeat([]byte("pixels"), 10)
+	exif := append([]byte("\x00\x00\x00\x06Exif\x00\x00"), testExif(1)...)
+	src := testHEIC(pixels, exif)
+	if mt, err := sniffMedia(src); err != nil || mt.MIME != "image/heic" {
+		t.Fatalf("test file sniffed as %v, %v", mt, err)
+	}
+	path := filepath.Join(t.TempDir(), "photo.heic")
+	if err := os.WriteFile(path, src, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	variants, _, err := processImage(path, mediaTypeByExt("heic"))
+	if err != nil || variants != nil {
+		t.Fatalf("processImage() = %v, %v, want the file kept", variants, err)
+	}
+	out, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != len(src) {
+		t.Fatalf("file is %d bytes, was %d", len(out), len(src))
+	}
+	if bytes.Contains(out, []byte(gpsMarker)) {
+		t.Error("GPS data survived")
+	}
+	// Only the Exif item is touched.
+	want := bytes.Replace(src, exif, make([]byte, len(exif)), 1)
+	if !bytes.Equal(out, want) {
+		t.Error("more than the Exif item changed")
+	}
+}
+
+func TestStripHEIFMetadataMalformed(t *testing.T) {
+	src := testHEIC([]byte("pixels"), testExif(1))
+	for name, b := range map[string][]byte{
+		"truncated": src[:len(src)-40],
+		"no meta":   isoBoxBytes("ftyp", []byte("heic\x00\x00\x00\x00mif1heic")),
+	} {
+		path := filepath.Join(t.TempDir(), "photo.heic")
+		if err := os.WriteFile(path, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := stripHEIFMetadata(path); !errors.Is(err, errUnsupportedMedia) {
+			t.Errorf("%s: got %v, want errUnsupportedMedia", name, err)
+		}
+	}
+}
@@ -7,6 +7,7 @@ require (
 	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/redis/go-redis/v9 v9.7.0
 	golang.org/x/crypto v0.33.0
+	golang.org/x/image v0.25.0
 )
 
 require (
@@ -0,0 +1,304 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// heif.go strips the metadata from AVIF and HEIC uploads. There's no pure Go
+// decoder for them, so unlike other images they can't be re-encoded, and are
+// kept as they are. Their EXIF and XMP data, GPS coordinates and all, is kept
+// in items of its own, listed in the "meta" box, so those items are zeroed
+// in place, which leaves the rest of the file as it was. Files whose
+// metadata can't be found for certain are refused. see: imaging.go
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// maxHEIFMeta is the largest "meta" box read. It holds the item tables, not
+// the images, so real ones are a few kilobytes.
+const maxHEIFMeta = 4 << 20
+
+// errBadHEIF is returned for AVIF and HEIC files which can't be parsed.
+var errBadHEIF = fmt.Errorf("%w: malformed HEIF", errUnsupportedMedia)
+
+// isoBox{} is one box of an ISO base media file, such as AVIF or HEIC. Off is
+// where its body starts in the file.
+type isoBox struct {
+	Type string
+	Body []byte
+	Off  int64
+}
+
+// stripHEIFMetadata() zeroes the EXIF and XMP items of the AVIF or HEIC file
+// at path.
+func stripHEIFMetadata(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	meta, err := readHEIFMeta(f, fi.Size())
+	if err != nil {
+		return err
+	}
+	extents, err := heifMetadataExtents(meta)
+	if err != nil {
+		return err
+	}
+	for _, e := range extents {
+		if e[0] < 0 || e[1] <= 0 || e[0] > fi.Size() || e[1] > fi.Size()-e[0] {
+			return errBadHEIF
+		}
+		if _, err = f.WriteAt(make([]byte, e[1]), e[0]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readHEIFMeta() walks the top level boxes of a file of size bytes and
+// returns its "meta" box, without reading the image data.
+func readHEIFMeta(f io.ReaderAt, size int64) (*isoBox, error) {
+	hdr := make([]byte, 16)
+	for off := int64(0); off+8 <= size; {
+		if _, err := f.ReadAt(hdr[:8], off); err != nil {
+			return nil, err
+		}
+		n, skip := int64(binary.BigEndian.Uint32(hdr)), int64(8)
+		switch n {
+		case 0:
+			n = size - off
+		case 1:
+			if _, err := f.ReadAt(hdr[8:], off+8); err != nil {
+				return nil, err
+			}
+			n, skip = int64(binary.BigEndian.Uint64(hdr[8:])), 16
+		}
+		if n < skip || n > size-off {
+			return nil, errBadHEIF
+		}
+		if string(hdr[4:8]) == "meta" {
+			if n-skip > maxHEIFMeta {
+				return nil, errBadHEIF
+			}
+			body := make([]byte, n-skip)
+			if _, err := f.ReadAt(body, off+skip); err != nil {
+				return nil, err
+			}
+			return &isoBox{"meta", body, off + skip}, nil
+		}
+		off += n
+	}
+	return nil, errBadHEIF
+}
+
+// isoBoxes() splits the body of box, from the byte at start, into the boxes
+// it's made of.
+func isoBoxes(box *isoBox, start int) ([]*isoBox, error) {
+	if start > len(box.Body) {
+		return nil, errBadHEIF
+	}
+	var boxes []*isoBox
+	for b, i := box.Body[start:], 0; i < len(b); {
+		if i+8 > len(b) {
+			return nil, errBadHEIF
+		}
+		n, skip := uint64(binary.BigEndian.Uint32(b[i:])), 8
+		switch n {
+		case 0:
+			n = uint64(len(b) - i)
+		case 1:
+			if i+16 > len(b) {
+				return nil, errBadHEIF
+			}
+			n, skip = binary.BigEndian.Uint64(b[i+8:]), 16
+		}
+		if n < uint64(skip) || n > uint64(len(b)-i) {
+			return nil, errBadHEIF
+		}
+		boxes = append(boxes, &isoBox{string(b[i+4 : i+8]), b[i+skip : i+int(n)],
+			box.Off + int64(start+i+skip)})
+		i += int(n)
+	}
+	return boxes, nil
+}
+
+// heifMetadataExtents() returns where in the file the metadata items listed
+// in the "meta" box are kept, as pairs of offset and length.
+func heifMetadataExtents(meta *isoBox) ([][2]int64, error) {
+	// "meta" is a full box, with a version and flags before its children.
+	children, err := isoBoxes(meta, 4)
+	if err != nil {
+		return nil, err
+	}
+	var iinf, iloc, idat *isoBox
+	for _, b := range children {
+		switch b.Type {
+		case "iinf":
+			iinf = b
+		case "iloc":
+			iloc = b
+		case "idat":
+			idat = b
+		}
+	}
+	if iinf == nil || iloc == nil {
+		return nil, errBadHEIF
+	}
+	items, err := heifMetadataItems(iinf)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	return heifItemExtents(iloc, idat, items)
+}
+
+// heifMetadataItems() returns the IDs of the items in the "iinf" box which
+// are metadata. EXIF data is kept in "Exif" items, and XMP in "mime" items.
+func heifMetadataItems(iinf *isoBox) (map[uint64]bool, error) {
+	start := 6
+	if len(iinf.Body) > 0 && iinf.Body[0] != 0 {
+		start = 8
+	}
+	entries, err := isoBoxes(iinf, start)
+	if err != nil {
+		return nil, err
+	}
+	items := map[uint64]bool{}
+	for _, e := range entries {
+		if e.Type != "infe" {
+			continue
+		}
+		// Only versions 2 and 3 of "infe" have an item type, and HEIF
+		// requires them.
+		r := &boxReader{b: e.Body}
+		version := r.uint(1)
+		r.uint(3)
+		var id uint64
+		switch version {
+		case 2:
+			id = r.uint(2)
+		case 3:
+			id = r.uint(4)
+		default:
+			return nil, errBadHEIF
+		}
+		r.uint(2)
+		typ := r.bytes(4)
+		if r.err != nil {
+			return nil, r.err
+		}
+		if typ := string(typ); typ == "Exif" || typ == "mime" {
+			items[id] = true
+		}
+	}
+	return items, nil
+}
+
+// heifItemExtents() returns where in the file the items are kept, going by
+// the "iloc" box. Items may be kept anywhere in the file, or in the "idat"
+// box, but items made out of other items aren't supported.
+func heifItemExtents(iloc, idat *isoBox, items map[uint64]bool) ([][2]int64, error) {
+	r := &boxReader{b: iloc.Body}
+	version := r.uint(1)
+	r.uint(3)
+	sizes, more := r.uint(1), r.uint(1)
+	offSize, lenSize, baseSize := int(sizes>>4), int(sizes&15), int(more>>4)
+	idxSize, idSize := 0, 2
+	if version == 1 || version == 2 {
+		idxSize = int(more & 15)
+	}
+	if version == 2 {
+		idSize = 4
+	}
+	var extents [][2]int64
+	for n := r.uint(idSize); n > 0 && r.err == nil; n-- {
+		id := r.uint(idSize)
+		method := uint64(0)
+		if version == 1 || version == 2 {
+			method = r.uint(2) & 15
+		}
+		r.uint(2)
+		base := r.uint(baseSize)
+		for e := r.uint(2); e > 0 && r.err == nil; e-- {
+			r.uint(idxSize)
+			off, length := r.uint(offSize), r.uint(lenSize)
+			if !items[id] {
+				continue
+			}
+			start := int64(base + off)
+			switch {
+			case method == 1 && idat != nil:
+				start += idat.Off
+			case method != 0, length == 0:
+				return nil, errBadHEIF
+			}
+			extents = append(extents, [2]int64{start, int64(length)})
+		}
+	}
+	return extents, r.err
+}
+
+// boxReader{} reads the big endian fields of a box in turn. Reading past the
+// end sets err, after which nothing more is read.
+type boxReader struct {
+	b   []byte
+	err error
+}
+
+// uint() reads an n byte unsigned integer. n may be 0, for fields which are
+// left out.
+func (r *boxReader) uint(n int) uint64 {
+	if n > 8 && r.err == nil {
+		r.err = errBadHEIF
+	}
+	b := r.bytes(n)
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// bytes() reads n bytes.
+func (r *boxReader) bytes(n int) []byte {
+	if r.err == nil && n > len(r.b) {
+		r.err = errBadHEIF
+	}
+	if r.err != nil {
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
@@ -35,8 +35,10 @@ import (
 	"encoding/json"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -52,12 +54,21 @@ func exeTmpl(w http.ResponseWriter, r *http.Request, view *viewData, tmpl string
 	if r.Context().Value(ctxkey) != nil {
 		view.Credentials = r.Context().Value(ctxkey).(*credentials)
 	}
+	if view.Credentials != nil && view.Credentials.IsLoggedIn {
+		view.CSRF = csrfToken(view.Credentials)
+	}
 	// if view.Profile == nil {
 	// 	view.Credentials = r.Context().Value(ctxkey).(*credentials)
 	// }
 
 	view.AppName = AppName
-	view.Stream = stream
+	// pages showing posts of their own, such as viewItem(), keep them.
+	if view.Stream == nil {
+		view.Stream = stream
+	}
+	// leave out the posts of users the viewer blocked or muted, or who
+	// blocked them, and posts shadow hidden from them. see: filterStream()
+	view.Stream = filterStream(view.Stream, view.Credentials)
 	err := templates.ExecuteTemplate(w, tmpl, view)
 	if err != nil {
 		log.Println(err)
@@ -135,6 +146,35 @@ func setupLogging() {
 	}
 }
 
+// clientIP() returns the IP address of the client. X-Forwarded-For is only
+// trusted when the request comes from the local reverse proxy, otherwise
+// clients could pick their own address.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		fwd := r.Header.Get("X-Forwarded-For")
+		if i := strings.LastIndex(fwd, ","); i >= 0 {
+			fwd = fwd[i+1:]
+		}
+		if fwd = strings.TrimSpace(fwd); net.ParseIP(fwd) != nil {
+			return fwd
+		}
+	}
+	return host
+}
+
+// siteURL() returns the base URL of the site, as configured in
+// bolt.conf.json, for use in links sent outside of the browser (e.g. email).
+func siteURL() string {
+	if appConf.App.TLSEnabled {
+		return "https://" + appConf.App.DomainName
+	}
+	return "http://" + appConf.App.DomainName
+}
+
 // readConf() is used to read the bolt.conf.json configuration file, which is
 // used to configure the port, log file, and app name, but is otherwise
 // unnecessary for the tagmachine app to function.
@@ -0,0 +1,317 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// imaging.go houses the image pipeline. Uploaded images are decoded, and
+// re-encoded at each of the imageSizes which is smaller than the original,
+// plus the full size, which drops any metadata the original carried, such
+// as the GPS coordinates in EXIF data. The original is then removed. Posts
+// show the sizes with srcset, so browsers download the smallest which fits.
+// Animated GIFs, and formats there's no pure Go decoder for, such as AVIF
+// and HEIC, are kept as they are, though AVIF and HEIC lose their metadata.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// imageSize{} is one size the pipeline makes, no wider or taller than Max.
+type imageSize struct {
+	Name string
+	Max  int
+}
+
+// imageSizes are the sizes made of each image, smallest first. The last is
+// the full size, which every image is made at.
+var imageSizes = []imageSize{
+	{"thumb", 160},
+	{"feed", 640},
+	{"full", 1600},
+}
+
+const (
+	// maxImagePixels is the most pixels we'll decode, so a small file
+	// can't claim huge dimensions and use up the servers memory.
+	maxImagePixels = 50_000_000
+	// jpegQuality is the quality images are re-encoded at.
+	jpegQuality = 85
+)
+
+// errImageTooLarge is returned for images over maxImagePixels.
+var errImageTooLarge = errors.New("image too large")
+
+// imageVariant{} is one size of a processed image.
+type imageVariant struct {
+	Path   string `json:"path"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// imageHashes{} are the hashes made of an image as it's processed: its
+// blurhash placeholder, and its perceptual hash. see: blurhash.go, phash.go
+type imageHashes struct {
+	Blurhash string
+	PHash    string
+}
+
+// processImage() runs an uploaded image at path through the pipeline,
+// returning the sizes made, smallest first, the last being the full size,
+// and its hashes. Images which are kept as they are have no sizes, and
+// animated GIFs are hashed by their first frame.
+func processImage(path string, mt *mediaType) ([]imageVariant, imageHashes, error) {
+	if mt.Kind != "img" {
+		return nil, imageHashes{}, nil
+	}
+	// There's no pure Go decoder for AVIF or HEIC, so they're kept as they
+	// are, less their metadata. see: heif.go
+	if mt.MIME == "image/avif" || mt.MIME == "image/heic" {
+		return nil, imageHashes{}, stripHEIFMetadata(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, imageHashes{}, err
+	}
+	defer f.Close()
+
+	// Files which match an images signature, but won't decode, are
+	// refused like any other file we don't support.
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, imageHashes{}, fmt.Errorf("%w: %v", errUnsupportedMedia, err)
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return nil, imageHashes{}, errImageTooLarge
+	}
+	if _, err = f.Seek(0, 0); err != nil {
+		return nil, imageHashes{}, err
+	}
+	// The EXIF data isn't kept, so its orientation is applied to the
+	// pixels. see: exif.go
+	o := exifOrientation(f, mt)
+	if _, err = f.Seek(0, 0); err != nil {
+		return nil, imageHashes{}, err
+	}
+	// Only the first frame of a GIF is decoded, as an animation may have
+	// thousands of frames, each the size of the screen.
+	if mt.MIME == "image/gif" {
+		animated, err := gifAnimated(f)
+		if err != nil {
+			return nil, imageHashes{}, fmt.Errorf("%w: %v", errUnsupportedMedia, err)
+		}
+		if _, err = f.Seek(0, 0); err != nil {
+			return nil, imageHashes{}, err
+		}
+		if animated {
+			first, err := gif.Decode(f)
+			if err != nil {
+				return nil, imageHashes{}, fmt.Errorf("%w: %v", errUnsupportedMedia, err)
+			}
+			return nil, imageHashes{PHash: dhash(scaleImage(first, blurhashSample, o))}, nil
+		}
+	}
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return nil, imageHashes{}, fmt.Errorf("%w: %v", errUnsupportedMedia, err)
+	}
+
+	// Images with transparency are kept as PNG, and the rest become JPEG.
+	ext := "jpg"
+	if o, ok := src.(interface{ Opaque() bool }); ok && !o.Opaque() {
+		ext = "png"
+	}
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	b := src.Bounds()
+	var variants []imageVariant
+	for i, size := range imageSizes {
+		full := i == len(imageSizes)-1
+		if !full && b.Dx() <= size.Max && b.Dy() <= size.Max {
+			continue
+		}
+		v := imageVariant{Path: fmt.Sprintf("%s-%s.%s", base, size.Name, ext)}
+		if full {
+			v.Path = base + "." + ext
+		}
+		if v.Width, v.Height, err = writeVariant(v.Path+".tmp", src, size.Max, o, ext); err != nil {
+			removeVariants(variants)
+			return nil, imageHashes{}, err
+		}
+		variants = append(variants, v)
+	}
+
+	// The new files take their place once they're all written, as the
+	// full size may replace the original.
+	for _, v := range variants {
+		if err = os.Rename(v.Path+".tmp", v.Path); err != nil {
+			return nil, imageHashes{}, err
+		}
+	}
+	if path != variants[len(variants)-1].Path {
+		os.Remove(path)
+	}
+	small := scaleImage(src, blurhashSample, o)
+	return variants, imageHashes{Blurhash: blurhash(small), PHash: dhash(small)}, nil
+}
+
+// gifAnimated() reports whether the GIF read from r has more than one frame,
+// by walking its blocks without decompressing any of them.
+func gifAnimated(r io.Reader) (bool, error) {
+	br := bufio.NewReader(r)
+	skip := func(n int) error {
+		_, err := br.Discard(n)
+		return err
+	}
+	// skipColors() skips the color table which packed says follows.
+	skipColors := func(packed byte) error {
+		if packed&0x80 == 0 {
+			return nil
+		}
+		return skip(3 << ((packed & 7) + 1))
+	}
+	// skipSubBlocks() skips data sub-blocks, up to the empty one ending them.
+	skipSubBlocks := func() error {
+		for {
+			n, err := br.ReadByte()
+			if err != nil || n == 0 {
+				return err
+			}
+			if err = skip(int(n)); err != nil {
+				return err
+			}
+		}
+	}
+
+	var header [13]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return false, err
+	}
+	if err := skipColors(header[10]); err != nil {
+		return false, err
+	}
+	frames := 0
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return false, err
+		}
+		switch b {
+		case 0x21: // extension: its label, then its data.
+			if err = skip(1); err == nil {
+				err = skipSubBlocks()
+			}
+		case 0x2C: // image: its descriptor, colors, LZW code size and data.
+			if frames++; frames > 1 {
+				return true, nil
+			}
+			var desc [9]byte
+			if _, err = io.ReadFull(br, desc[:]); err == nil {
+				if err = skipColors(desc[8]); err == nil {
+					if err = skip(1); err == nil {
+						err = skipSubBlocks()
+					}
+				}
+			}
+		case 0x3B: // trailer.
+			return false, nil
+		default:
+			return false, fmt.Errorf("gif: unknown block 0x%02x", b)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// writeVariant() scales src to fit within limit by limit, turned the right
+// way up for the EXIF orientation o, and encodes it to path. It returns the
+// size it ended up.
+func writeVariant(path string, src image.Image, limit, o int, ext string) (int, int, error) {
+	dst := scaleImage(src, limit, o)
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	if ext == "png" {
+		err = png.Encode(f, dst)
+	} else {
+		err = jpeg.Encode(f, dst, &jpeg.Options{Quality: jpegQuality})
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return dst.Bounds().Dx(), dst.Bounds().Dy(), err
+}
+
+// scaleImage() scales src to fit within limit by limit, keeping its aspect
+// ratio, and turns it the right way up for the EXIF orientation o.
+func scaleImage(src image.Image, limit, o int) *image.RGBA {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > limit || h > limit {
+		if w >= h {
+			w, h = limit, h*limit/w
+		} else {
+			w, h = w*limit/h, limit
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, max(w, 1), max(h, 1)))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+	return orient(dst, o)
+}
+
+// removeVariants() removes the temp files of variants written so far, when
+// the pipeline fails part way.
+func removeVariants(variants []imageVariant) {
+	for _, v := range variants {
+		os.Remove(v.Path + ".tmp")
+	}
+}
+
+// srcset() returns the srcset attribute listing the variants, by width.
+// see: mediaURL()
+func srcset(variants []imageVariant) string {
+	set := make([]string, len(variants))
+	for i, v := range variants {
+		set[i] = fmt.Sprintf("%s %dw", mediaURL(v.Path), v.Width)
+	}
+	return strings.Join(set, ", ")
+}
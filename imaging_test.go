@@ -0,0 +1,120 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testGIF() returns a GIF of n frames, each w by h, the first drawn from
+// testImage() so it has something to hash.
+func testGIF(t *testing.T, n, w, h int) []byte {
+	g := &gif.GIF{}
+	for i := 0; i < n; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, w, h), palette.Plan9)
+		if i == 0 {
+			src := testImage(w, h)
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					frame.Set(x, y, src.At(x, y))
+				}
+			}
+		}
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10)
+	}
+	var b bytes.Buffer
+	if err := gif.EncodeAll(&b, g); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestGIFAnimated(t *testing.T) {
+	for _, tt := range []struct {
+		frames int
+		want   bool
+	}{
+		{1, false},
+		{2, true},
+		{50, true},
+	} {
+		got, err := gifAnimated(bytes.NewReader(testGIF(t, tt.frames, 32, 24)))
+		if err != nil {
+			t.Fatalf("%d frames: %v", tt.frames, err)
+		}
+		if got != tt.want {
+			t.Errorf("%d frames: animated = %v, want %v", tt.frames, got, tt.want)
+		}
+	}
+
+	b := testGIF(t, 1, 32, 24)
+	if _, err := gifAnimated(bytes.NewReader(b[:len(b)-8])); err == nil {
+		t.Error("truncated GIF: no error")
+	}
+}
+
+// TestProcessImageAnimatedGIF checks an animated GIF is kept as it is, and
+// hashed by its first frame alone.
+func TestProcessImageAnimatedGIF(t *testing.T) {
+	mt := mediaTypeByExt("gif")
+	dir := t.TempDir()
+
+	one := filepath.Join(dir, "one.gif")
+	if err := os.WriteFile(one, testGIF(t, 1, 64, 48), 0644); err != nil {
+		t.Fatal(err)
+	}
+	many := filepath.Join(dir, "many.gif")
+	if err := os.WriteFile(many, testGIF(t, 200, 64, 48), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	variants, h, err := processImage(many, mt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if variants != nil {
+		t.Errorf("animated GIF re-encoded: %v", variants)
+	}
+	if _, err = os.Stat(many); err != nil {
+		t.Errorf("animated GIF removed: %v", err)
+	}
+	_, still, err := processImage(one, mt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.PHash == "" || h.PHash != still.PHash {
+		t.Errorf("phash = %q, want the first frames %q", h.PHash, still.PHash)
+	}
+}
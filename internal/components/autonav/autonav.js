@@ -71,6 +71,7 @@ async function auth(path) {
     if (validateFormData()) {
         let response = await fetch("/"+path, {
             method: "POST",
+            headers: csrfHeaders(),
             body: JSON.stringify({
                 password: password.value,
                 username: username.value,
@@ -81,9 +82,50 @@ async function auth(path) {
             location.reload();
             return
         } 
+        if (res.status == "2fa") {
+            signinTOTP(res.challenge);
+            return
+        }
         document.getElementById("errorDiv").innerHTML = res.status;
     }
 }
+// signinTOTP is the second step of signin for users with two-factor
+// authentication enabled. challenge is the token returned by /signin.
+async function signinTOTP(challenge) {
+    let code = prompt("authentication or recovery code");
+    if (code == null) { return }
+    let response = await fetch("/signinTOTP", {
+        method: "POST",
+        headers: csrfHeaders(),
+        body: JSON.stringify({challenge: challenge, code: code}),
+    });
+    let res = await response.json();
+    if (res.status == "success") {
+        location.reload();
+        return
+    }
+    document.getElementById("errorDiv").innerHTML = res.status;
+}
+// When signing in with an identity provider, users with two-factor
+// authentication enabled are sent back here with a challenge in the URL
+// fragment, so they can finish signing in with a code.
+if (window.location.hash.startsWith("#2fa=")) {
+    let challenge = decodeURIComponent(window.location.hash.slice(5));
+    history.replaceState(null, "", window.location.pathname);
+    signinTOTP(challenge);
+}
+// resendVerification asks the server to send another verification email,
+// and displays the result in place of the notice.
+async function resendVerification() {
+    let response = await fetch("/resendVerification", {method: "POST", headers: csrfHeaders()});
+    let res = await response.json();
+    let notice = document.getElementById("nav-verify");
+    if (res.status == "success") {
+        notice.innerHTML = "check your email";
+        return
+    }
+    notice.innerHTML = res.status;
+}
 function tf() {
     np.style.right = "-" + np.offsetWidth + "px";
     document.removeEventListener('click', tf);
@@ -110,11 +152,14 @@ function toggleAuth() {
         tog2.classList.add("nta3-toggled");
         togl.onclick = async function auth(path) {
             if (validateFormData()) {
+                document.getElementById("errorDiv").innerHTML = "one moment...";
                 let response = await fetch("/signup", {
                     method: "POST",
+                    headers: await powHeaders("signup"),
                     body: JSON.stringify({
                         password: password.value,
                         username: username.value,
+                        invite: inviteCode(),
                     }),
                 });
                 let res = await response.json();
@@ -130,6 +175,7 @@ function toggleAuth() {
             if (validateFormData()) {
                 let response = await fetch("/signin", {
                     method: "POST",
+                    headers: csrfHeaders(),
                     body: JSON.stringify({
                         password: password.value,
                         username: username.value,
@@ -140,6 +186,10 @@ function toggleAuth() {
                     location.reload();
                     return
                 } 
+                if (res.status == "2fa") {
+                    signinTOTP(res.challenge);
+                    return
+                }
                 document.getElementById("errorDiv").innerHTML = res.status;
             }
         }
@@ -166,3 +216,15 @@ function toggleAuth() {
         authToggled = false;
     }
 }
+// inviteCode returns the invite code from an invite link, /?invite=[code],
+// which is sent along with the signup. see: invite.go
+function inviteCode() {
+    return new URLSearchParams(window.location.search).get("invite") || "";
+}
+// The invite code is passed on to identity providers too, in case the user
+// signs up with one.
+if (inviteCode()) {
+    document.querySelectorAll(".nav-oidc").forEach(a => {
+        a.href += "?invite=" + encodeURIComponent(inviteCode());
+    });
+}
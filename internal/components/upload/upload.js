@@ -29,18 +29,161 @@ async function submitPost() {
                 did_submit = true;
                 const form = document.getElementById("uploadForm");
                 const data = new FormData(form);
+                // Each file is followed by its alt text, which the server
+                // matches up in order. Large files are sent ahead in
+                // chunks, so a dropped connection doesn't mean starting
+                // over. see: resumable.go
+                const files = data.getAll("Media").filter(f => f.name);
+                const alts = document.querySelectorAll(".upload-alt");
+                data.delete("Media");
+                for (let i = 0; i < files.length && i < maxAttachments; i++) {
+                        if (files[i].size > resumableSize) {
+                                let id;
+                                try {
+                                        id = await resumableUpload(files[i]);
+                                } catch (e) {
+                                        did_submit = false;
+                                        document.getElementById("errorField").innerText = e.message;
+                                        return;
+                                }
+                                data.append("upload", id);
+                        } else {
+                                data.append("Media", files[i]);
+                        }
+                        data.append("alt", alts[i] ? alts[i].value : "");
+                }
                 let response = await fetch("/uploadItem", {
                         method: "POST",
+                        headers: await powHeaders("post"),
                         body: data,
                 });
                 let res = await response.json();
                 if (res.status != "success") {
-                        document.getElementById("errorField").innerHTML = res.error;
+                        did_submit = false;
+                        document.getElementById("errorField").innerText = res.status;
                         return;
                 }
+                if (res.notice) {
+                        alert(res.notice);
+                }
                 location.reload();
         }
 }
+// A post has at most maxAttachments files. see: attachment.go
+const maxAttachments = 4;
+// showAttachments lists the files chosen for a post, each with a field to
+// describe it for people who can't see it.
+function showAttachments() {
+        const list = document.getElementById("upload-attachments");
+        list.innerHTML = "";
+        const files = [...document.getElementById("Media").files];
+        if (files.length > maxAttachments) {
+                document.getElementById("errorField").innerText =
+                        "Only The First " + maxAttachments + " Files Will Be Posted";
+        }
+        files.slice(0, maxAttachments).forEach((file) => {
+                const row = document.createElement("div");
+                row.className = "upload-attachment";
+                const name = document.createElement("span");
+                name.innerText = file.name;
+                const alt = document.createElement("input");
+                alt.className = "upload-alt";
+                alt.type = "text";
+                alt.maxLength = 1000;
+                alt.placeholder = "describe this for people who can't see it";
+                row.append(name, alt);
+                list.append(row);
+        });
+}
+// Files larger than resumableSize are uploaded in chunks.
+const resumableSize = 8 << 20;
+// resumableUpload sends a file in chunks, retrying failed chunks from where
+// the server says the upload got to, and resolves to the uploads ID. The ID
+// is kept in localStorage, so the same file can pick up where it left off
+// after the page is reloaded.
+async function resumableUpload(file) {
+        const fileKey = "upload:" + file.name + ":" + file.size + ":" + file.lastModified;
+        let id = localStorage.getItem(fileKey);
+        let offset = 0;
+        let chunkSize = resumableSize;
+        if (id) {
+                let response = await fetch("/uploadStatus/" + id);
+                let res = await response.json();
+                if (res.status == "success") {
+                        offset = parseInt(res.offset);
+                } else {
+                        id = null;
+                }
+        }
+        if (!id) {
+                let response = await fetch("/startUpload", {
+                        method: "POST",
+                        headers: csrfHeaders(),
+                        body: JSON.stringify({"size": file.size}),
+                });
+                let res = await response.json();
+                if (res.status != "success") {
+                        throw new Error(res.status);
+                }
+                id = res.id;
+                chunkSize = parseInt(res.chunk_size);
+                localStorage.setItem(fileKey, id);
+        }
+        let failures = 0;
+        while (offset < file.size) {
+                showUploadProgress(offset, file.size);
+                let refused = "";
+                try {
+                        let headers = csrfHeaders();
+                        headers["Upload-Offset"] = offset;
+                        let response = await fetch("/uploadChunk/" + id, {
+                                method: "POST",
+                                headers: headers,
+                                body: file.slice(offset, offset + chunkSize),
+                        });
+                        let res = await response.json();
+                        if (res.offset) {
+                                // The server says where to carry on from.
+                                offset = parseInt(res.offset);
+                                failures = 0;
+                                continue;
+                        }
+                        if (response.status == 429) {
+                                // Too many chunks, so wait as long as the
+                                // server says, and carry on.
+                                await new Promise(r => setTimeout(r, 1000 * parseInt(res.retry_after)));
+                                continue;
+                        }
+                        if (response.status < 500 && response.status != 409) {
+                                refused = res.status;
+                        }
+                } catch (e) {}
+                if (refused) {
+                        throw new Error(refused);
+                }
+                // The connection dropped, so wait a little longer each
+                // time, and then ask where the upload got to.
+                if (++failures > 8) {
+                        throw new Error("Upload Failed, Try Again Later");
+                }
+                await new Promise(r => setTimeout(r, 1000 * 2 ** failures));
+                try {
+                        let response = await fetch("/uploadStatus/" + id);
+                        let res = await response.json();
+                        if (res.status == "success") {
+                                offset = parseInt(res.offset);
+                        }
+                } catch (e) {}
+        }
+        showUploadProgress(file.size, file.size);
+        localStorage.removeItem(fileKey);
+        return id;
+}
+// showUploadProgress shows how much of a resumable upload has been sent.
+function showUploadProgress(sent, size) {
+        document.getElementById("errorField").innerText =
+                "Uploading " + Math.floor(100 * sent / size) + "%";
+}
 //async function submitImg() {
 //        const form = document.getElementById("img-uploadForm");
 //        const data = new FormData(form);
@@ -32,6 +32,7 @@ async function submitEdits(elid, cls) {
 
         let response = await fetch("/edit", {
                 method: "POST", 
+                headers: csrfHeaders(),
                 body: data
         });
         let res = await response.json();
@@ -49,6 +50,7 @@ async function submitEditsInputs(elid) {
 
         let response = await fetch("/edit", {
                 method: "POST", 
+                headers: csrfHeaders(),
                 body: data
         });
         let res = await response.json();
@@ -58,3 +60,306 @@ async function submitEditsInputs(elid) {
                 document.getElementById("errorField").innerHTML = res.error;
         }
 }
+// enrollTOTP begins two-factor enrollment, showing the QR code and secret for
+// the user to add to their authenticator app, and a field for the first code.
+async function enrollTOTP() {
+        let response = await fetch("/enrollTOTP", {method: "POST", headers: csrfHeaders()});
+        let res = await response.json();
+        let el = document.getElementById("profile-totp");
+        if (res.status != "success") {
+                el.innerText = res.status;
+                return
+        }
+        el.innerHTML = "<div class='profile-totp-qr'>" + res.qr + "</div>" +
+                "<div class='profile-totp-secret'></div>" +
+                "<input class='profile-input' id='profile-totp-code' placeholder='code'/>" +
+                "<div class='profile-show-friends' onclick='confirmTOTP()'>confirm</div>";
+        el.querySelector(".profile-totp-secret").innerText = res.secret;
+}
+// confirmTOTP finishes enrollment and shows the recovery codes, which the
+// server only ever sends once.
+async function confirmTOTP() {
+        let code = document.getElementById("profile-totp-code").value;
+        let response = await fetch("/confirmTOTP", {
+                method: "POST",
+                headers: csrfHeaders(),
+                body: JSON.stringify({code: code}),
+        });
+        let res = await response.json();
+        let el = document.getElementById("profile-totp");
+        if (res.status != "success") {
+                el.querySelector(".profile-totp-secret").innerText = res.status;
+                return
+        }
+        el.innerText = "save these recovery codes somewhere safe: " +
+                res.codes.split(" ").join("  ");
+}
+async function disableTOTP() {
+        let pass = prompt("password");
+        if (pass == null) { return }
+        let response = await fetch("/disableTOTP", {
+                method: "POST",
+                headers: csrfHeaders(),
+                body: JSON.stringify({password: pass}),
+        });
+        let res = await response.json();
+        if (res.status == "success") {
+                location.reload();
+                return
+        }
+        document.getElementById("profile-totp").innerText = res.status;
+}
+// showTokens lists the users API tokens, with a form for creating new ones.
+async function showTokens() {
+        let response = await fetch("/apiTokens");
+        let res = await response.json();
+        let el = document.getElementById("profile-tokens");
+        if (res.status != "success") {
+                el.innerText = res.status;
+                return
+        }
+        el.innerHTML = "<input class='profile-input' id='profile-token-name' placeholder='token name'/>" +
+                "<div class='profile-token-scopes'>" +
+                ["read", "post", "like", "follow", "admin"].map(s =>
+                        "<label><input type='checkbox' value='" + s + "'/>" + s + "</label>").join("") +
+                "</div>" +
+                "<select class='profile-input' id='profile-token-expiry'>" +
+                "<option value='30'>30 days</option><option value='90'>90 days</option>" +
+                "<option value='365'>1 year</option><option value='0'>never expires</option>" +
+                "</select>" +
+                "<div class='profile-show-friends' onclick='createToken()'>create</div>" +
+                "<div class='profile-token-new' id='profile-token-new'></div>";
+        for (const t of res.tokens) {
+                let row = document.createElement("div");
+                row.className = "profile-token";
+                let used = t.last_used ? new Date(t.last_used * 1000).toLocaleString() : "never";
+                let expires = t.expires ? new Date(t.expires * 1000).toLocaleDateString() : "never";
+                row.innerText = t.name + " (" + t.scopes + ") used: " + used + " expires: " + expires;
+                let revoke = document.createElement("span");
+                revoke.className = "profile-token-revoke";
+                revoke.innerText = "revoke";
+                revoke.onclick = () => revokeToken(t.id);
+                row.appendChild(revoke);
+                el.appendChild(row);
+        }
+}
+// createToken creates a token and shows it. The server only ever sends a
+// token this once.
+async function createToken() {
+        let scopes = [...document.querySelectorAll(".profile-token-scopes input:checked")].map(i => i.value);
+        let response = await fetch("/createToken", {
+                method: "POST",
+                headers: csrfHeaders(),
+                body: JSON.stringify({
+                        name: document.getElementById("profile-token-name").value,
+                        scopes: scopes,
+                        expires_in: parseInt(document.getElementById("profile-token-expiry").value),
+                }),
+        });
+        let res = await response.json();
+        if (res.status != "success") {
+                document.getElementById("profile-token-new").innerText = res.status;
+                return
+        }
+        await showTokens();
+        document.getElementById("profile-token-new").innerText =
+                "copy this token now, it won't be shown again: " + res.token;
+}
+async function revokeToken(id) {
+        if (!confirm("revoke this token?")) { return }
+        let response = await fetch("/revokeToken/" + id, {method: "POST", headers: csrfHeaders()});
+        let res = await response.json();
+        if (res.status != "success") {
+                document.getElementById("profile-tokens").innerText = res.status;
+                return
+        }
+        showTokens();
+}
+// showInvites lists the users invite codes, with a form for making new ones,
+// and the users they've invited. see: invite.go
+async function showInvites() {
+        let response = await fetch("/invites");
+        let res = await response.json();
+        let el = document.getElementById("profile-invites");
+        if (res.status != "success") {
+                el.innerText = res.status;
+                return
+        }
+        el.innerHTML = "<div>signup is " + res.mode + "</div>" +
+                "<input class='profile-input' id='profile-invite-uses' type='number' min='1' value='1' placeholder='uses'/>" +
+                "<select class='profile-input' id='profile-invite-days'>" +
+                "<option value='1'>1 day</option><option value='7'>7 days</option>" +
+                "<option value='30'>30 days</option>" +
+                "{{ if hasRole .Credentials "admin" }}<option value='0'>never expires</option>{{ end }}" +
+                "</select>" +
+                "<div class='profile-show-friends' onclick='createInvite()'>create</div>" +
+                "<div class='profile-token-new' id='profile-invite-new'></div>";
+        for (const inv of res.invites) {
+                let row = document.createElement("div");
+                row.className = "profile-token";
+                let expires = inv.expires ? new Date(inv.expires * 1000).toLocaleDateString() : "never";
+                row.innerText = window.location.origin + "/?invite=" + inv.code +
+                        " used: " + inv.uses + "/" + inv.max_uses + " expires: " + expires;
+                let revoke = document.createElement("span");
+                revoke.className = "profile-token-revoke";
+                revoke.innerText = "revoke";
+                revoke.onclick = () => revokeInvite(inv.code);
+                row.appendChild(revoke);
+                el.appendChild(row);
+        }
+        for (const id of res.invited || []) {
+                let row = document.createElement("div");
+                let link = document.createElement("a");
+                link.href = "/user/" + id;
+                link.innerText = "invited " + id;
+                row.appendChild(link);
+                el.appendChild(row);
+        }
+}
+async function createInvite() {
+        let response = await fetch("/createInvite", {
+                method: "POST",
+                headers: csrfHeaders(),
+                body: JSON.stringify({
+                        max_uses: parseInt(document.getElementById("profile-invite-uses").value) || 1,
+                        days: parseInt(document.getElementById("profile-invite-days").value),
+                }),
+        });
+        let res = await response.json();
+        if (res.status != "success") {
+                document.getElementById("profile-invite-new").innerText = res.status;
+                return
+        }
+        showInvites();
+}
+async function revokeInvite(code) {
+        if (!confirm("revoke this invite?")) { return }
+        let response = await fetch("/revokeInvite/" + code, {method: "POST", headers: csrfHeaders()});
+        let res = await response.json();
+        if (res.status != "success") {
+                document.getElementById("profile-invites").innerText = res.status;
+                return
+        }
+        showInvites();
+}
+// showStorage shows how much the user has uploaded, against the quota for
+// their role. A quota of 0 is no limit. see: quota.go
+async function showStorage() {
+        let response = await fetch("/storage");
+        let res = await response.json();
+        let el = document.getElementById("profile-storage");
+        if (res.status != "success") {
+                el.innerText = res.status;
+                return
+        }
+        const mb = (bytes) => (parseInt(bytes) / (1 << 20)).toFixed(1) + "MB";
+        const line = (used, quota, show) => {
+                let row = document.createElement("div");
+                row.innerText = show(used) + (parseInt(quota) > 0 ? " of " + show(quota) : ", no limit");
+                el.appendChild(row);
+                if (parseInt(quota) <= 0) { return }
+                let share = Math.min(1, parseInt(used) / parseInt(quota));
+                let bar = document.createElement("div");
+                bar.className = "profile-storage-bar" + (share >= 0.9 ? " profile-storage-full" : "");
+                let fill = document.createElement("div");
+                fill.className = "profile-storage-used";
+                fill.style.width = (100 * share) + "%";
+                bar.appendChild(fill);
+                el.appendChild(bar);
+        };
+        el.innerHTML = "";
+        line(res.bytes, res.quota_bytes, mb);
+        line(res.files, res.quota_files, (n) => n + " files");
+        let role = document.createElement("div");
+        role.innerText = "quota for the " + res.role + " role";
+        el.appendChild(role);
+}
+// requestExport starts building an archive of the users data, then checks on
+// it until it's ready to download.
+async function requestExport() {
+        let response = await fetch("/requestExport", {method: "POST", headers: csrfHeaders()});
+        let res = await response.json();
+        let el = document.getElementById("profile-export");
+        if (res.status != "success") {
+                el.innerText = res.status;
+                return
+        }
+        el.innerText = "building your export, we'll email you when it's ready";
+        checkExport();
+}
+async function checkExport() {
+        let response = await fetch("/exportStatus");
+        let res = await response.json();
+        let el = document.getElementById("profile-export");
+        if (res.status == "pending") {
+                setTimeout(checkExport, 3000);
+                return
+        }
+        if (res.status == "ready") {
+                el.innerHTML = "<a href='/downloadExport'>download your export</a>";
+                return
+        }
+        el.innerText = res.status == "failed" ? "export failed, please try again" : "";
+}
+// deleteAccount permanently deletes the users account, after they confirm
+// with their password, or their email if they don't have one.
+async function deleteAccount() {
+        if (!confirm("permanently delete your account and all of your posts?")) { return }
+        let pass = prompt("password (or your email, if you sign in with another site)");
+        if (pass == null) { return }
+        let response = await fetch("/deleteAccount", {
+                method: "POST",
+                headers: csrfHeaders(),
+                body: JSON.stringify({password: pass, email: pass}),
+        });
+        let res = await response.json();
+        if (res.status == "success") {
+                window.location = window.location.origin;
+                return
+        }
+        document.getElementById("profile-export").innerText = res.status;
+}
+if (document.getElementById("profile-export")) { checkExport(); }
+// setBlock blocks, unblocks, mutes or unmutes a user. action is the route,
+// one of "block", "unblock", "mute" or "unmute".
+async function setBlock(action, id) {
+        if (action == "block" && !confirm("block " + id + "? neither of you will see the other")) { return }
+        let response = await fetch("/" + action + "/" + id, {method: "POST", headers: csrfHeaders()});
+        let res = await response.json();
+        if (res.status == "success") {
+                location.reload();
+                return
+        }
+        alert(res.status);
+}
+// showBlocks lists the users the user has blocked and muted, so they can
+// unblock or unmute them.
+async function showBlocks() {
+        let response = await fetch("/blocks");
+        let res = await response.json();
+        let el = document.getElementById("profile-blocks");
+        if (res.status != "success") {
+                el.innerText = res.status;
+                return
+        }
+        el.innerHTML = "";
+        const list = (ids, action) => {
+                for (const id of ids || []) {
+                        let row = document.createElement("div");
+                        let link = document.createElement("a");
+                        link.href = "/user/" + id;
+                        link.innerText = id;
+                        let undo = document.createElement("span");
+                        undo.className = "profile-token-revoke";
+                        undo.innerText = action;
+                        undo.onclick = () => setBlock(action, id);
+                        row.append(link, undo);
+                        el.appendChild(row);
+                }
+        };
+        list(res.blocked, "unblock");
+        list(res.muted, "unmute");
+        if (!el.hasChildNodes()) {
+                el.innerText = "you haven't blocked or muted anyone";
+        }
+}
@@ -0,0 +1,65 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// setRole changes a users role. see: roles.go
+async function setRole(id, role) {
+        let response = await fetch("/setRole", {
+                method: "POST",
+                headers: csrfHeaders(),
+                body: JSON.stringify({id: id, role: role}),
+        });
+        let res = await response.json();
+        document.getElementById("admin-status").innerText =
+                res.status == "success" ? id + " is now " + role : res.status;
+}
+
+// setThrottle adjusts a users rate limits, as a percentage of the budgets for
+// their role. see: ratelimit.go
+async function setThrottle(id, throttle) {
+        let response = await fetch("/setThrottle", {
+                method: "POST",
+                headers: csrfHeaders(),
+                body: JSON.stringify({id: id, throttle: parseInt(throttle) || 0}),
+        });
+        let res = await response.json();
+        document.getElementById("admin-status").innerText =
+                res.status == "success" ? id + " is now throttled to " + throttle + "%" : res.status;
+}
+
+// decideSignup approves or rejects a user on the waitlist. action is the
+// route, either "approveSignup" or "rejectSignup". see: invite.go
+async function decideSignup(action, id) {
+        if (action == "rejectSignup" && !confirm("reject " + id + "? their account will be deleted")) { return }
+        let response = await fetch("/" + action + "/" + id, {method: "POST", headers: csrfHeaders()});
+        let res = await response.json();
+        if (res.status != "success") {
+                document.getElementById("admin-status").innerText = res.status;
+                return
+        }
+        document.getElementById("waitlist_" + id).remove();
+}
@@ -0,0 +1,61 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// moderate posts to one of the moderation routes, reloading the page to show
+// the updated queue, or the error if there was one. see: moderation.go
+async function moderate(path, body) {
+        let response = await fetch(path, {
+                method: "POST",
+                headers: csrfHeaders(),
+                body: JSON.stringify(body || {}),
+        });
+        let res = await response.json();
+        if (res.status == "success") {
+                location.reload();
+                return
+        }
+        document.getElementById("moderation-status").innerText = res.status;
+}
+function claimReport(id) {
+        moderate("/claimReport/" + id);
+}
+function releaseReport(id) {
+        moderate("/releaseReport/" + id);
+}
+function resolveReport(id) {
+        moderate("/resolveReport/" + id, {
+                action: document.getElementById("action_" + id).value,
+                days: parseInt(document.getElementById("days_" + id).value),
+                note: document.getElementById("note_" + id).value,
+        });
+}
+// unblockMedia takes an image off the media blocklist. see: phash.go
+function unblockMedia(hash) {
+        if (!confirm("let this image be posted again?")) { return }
+        moderate("/unblockMedia/" + hash);
+}
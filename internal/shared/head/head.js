@@ -26,6 +26,68 @@
 //
 // ////////////////////////////////////////////////////////////////////////////
 //
+// csrfHeaders returns the headers sent with every request that changes state,
+// carrying the users CSRF token from the page. see: csrf.go
+function csrfHeaders() {
+        return {"X-CSRF-Token": document.querySelector("meta[name=csrf-token]").content};
+}
+// Requests over a rate limit are answered with 429 Too Many Requests, and a
+// Retry-After header saying how many seconds to wait. fetch is wrapped so the
+// user is told, whichever script made the request. see: ratelimit.go
+const unlimitedFetch = window.fetch;
+window.fetch = async function(...args) {
+        let response = await unlimitedFetch(...args);
+        if (response.status == 429) {
+                showRateLimit(response.headers.get("Retry-After"));
+        }
+        return response;
+};
+function showRateLimit(secs) {
+        let notice = document.getElementById("rate-limit");
+        if (!notice) {
+                notice = document.createElement("div");
+                notice.id = "rate-limit";
+                notice.className = "rate-limit";
+                document.body.appendChild(notice);
+        }
+        notice.innerText = "slow down! try again in " + secs + "s";
+        notice.style.display = "block";
+        clearTimeout(notice.timer);
+        notice.timer = setTimeout(() => { notice.style.display = "none" }, 5000);
+}
+// powHeaders returns the headers for a request taking action, solving the
+// proof-of-work challenge for it if the server asks for one. The challenge is
+// solved by finding a nonce where the SHA-256 hash of challenge:nonce starts
+// with the given number of zero bits. see: pow.go
+async function powHeaders(action) {
+        let headers = csrfHeaders();
+        let response = await fetch("/challenge?action=" + action);
+        let res = await response.json();
+        if (!res.challenge) {
+                return headers;
+        }
+        let bits = parseInt(res.bits);
+        let enc = new TextEncoder();
+        for (let nonce = 0; ; nonce++) {
+                let sum = new Uint8Array(await crypto.subtle.digest("SHA-256",
+                        enc.encode(res.challenge + ":" + nonce)));
+                if (leadingZeros(sum) >= bits) {
+                        headers["X-PoW-Challenge"] = res.challenge;
+                        headers["X-PoW-Nonce"] = String(nonce);
+                        return headers;
+                }
+        }
+}
+function leadingZeros(sum) {
+        let n = 0;
+        for (let b of sum) {
+                if (b != 0) {
+                        return n + Math.clz32(b) - 24;
+                }
+                n += 8;
+        }
+        return n;
+}
 function toggleDisplay(elem) {
         let formDisplay = document.getElementById("item-controls_"+elem);
         let butt = document.getElementById("item-shr-"+elem);
@@ -41,10 +103,17 @@ async function submitReply(parent) {
                 let txt = document.getElementById("uptext_"+parent).value
                 let response = await fetch("/reply", {
                         method: "POST",
+                        headers: await powHeaders("post"),
                         body: JSON.stringify({"parent": parent, "uptext": txt}),
                 });
                 let res = await response.json();
                 if (res.status == "success") {
+                        // replies held for review can't be viewed yet.
+                        if (res.notice) {
+                                alert(res.notice);
+                                window.location = window.location.origin + "/view/"+parent;
+                                return;
+                        }
                         window.location = window.location.origin + "/view/"+res.ID;
                 }
         }
@@ -52,6 +121,7 @@ async function submitReply(parent) {
 async function like(postID) {
         let response = await fetch("/like/"+postID, {
                 method: "POST",
+                headers: csrfHeaders(),
                 body: {"id": postID},
         });
 
@@ -63,12 +133,83 @@ async function like(postID) {
         }
 }
 async function share(postID) {
-        let response = await fetch("/share", {method: "POST", body: {"id": postID}});
+        let response = await fetch("/share/"+postID, {method: "POST", headers: csrfHeaders(), body: {"id": postID}});
         let res      = await response.json();
 
         if (res.success == "true") {window.location = window.location.origin;} 
         else {document.getElementById("errorField").innerHTML = res.error;}
 }
+// report reports a post or user to the moderators. see: moderation.go
+async function report(targetType, target) {
+        let reason = prompt("why are you reporting this? spam, harassment, hate, violence, illegal, or other");
+        if (reason == null) { return }
+        let text = prompt("anything else the moderators should know?") || "";
+        let response = await fetch("/report", {
+                method: "POST",
+                headers: csrfHeaders(),
+                body: JSON.stringify({target_type: targetType, target: target,
+                        reason: reason.trim().toLowerCase(), text: text}),
+        });
+        let res = await response.json();
+        alert(res.status == "success" ? "thanks, the moderators will take a look" : res.status);
+}
+// decodeBlurhash paints a blurhash onto a canvas, as a placeholder while the
+// image it describes loads. see: blurhash.go
+function decodeBlurhash(canvas, hash) {
+        const chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~";
+        const b83 = (s) => [...s].reduce((n, c) => n * 83 + chars.indexOf(c), 0);
+        const toLinear = (v) => { v /= 255; return v <= 0.04045 ? v / 12.92 : Math.pow((v + 0.055) / 1.055, 2.4) };
+        const toSRGB = (v) => {
+                v = Math.max(0, Math.min(1, v));
+                return Math.round((v <= 0.0031308 ? v * 12.92 : 1.055 * Math.pow(v, 1 / 2.4) - 0.055) * 255);
+        };
+        const signPow = (v, e) => Math.sign(v) * Math.pow(Math.abs(v), e);
+
+        let size = b83(hash[0]), nx = size % 9 + 1, ny = Math.floor(size / 9) + 1;
+        if (hash.length != 4 + 2 * nx * ny) { return }
+        let maxValue = (b83(hash[1]) + 1) / 166;
+        let dc = b83(hash.slice(2, 6));
+        let colors = [[toLinear(dc >> 16), toLinear((dc >> 8) & 255), toLinear(dc & 255)]];
+        for (let i = 1; i < nx * ny; i++) {
+                let v = b83(hash.slice(4 + i * 2, 6 + i * 2));
+                colors.push([Math.floor(v / 361), Math.floor(v / 19) % 19, v % 19]
+                        .map((q) => signPow((q - 9) / 9, 2) * maxValue));
+        }
+
+        let w = canvas.width, h = canvas.height;
+        let ctx = canvas.getContext("2d");
+        let img = ctx.createImageData(w, h);
+        for (let y = 0; y < h; y++) {
+                for (let x = 0; x < w; x++) {
+                        let rgb = [0, 0, 0];
+                        for (let j = 0; j < ny; j++) {
+                                for (let i = 0; i < nx; i++) {
+                                        let basis = Math.cos(Math.PI * x * i / w) * Math.cos(Math.PI * y * j / h);
+                                        let c = colors[i + j * nx];
+                                        for (let k = 0; k < 3; k++) { rgb[k] += c[k] * basis }
+                                }
+                        }
+                        let o = 4 * (x + y * w);
+                        img.data[o]     = toSRGB(rgb[0]);
+                        img.data[o + 1] = toSRGB(rgb[1]);
+                        img.data[o + 2] = toSRGB(rgb[2]);
+                        img.data[o + 3] = 255;
+                }
+        }
+        ctx.putImageData(img, 0, 0);
+}
+// showBlurhashes paints the placeholders of images which haven't loaded yet,
+// and hides each one once its image has.
+function showBlurhashes() {
+        document.querySelectorAll(".item-blurhash:not(.painted)").forEach((canvas) => {
+                canvas.classList.add("painted");
+                let img = canvas.nextElementSibling;
+                if (img.complete) { canvas.classList.add("loaded"); return }
+                decodeBlurhash(canvas, canvas.dataset.blurhash);
+                img.addEventListener("load", () => canvas.classList.add("loaded"));
+        });
+}
+document.addEventListener("DOMContentLoaded", showBlurhashes);
 //let toggled = false;
 //{{ if .Credentials.IsLoggedIn }}
 //window.onscroll = function(e) {
@@ -0,0 +1,267 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// invite.go houses invite codes and the waitlist, which let an instance run
+// closed. The signup mode is set by signup.mode in bolt.conf.json:
+//   - open:        anyone may sign up (the default)
+//   - invite-only: an invite code is needed to sign up
+//   - waitlist:    anyone may sign up, but they can't sign in until an admin
+//     approves them, unless they had an invite code
+//   - closed:      no one may sign up
+//
+// Any user may create invite codes, with a limit on how many times each may
+// be used and when it expires. Invite links are /?invite=[code], and the
+// code is sent along with the signup. Each user remembers who invited them.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// maxInvites is how many invite codes a user may have at once.
+	maxInvites = 5
+	// maxInviteUses and maxInviteDays limit the invite codes made by
+	// users. Admins may make codes with up to maxAdminInviteUses uses,
+	// and which never expire.
+	maxInviteUses      = 5
+	maxInviteDays      = 30
+	maxAdminInviteUses = 1000
+)
+
+// signupModes are the signup modes, the first being the default.
+var signupModes = []string{"open", "invite-only", "waitlist", "closed"}
+
+// signupMode() returns the configured signup mode.
+func signupMode() string {
+	if !slices.Contains(signupModes, appConf.Signup.Mode) {
+		return signupModes[0]
+	}
+	return appConf.Signup.Mode
+}
+
+// admitSignup() decides whether a new user may sign up, given the signup mode
+// and the invite code they sent, if any, before their account is made. It
+// returns the invite to redeem once the email is claimed, or a status to
+// refuse the signup with. Users on the waitlist are marked so.
+func admitSignup(c *credentials) (*invite, string) {
+	mode := signupMode()
+	if mode == "closed" {
+		return nil, "Signup Is Closed"
+	}
+	if code := strings.TrimSpace(c.Invite); code != "" {
+		inv, err := getInvite(code)
+		if err != nil || !inv.usable() {
+			log.Println(err)
+			return nil, "Invalid Invite Code"
+		}
+		return inv, ""
+	}
+	switch mode {
+	case "invite-only":
+		return nil, "An Invite Code Is Required To Sign Up"
+	case "waitlist":
+		c.User.Waitlisted = true
+	}
+	return nil, ""
+}
+
+// usable() reports whether the invite has uses left and hasn't expired.
+func (inv *invite) usable() bool {
+	return inv.Uses < inv.MaxUses && (inv.Expires == 0 || inv.Expires > time.Now().Unix())
+}
+
+// inviteRequest{} is the request body sent by the client to create an invite
+// code. Days is how long it lasts, with zero meaning forever.
+type inviteRequest struct {
+	MaxUses int `json:"max_uses"`
+	Days    int `json:"days"`
+}
+
+// createInvite() is the route handler used to create an invite code.
+func createInvite(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	if !c.IsLoggedIn {
+		log.Println(status(w, "Not Logged In", nil))
+		return
+	}
+	ir := new(inviteRequest)
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(ir); err != nil {
+		log.Println(status(w, "Invalid Request", err))
+		return
+	}
+
+	uses, days := maxInviteUses, maxInviteDays
+	if hasRole(c, roleAdmin) {
+		uses, days = maxAdminInviteUses, 0
+	}
+	if ir.MaxUses < 1 || ir.MaxUses > uses {
+		log.Println(status(w, fmt.Sprintf("Uses Must Be 1-%d", uses), nil))
+		return
+	}
+	if ir.Days < 0 || (days > 0 && (ir.Days < 1 || ir.Days > days)) {
+		log.Println(status(w, fmt.Sprintf("Invites Must Last 1-%d Days", maxInviteDays), nil))
+		return
+	}
+
+	invites, err := getInvites(c)
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	if len(invites) >= maxInvites && !hasRole(c, roleAdmin) {
+		log.Println(status(w, "Too Many Invites, Revoke One First", nil))
+		return
+	}
+
+	now := time.Now()
+	inv := &invite{
+		Code:    genID(11),
+		Creator: c.User.ID,
+		MaxUses: ir.MaxUses,
+		Created: now.Unix(),
+	}
+	if ir.Days > 0 {
+		inv.Expires = now.AddDate(0, 0, ir.Days).Unix()
+	}
+	if err = setInvite(inv); err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	ajaxResponse(w, map[string]string{"status": "success", "code": inv.Code})
+}
+
+// invitesHandler() is the route handler used to list the users invite codes,
+// and the users they've invited.
+func invitesHandler(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	if !c.IsLoggedIn {
+		log.Println(status(w, "Not Logged In", nil))
+		return
+	}
+	invites, err := getInvites(c)
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	invited, err := getInvited(c)
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(struct {
+		Status  string    `json:"status"`
+		Mode    string    `json:"mode"`
+		Invites []*invite `json:"invites"`
+		Invited []string  `json:"invited"`
+	}{"success", signupMode(), invites, invited})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// revokeInvite() is the route handler for /revokeInvite/[code], used to
+// delete one of the users invite codes.
+func revokeInvite(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	if !c.IsLoggedIn {
+		log.Println(status(w, "Not Logged In", nil))
+		return
+	}
+	ok, err := deleteInvite(c, strings.Split(r.URL.Path, "/")[2])
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	if !ok {
+		log.Println(status(w, "No Such Invite", nil))
+		return
+	}
+	log.Println(status(w, "success", nil))
+}
+
+// approveSignup() is the route handler for /approveSignup/[id], used by
+// admins to let a user on the waitlist in. They're told by email.
+func approveSignup(w http.ResponseWriter, r *http.Request) {
+	id := strings.Split(r.URL.Path, "/")[2]
+	u := &credentials{User: &user{ID: id}}
+	ok, err := removeFromWaitlist(id)
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	if !ok {
+		log.Println(status(w, "Not On The Waitlist", nil))
+		return
+	}
+	if err = scanProfile(u); err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	err = mail.send(u.User.Email, "Welcome to "+AppName,
+		"You're off the waitlist, and can now sign in to "+AppName+" at https://"+
+			appConf.App.DomainName+"\n")
+	if err != nil {
+		log.Println(err)
+	}
+	log.Println(status(w, "success", nil))
+}
+
+// rejectSignup() is the route handler for /rejectSignup/[id], used by admins
+// to turn away a user on the waitlist. Their account is deleted, freeing the
+// email to sign up again later.
+func rejectSignup(w http.ResponseWriter, r *http.Request) {
+	u := &credentials{User: &user{ID: strings.Split(r.URL.Path, "/")[2]}}
+	ok, err := removeFromWaitlist(u.User.ID)
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	if !ok {
+		log.Println(status(w, "Not On The Waitlist", nil))
+		return
+	}
+	if err = scanProfile(u); err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	if _, err = deleteUser(u); err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	log.Println(status(w, "success", nil))
+}
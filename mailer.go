@@ -0,0 +1,100 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// mailer.go houses the mailer{} abstraction used to send email to users, such
+// as verification links. If a mail host is configured in bolt.conf.json mail
+// is sent over SMTP, otherwise it's written to the log, which is handy for
+// development.
+package main
+
+import (
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+// mailer is anything capable of sending a plain text email.
+type mailer interface {
+	send(to, subject, body string) error
+}
+
+// smtpMailer sends mail using the SMTP server configured in bolt.conf.json.
+// The password should be provided as an environment variable (smtppass) at
+// run time, the same way hmacss is.
+type smtpMailer struct {
+	host     string
+	port     string
+	from     string
+	username string
+	password string
+}
+
+// send() sends a plain text email over SMTP.
+func (m *smtpMailer) send(to, subject, body string) error {
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+	msg := "From: " + m.from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + body
+	return smtp.SendMail(net.JoinHostPort(m.host, m.port), auth, m.from,
+		[]string{to}, []byte(msg))
+}
+
+// logMailer "sends" mail by writing it to the log. It's used when no mail
+// host has been configured.
+type logMailer struct{}
+
+// send() writes the email to the log.
+func (logMailer) send(to, subject, body string) error {
+	log.Println("mail to:", to, "subject:", subject, "\n"+body)
+	return nil
+}
+
+// newMailer() returns the mailer{} described by the configuration.
+func newMailer(c *config) mailer {
+	if strings.TrimSpace(c.Mail.Host) == "" {
+		return logMailer{}
+	}
+	port := c.Mail.Port
+	if port == "" {
+		port = "587"
+	}
+	return &smtpMailer{
+		host:     c.Mail.Host,
+		port:     port,
+		from:     c.Mail.From,
+		username: c.Mail.Username,
+		password: os.Getenv("smtppass"),
+	}
+}
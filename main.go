@@ -132,11 +132,45 @@ var (
 		"marshalHTML": func(s string) template.HTML {
 			return template.HTML(s)
 		},
+		// mediaURL links to media, signing the link when URLs are
+		// signed. see: storage.go
+		"mediaURL": mediaURL,
+		// oidcProviders lists the identity providers users can sign
+		// in with. see: oidc.go
+		"oidcProviders": func() []oidcProvider {
+			return appConf.OIDC
+		},
+		// hasRole, roleName and roles are used to show or hide things
+		// based on the users role. see: roles.go
+		"hasRole": func(c *credentials, name string) bool {
+			role, ok := roleByName(name)
+			return ok && hasRole(c, role)
+		},
+		"roleName": roleName,
+		"roles": func() []string {
+			return roleNames
+		},
+		// modActions lists the actions moderators may take, and
+		// unixTime formats the timestamps of reports and actions. see:
+		// moderation.go
+		"modActions": func() []string {
+			return modActions
+		},
+		"unixTime": func(t int64) string {
+			return time.Unix(t, 0).Format(time.RFC822)
+		},
 	}
 
 	// initialize post stream.
 	stream []*post = []*post{}
 
+	// mail is used to send email to users, such as verification links.
+	// see: mailer.go
+	mail mailer = newMailer(appConf)
+
+	// blobs is where uploaded media is kept. see: storage.go
+	blobs blobStore = newBlobStore(appConf)
+
 	// Create the context for redis, and connect tot he redis database.
 	rdx context.Context = context.Background()
 	rdb *redis.Client   = redis.NewClient(&redis.Options{
@@ -166,6 +200,74 @@ type config struct {
 		LiveDir   string `json:"livedir" redis:"live_dir"`
 		ProxyConf string `json:"proxyConf" redis:"proxy_conf"`
 	} `json:"gcloud" redis:"g_cloud"`
+	// Mail configures the outgoing mail server. If Host is empty, mail is
+	// written to the log instead. see: mailer.go
+	Mail struct {
+		Host     string `json:"host" redis:"host"`
+		Port     string `json:"port" redis:"port"`
+		From     string `json:"from" redis:"from"`
+		Username string `json:"username" redis:"username"`
+	} `json:"mail" redis:"mail"`
+	// OIDC lists the external identity providers users can sign in with.
+	// see: oidc.go
+	OIDC []oidcProvider `json:"oidc" redis:"oidc"`
+	// Spam sets the scores at which the spam filter holds a post for
+	// review, or shadow hides it. see: spam.go
+	Spam struct {
+		Hold float64 `json:"hold" redis:"hold"`
+		Hide float64 `json:"hide" redis:"hide"`
+	} `json:"spam" redis:"spam"`
+	// PoW bounds the difficulty of the proof-of-work challenge, in bits,
+	// and sets whether posts from new accounts are challenged too.
+	// see: pow.go
+	PoW struct {
+		MinBits     int  `json:"min_bits" redis:"min_bits"`
+		MaxBits     int  `json:"max_bits" redis:"max_bits"`
+		NewAccounts bool `json:"new_accounts" redis:"new_accounts"`
+	} `json:"pow" redis:"pow"`
+	// Media sets where blobs are kept: "local", the default, or "s3" for
+	// an S3-compatible service, and whether the URLs they're fetched from
+	// are signed, and expire after URLExpiry seconds. see: storage.go
+	Media struct {
+		Backend    string `json:"backend" redis:"backend"`
+		SignedURLs bool   `json:"signed_urls" redis:"signed_urls"`
+		URLExpiry  int    `json:"url_expiry" redis:"url_expiry"`
+		S3         struct {
+			Endpoint  string `json:"endpoint" redis:"endpoint"`
+			Region    string `json:"region" redis:"region"`
+			Bucket    string `json:"bucket" redis:"bucket"`
+			AccessKey string `json:"access_key" redis:"access_key"`
+			PathStyle bool   `json:"path_style" redis:"path_style"`
+			PublicURL string `json:"public_url" redis:"public_url"`
+		} `json:"s3" redis:"s3"`
+	} `json:"media" redis:"media"`
+	// MediaBlocklist sets how many bits an uploaded image may differ
+	// from a blocked one by and still match, and whether matches are
+	// rejected, the default, or flagged for review with "flag".
+	// see: phash.go
+	MediaBlocklist struct {
+		Distance int    `json:"distance" redis:"distance"`
+		Action   string `json:"action" redis:"action"`
+	} `json:"media_blocklist" redis:"media_blocklist"`
+	// Quotas sets how much each role may store, by role name, overriding
+	// defaultQuotas. see: quota.go
+	Quotas map[string]storage `json:"quotas" redis:"quotas"`
+	// Signup sets who may sign up: "open", "invite-only", "waitlist", or
+	// "closed". see: invite.go
+	Signup struct {
+		Mode string `json:"mode" redis:"mode"`
+	} `json:"signup" redis:"signup"`
+}
+
+// resumable{} is an upload sent in chunks, which can be picked up where it
+// left off after the connection drops. Offset is how much of it has arrived.
+// see: resumable.go
+type resumable struct {
+	ID      string `json:"id" redis:"id"`
+	Owner   string `json:"-" redis:"owner"`
+	Size    int64  `json:"size" redis:"size"`
+	Offset  int64  `json:"offset" redis:"offset"`
+	Created int64  `json:"created" redis:"created"`
 }
 
 // viewData{} represents the root model used to dynamically update the page
@@ -183,9 +285,27 @@ type viewData struct {
 	// Credentials are used for logging a user in and contain a logged in
 	// users credentials.
 	Credentials *credentials `json:"credentials" redis:"credentials"`
+	// CSRF is the signed in users CSRF token, which the client sends back
+	// in the X-CSRF-Token header of requests that change state. see: csrf.go
+	CSRF string `json:"csrf" redis:"csrf"`
 	// Profile is used when viewing another users profile (or when a user
 	// views their own profile.)
 	Profile *user `json:"user" redis:"user"`
+	// Users is a list of users, such as on the admin page, and Waitlist
+	// is the users waiting for an admin to approve their signup.
+	Users    []*user `json:"users" redis:"users"`
+	Waitlist []*user `json:"waitlist" redis:"waitlist"`
+	// Blocking and Muting are set when the viewer has blocked or muted the
+	// user whose profile they're viewing. see: block_handler.go
+	Blocking bool `json:"blocking" redis:"blocking"`
+	Muting   bool `json:"muting" redis:"muting"`
+	// Reports and ModLog are the moderation queue and the most recent
+	// moderator actions, shown on the moderation page.
+	Reports []*report    `json:"reports" redis:"reports"`
+	ModLog  []*modAction `json:"mod_log" redis:"mod_log"`
+	// BlockedMedia is the media blocklist, also shown on the moderation
+	// page. see: phash.go
+	BlockedMedia []*blockedMedia `json:"blocked_media" redis:"blocked_media"`
 }
 
 // credentials are user credentials and are used in the HTML templates and also
@@ -201,6 +321,12 @@ type credentials struct {
 	// The logged in user, if any. Sometimes a "dummy" user with a user ID
 	// is placed here to look up user data.
 	User *user `json:"user" redis:"user"`
+	// Scopes are the scopes granted to the API token the request was
+	// authenticated with. It's nil when the "token" cookie was used
+	// instead, as a signed in user may do anything. see: token_handler.go
+	Scopes []string `json:"-" redis:"-"`
+	// Invite is the invite code sent with a signup, if any. see: invite.go
+	Invite string `json:"invite,omitempty" redis:"-"`
 	// Implements
 	jwt.StandardClaims
 }
@@ -217,31 +343,156 @@ func (p *credentials) MarshalBinary() ([]byte, error) {
 	return json.Marshal(p)
 }
 
+// apiToken{} is a personal access token, created by a user so their scripts
+// and bots can use the API with an "Authorization: Bearer" header. Only a
+// hash of the token its self is stored. Scopes is a space separated list,
+// and Expires is zero for tokens that never expire.
+type apiToken struct {
+	ID       string `json:"id" redis:"id"`
+	UserID   string `json:"-" redis:"user"`
+	Name     string `json:"name" redis:"name"`
+	Scopes   string `json:"scopes" redis:"scopes"`
+	Created  int64  `json:"created" redis:"created"`
+	Expires  int64  `json:"expires" redis:"expires"`
+	LastUsed int64  `json:"last_used" redis:"last_used"`
+}
+
+// invite{} is an invite code, which lets someone sign up when signup is
+// invite-only, or skip the waitlist. Expires is zero for codes which never
+// expire. see: invite.go
+type invite struct {
+	Code    string `json:"code" redis:"code"`
+	Creator string `json:"-" redis:"creator"`
+	Uses    int    `json:"uses" redis:"uses"`
+	MaxUses int    `json:"max_uses" redis:"max_uses"`
+	Created int64  `json:"created" redis:"created"`
+	Expires int64  `json:"expires" redis:"expires"`
+}
+
+// exportJob{} tracks a users data export, which is built in the background.
+// Status is one of "pending", "ready" or "failed", and File is the path of
+// the finished archive. see: account_handler.go
+type exportJob struct {
+	Status    string `json:"status" redis:"status"`
+	File      string `json:"-" redis:"file"`
+	Requested int64  `json:"requested" redis:"requested"`
+}
+
+// report{} is a report of an abusive post or user, made by another user.
+// Reports start "open", are "claimed" by a moderator while they look into
+// them, and are "resolved" with an action. Excerpt keeps a copy of what was
+// reported, in case it's changed or deleted. see: moderation.go
+type report struct {
+	ID         string `json:"id" redis:"id"`
+	Reporter   string `json:"reporter" redis:"reporter"`
+	TargetType string `json:"target_type" redis:"target_type"`
+	Target     string `json:"target" redis:"target"`
+	Reason     string `json:"reason" redis:"reason"`
+	Text       string `json:"text" redis:"text"`
+	Excerpt    string `json:"excerpt" redis:"excerpt"`
+	Created    int64  `json:"created" redis:"created"`
+	Status     string `json:"status" redis:"status"`
+	Moderator  string `json:"moderator" redis:"moderator"`
+	Claimed    int64  `json:"claimed" redis:"claimed"`
+	Resolved   int64  `json:"resolved" redis:"resolved"`
+	Action     string `json:"action" redis:"action"`
+	Note       string `json:"note" redis:"note"`
+}
+
+// modAction{} is an entry in the moderation audit trail, recording who did
+// what to which post or user, and why.
+type modAction struct {
+	Time       int64  `json:"time"`
+	Moderator  string `json:"moderator"`
+	Action     string `json:"action"`
+	TargetType string `json:"target_type"`
+	Target     string `json:"target"`
+	Report     string `json:"report,omitempty"`
+	Note       string `json:"note,omitempty"`
+}
+
+// blockedMedia{} is an image on the media blocklist, by its perceptual hash,
+// recording who blocked it, from which post, and why. see: phash.go
+type blockedMedia struct {
+	Hash      string `json:"hash"`
+	Moderator string `json:"moderator"`
+	Post      string `json:"post"`
+	Reason    string `json:"reason"`
+	Note      string `json:"note,omitempty"`
+	Added     int64  `json:"added"`
+}
+
 // post{} represents a user post or reply to another users post.
 type post struct {
-	Type         string    `json:"Type" redis:"Type"`
-	ID           string    `json:"id" redis:"id"`
-	Parent       string    `json:"parent" redis:"parent"`
-	TS           time.Time `json:"ts" redis:"ts"`
-	TimeString   string    `json:"time_string" redis:"time_string"`
-	Author       string    `json:"author" redis:"author"`
-	Text         string    `json:"uptext" redis:"uptext"`
-	MediaType    string    `json:"media_type" redis:"media_type"`
-	Media        string    `json:"Media" redis:"Media"`
-	TempFileName string    `json:"temp_file_name" redis:"temp_file_name"`
-	Score        int       `json:"score" redis:"score"`
-	Categories   rstring   `json:"categories" redis:"categories"`
-	CommentIDs   rstring   `json:"commentIDs" redis:"commentIDs"`
-	Comments     replies   `json:"comments" redis:"comments"`
-	Political    rstring   `json:"political" redis:"political"`
-	Finance      rstring   `json:"finance" redis:"finance"`
-	Art          rstring   `json:"art" redis:"art"`
-	Life         rstring   `json:"life" redis:"life"`
-	Mentions     rstring   `json:"mentions" redis:"mentions"`
+	Type       string    `json:"Type" redis:"Type"`
+	ID         string    `json:"id" redis:"id"`
+	Parent     string    `json:"parent" redis:"parent"`
+	TS         time.Time `json:"ts" redis:"ts"`
+	TimeString string    `json:"time_string" redis:"time_string"`
+	Author     string    `json:"author" redis:"author"`
+	Text       string    `json:"uptext" redis:"uptext"`
+	Score      int       `json:"score" redis:"score"`
+	Categories rstring   `json:"categories" redis:"categories"`
+	CommentIDs rstring   `json:"commentIDs" redis:"commentIDs"`
+	Comments   replies   `json:"comments" redis:"comments"`
+	Political  rstring   `json:"political" redis:"political"`
+	Finance    rstring   `json:"finance" redis:"finance"`
+	Art        rstring   `json:"art" redis:"art"`
+	Life       rstring   `json:"life" redis:"life"`
+	Mentions   rstring   `json:"mentions" redis:"mentions"`
+	// Attachments are the files attached to the post, in the order they
+	// were uploaded. see: attachment.go
+	Attachments attachments `json:"attachments" redis:"attachments"`
+	// Hidden is set when a moderator hides the post. Hidden posts are left
+	// out of every stream. see: moderation.go
+	Hidden bool `json:"hidden" redis:"hidden"`
+	// Shadow is set when the spam filter shadow hides the post. It's shown
+	// to its author, and no one else. see: spam.go
+	Shadow bool `json:"shadow" redis:"shadow"`
 	// Tags         []*tag    `json:"tags" redis:"tags"`
 	encoding.BinaryMarshaler
 }
 
+// attachment{} is a file attached to a post. Blob is its path in the blob
+// store, Kind is "img", "vid" or "audio", and Duration is in seconds. Sizes
+// are the sizes the image pipeline made of images, smallest first, and
+// Blurhash is a tiny placeholder shown while an image loads, and PHash is the
+// perceptual hash images are matched against the blocklist by. Size is the
+// bytes stored for it, of every size, which count towards the uploaders quota.
+// Dimensions and durations are left out of files we can't read them from.
+type attachment struct {
+	Blob     string         `json:"blob"`
+	Kind     string         `json:"kind"`
+	MIME     string         `json:"mime"`
+	Width    int            `json:"width,omitempty"`
+	Height   int            `json:"height,omitempty"`
+	Duration float64        `json:"duration,omitempty"`
+	Alt      string         `json:"alt,omitempty"`
+	Blurhash string         `json:"blurhash,omitempty"`
+	Sizes    []imageVariant `json:"sizes,omitempty"`
+	Size     int64          `json:"size,omitempty"`
+	PHash    string         `json:"phash,omitempty"`
+}
+
+// attachments are kept as JSON in the post data.
+type attachments []*attachment
+
+// attachments.MarshalBinary() is used to implement encoding.BinaryMarshaler,
+// as required for compatibility with redis.
+func (a attachments) MarshalBinary() ([]byte, error) {
+	return json.Marshal(a)
+}
+
+// *attachments.ScanRedis() is used by redis to scan the JSON back in. Posts
+// without attachments may have an empty string.
+func (a *attachments) ScanRedis(s string) error {
+	if s == "" {
+		*a = nil
+		return nil
+	}
+	return json.Unmarshal([]byte(s), a)
+}
+
 type replies []*post
 
 func (u replies) UnmarshalBinary(data []byte) error {
@@ -292,11 +543,33 @@ type user struct {
 	Likes       []string  `json:"likes" redis:"likes"`
 	Shares      []string  `json:"shares" redis:"shares"`
 	Friends     []string  `json:"friends" redis:"friends"`
+	// Unverified is set at signup and cleared once the user follows the
+	// link sent to their email. Unverified users can't post or reply.
+	Unverified bool `json:"unverified" redis:"unverified"`
+	// TwoFactor is set when the user has enabled TOTP two-factor
+	// authentication. see: totp.go
+	TwoFactor bool `json:"two_factor" redis:"two_factor"`
+	// Level is the users role, such as moderator or admin, which decides
+	// what they're allowed to do. see: roles.go
+	Level int `json:"level" redis:"level"`
+	// SuspendedUntil is when a suspension by a moderator ends, as a unix
+	// timestamp. Suspended users can sign in, but can't post or interact.
+	// Banned users can't sign in at all. see: moderation.go
+	SuspendedUntil int64 `json:"suspended_until" redis:"suspended_until"`
+	Banned         bool  `json:"banned" redis:"banned"`
+	// Warnings counts the warnings the user has been given by moderators.
+	Warnings int `json:"warnings" redis:"warnings"`
+	// InvitedBy is the ID of the user whose invite code the user signed up
+	// with, and Waitlisted is set while they wait for an admin to approve
+	// their signup. see: invite.go
+	InvitedBy  string `json:"invited_by" redis:"invited_by"`
+	Waitlisted bool   `json:"waitlisted" redis:"waitlisted"`
+	// Throttle adjusts the users rate limits, as a percentage of the
+	// budgets for their role. 0 leaves them as they are. see: ratelimit.go
+	Throttle int `json:"throttle" redis:"throttle"`
 
 	// TODO /* Not implemented */
 	Events   []string `json:"events" redis:"events"`
-	Level    int      `json:"level" redis:"level"`
-	Throttle int      `json:"throttle" redis:"throttle"`
 	Insights string   `json:"insights" redis:"insights"`
 	Random   string   `json:"random" redis:"random"`
 	Other    string   `json:"other" redis:"other"`
@@ -354,7 +627,40 @@ func init() {
 // function, used for caching the database every two seconds (will be
 // reconfigured for production).
 func main() {
+	// bootstrap the first admin from the command line, e.g.:
+	// ./tagmachine grant-admin someone@example.com
+	if len(os.Args) == 3 && os.Args[1] == "grant-admin" {
+		if err := grantAdmin(os.Args[2]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(os.Args[2], "is now an admin")
+		return
+	}
+
 	setupLogging()
+
+	// move any accounts still using the original credential layout.
+	// see: migrateCredentials()
+	if err := migrateCredentials(); err != nil {
+		log.Println(err)
+	}
+	// move files uploaded before the blob store into it.
+	// see: migrateBlobs()
+	if err := migrateBlobs(); err != nil {
+		log.Println(err)
+	}
+	// move posts from a single file to a list of attachments.
+	// see: migrateAttachments()
+	if err := migrateAttachments(); err != nil {
+		log.Println(err)
+	}
+	// charge users for what they uploaded before storage quotas.
+	// see: migrateUsage()
+	if err := migrateUsage(); err != nil {
+		log.Println(err)
+	}
+
 	go func() {
 		for {
 			cache()
@@ -362,6 +668,30 @@ func main() {
 		}
 	}()
 
+	// remove data exports once they've expired. see: cleanExports()
+	go func() {
+		for {
+			cleanExports()
+			time.Sleep(time.Hour)
+		}
+	}()
+
+	// remove resumable uploads which were abandoned. see: cleanUploads()
+	go func() {
+		for {
+			cleanUploads()
+			time.Sleep(time.Hour)
+		}
+	}()
+
+	// remove media blobs nothing uses any more. see: collectBlobs()
+	go func() {
+		for {
+			collectBlobs()
+			time.Sleep(blobGrace)
+		}
+	}()
+
 	// start the server.
 	ctx, srv := bolt()
 
@@ -33,9 +33,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 )
@@ -58,17 +60,20 @@ func what(w http.ResponseWriter, r *http.Request) {
 // viewItem() is the route handler used for viewing a link to an individual
 // post. It serves "main.html", passing the single post as the "stream" value
 // in viewData{}, (allowing us to reuse "main.html", instead of creating
-// another page view).
+// another page view). Moderators can see posts, and replies, hidden by a
+// moderator, so they can review them.
 func viewItem(w http.ResponseWriter, r *http.Request) {
 	// get the ID from after the "view/", the route looks like this:
 	// https://tagmachine.xyz/view/LGnIKd2DXECZPsBQ
 	id := strings.Split(r.RequestURI, "/")[2]
+	c, _ := r.Context().Value(ctxkey).(*credentials)
 
 	// Execute the template with the single post added as the
-	// viewData.Stream{} property.
+	// viewData.Stream{} property. The stream everyone else sees is left
+	// as it is, see: postsByID()
 	exeTmpl(w, r, &viewData{
 		AppName: appConf.App.Name,
-		Stream:  getPostsByID([]string{id}),
+		Stream:  postsByID([]string{id}, hasRole(c, roleModerator)),
 	}, "main.html")
 }
 
@@ -86,6 +91,26 @@ func profileHandler(w http.ResponseWriter, r *http.Request) {
 		User: &user{ID: id},
 	}
 
+	// Users who blocked the viewer are hidden from them, as if they
+	// didn't exist. see: block_handler.go
+	viewer := r.Context().Value(ctxkey).(*credentials)
+	var blocked, muted []string
+	if viewer.IsLoggedIn {
+		hidden, err := hasBlocked(id, viewer.User.ID)
+		if err != nil {
+			log.Println(status(w, "Database error", err))
+			return
+		}
+		if hidden {
+			log.Println(status(w, "Couldn't find user", nil))
+			return
+		}
+		if blocked, muted, err = getBlocks(viewer); err != nil {
+			log.Println(status(w, "Database error", err))
+			return
+		}
+	}
+
 	// Get the profile data for the user by passing the dummy credentials
 	// to scanProfile().
 	err := scanProfile(_c) // see: scanProfile()
@@ -117,8 +142,10 @@ func profileHandler(w http.ResponseWriter, r *http.Request) {
 	// liked posts associated with the profile being viewed as well.
 	exeTmpl(w, r, &viewData{
 		Profile:     _c.User,
-		Credentials: r.Context().Value(ctxkey).(*credentials),
+		Credentials: viewer,
 		Stream:      likes,
+		Blocking:    slices.Contains(blocked, id),
+		Muting:      slices.Contains(muted, id),
 	}, "profile.html")
 }
 
@@ -142,6 +169,25 @@ func reply(w http.ResponseWriter, r *http.Request) {
 	p.TS = time.Now()
 	p.TimeString = time.Now().Format(time.RFC822)
 	p.Author = c_.User.ID
+	// Replies are text only. Attachments only come from uploads, which
+	// store the files they name. see: uploadHandler()
+	p.Attachments = nil
+
+	// Users can't reply to someone they've blocked, or who has blocked
+	// them, or mention them. see: block_handler.go
+	parent, err := getPost(p.Parent)
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	if ok, err := canInteract(c_.User.ID, parent.Author); err != nil || !ok {
+		log.Println(status(w, "You Can't Reply To This User", err))
+		return
+	}
+	p.Mentions = dropBlockedMentions(c_, p.Mentions)
+
+	// Run the reply through the spam filter. see: spam.go
+	verdict := screenPost(c_, p)
 
 	// Add the posts ID to a sorted set and store the post data as an
 	// object in redis:
@@ -151,8 +197,11 @@ func reply(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	reportSpam(p, verdict)
+
 	// success
-	ajaxResponse(w, map[string]string{"status": "success", "ID": p.ID})
+	ajaxResponse(w, map[string]string{"status": "success", "ID": p.ID,
+		"notice": heldNotice(p)})
 }
 
 // likeHandler() is the route handler for /like/ID, by appending the liked
@@ -200,6 +249,10 @@ func addFriendHandler(w http.ResponseWriter, r *http.Request) {
 
 	// TODO:
 	n, err := setFriend(c, id) // see: setFriend()
+	if errors.Is(err, errBlocked) {
+		log.Println(status(w, "Blocked", nil))
+		return
+	}
 	if err != nil {
 		log.Println(status(w, "Database Error", err))
 		return
@@ -0,0 +1,157 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// media.go houses the registry of media types users may upload. Uploads are
+// recognized by their magic bytes, the signature at the start of each kind
+// of file, rather than by their name or the type the client claims, and
+// anything not in the registry is refused.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"strings"
+)
+
+// mediaType{} is a kind of file users may upload. Kind decides how it's
+// shown: "img", "vid" or "audio". see: the gallery in stream.html
+type mediaType struct {
+	MIME  string
+	Ext   string
+	Kind  string
+	Match func(head []byte) bool
+}
+
+// mediaTypes are the media types users may upload. They're matched in order,
+// so more specific signatures come first.
+var mediaTypes = []*mediaType{
+	{"image/png", "png", "img", hasPrefix("\x89PNG\r\n\x1a\n")},
+	{"image/jpeg", "jpg", "img", hasPrefix("\xff\xd8\xff")},
+	{"image/gif", "gif", "img", hasPrefix("GIF87a", "GIF89a")},
+	{"image/webp", "webp", "img", isRIFF("WEBP")},
+	{"image/avif", "avif", "img", hasBrand("avif", "avis")},
+	// HEIC is passed through, less its metadata. Not every browser can show
+	// it. see: heif.go
+	{"image/heic", "heic", "img", hasBrand("heic", "heix", "heim", "heis", "hevc", "hevx")},
+	{"video/mp4", "mp4", "vid", hasBrand("isom", "iso2", "iso4", "iso5", "iso6",
+		"mp41", "mp42", "avc1", "M4V ", "dash", "mmp4")},
+	{"video/webm", "webm", "vid", isWebM},
+	{"audio/mpeg", "mp3", "audio", isMP3},
+	{"audio/ogg", "ogg", "audio", hasPrefix("OggS")},
+}
+
+// errUnsupportedMedia is returned for uploads which aren't one of the
+// mediaTypes.
+var errUnsupportedMedia = errors.New("unsupported media type")
+
+// sniffMedia() returns the media type of a file from its first bytes, of
+// which 512 is plenty.
+func sniffMedia(head []byte) (*mediaType, error) {
+	for _, mt := range mediaTypes {
+		if mt.Match(head) {
+			return mt, nil
+		}
+	}
+	return nil, errUnsupportedMedia
+}
+
+// mediaTypeByExt() returns the media type with the extension ext, or nil
+// if there isn't one.
+func mediaTypeByExt(ext string) *mediaType {
+	for _, mt := range mediaTypes {
+		if mt.Ext == ext {
+			return mt
+		}
+	}
+	return nil
+}
+
+// mediaExts() lists the extensions of the mediaTypes, to tell users what
+// they may upload.
+func mediaExts() string {
+	exts := make([]string, len(mediaTypes))
+	for i, mt := range mediaTypes {
+		exts[i] = strings.ToUpper(mt.Ext)
+	}
+	return strings.Join(exts, ", ")
+}
+
+// hasPrefix() matches files starting with any of the signatures.
+func hasPrefix(sigs ...string) func([]byte) bool {
+	return func(head []byte) bool {
+		return slices.ContainsFunc(sigs, func(sig string) bool {
+			return bytes.HasPrefix(head, []byte(sig))
+		})
+	}
+}
+
+// isRIFF() matches RIFF containers of the given form, such as WEBP.
+func isRIFF(form string) func([]byte) bool {
+	return func(head []byte) bool {
+		return len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == form
+	}
+}
+
+// hasBrand() matches ISO base media files, such as MP4, AVIF and HEIC, whose
+// ftyp box lists any of the brands, either as the major brand or as one it's
+// compatible with.
+func hasBrand(brands ...string) func([]byte) bool {
+	return func(head []byte) bool {
+		if len(head) < 16 || string(head[4:8]) != "ftyp" {
+			return false
+		}
+		size := min(int(binary.BigEndian.Uint32(head[:4])), len(head))
+		if slices.Contains(brands, string(head[8:12])) {
+			return true
+		}
+		for i := 16; i+4 <= size; i += 4 {
+			if slices.Contains(brands, string(head[i:i+4])) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// isWebM() matches Matroska files with the "webm" document type.
+func isWebM(head []byte) bool {
+	return bytes.HasPrefix(head, []byte("\x1a\x45\xdf\xa3")) &&
+		bytes.Contains(head[:min(len(head), 64)], []byte("webm"))
+}
+
+// isMP3() matches MP3 files, which either start with an ID3 tag, or straight
+// away with the sync word of an MPEG audio layer III frame.
+func isMP3(head []byte) bool {
+	if bytes.HasPrefix(head, []byte("ID3")) {
+		return true
+	}
+	return len(head) >= 3 && head[0] == 0xff && head[1]&0xe0 == 0xe0 &&
+		head[1]&0x18 != 0x08 && head[1]&0x06 == 0x02 && head[2]&0xf0 != 0xf0
+}
@@ -0,0 +1,113 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// ftyp() returns the start of an ISO base media file with the major brand,
+// and the compatible brands.
+func ftyp(major string, compat ...string) []byte {
+	b := []byte{0, 0, 0, byte(16 + 4*len(compat))}
+	b = append(append(b, "ftyp"...), major...)
+	b = append(b, 0, 0, 0, 0)
+	for _, c := range compat {
+		b = append(b, c...)
+	}
+	return append(b, "\x00\x00\x00\x08mdat"...)
+}
+
+func TestSniffMedia(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		head []byte
+		want string
+	}{
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), "image/png"},
+		{"jpeg", []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00"), "image/jpeg"},
+		{"gif87a", []byte("GIF87a\x01\x00\x01\x00"), "image/gif"},
+		{"gif89a", []byte("GIF89a\x01\x00\x01\x00"), "image/gif"},
+		{"webp", []byte("RIFF\x24\x00\x00\x00WEBPVP8 "), "image/webp"},
+		{"avif", ftyp("avif", "mif1", "miaf"), "image/avif"},
+		{"avif sequence", ftyp("avis", "msf1"), "image/avif"},
+		{"heic", ftyp("heic", "mif1", "heic"), "image/heic"},
+		{"heic compatible brand", ftyp("mif1", "heic"), "image/heic"},
+		{"mp4", ftyp("isom", "isom", "avc1"), "video/mp4"},
+		{"m4v", ftyp("M4V ", "M4V ", "mp42"), "video/mp4"},
+		{"webm", []byte("\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x84webm"), "video/webm"},
+		{"mp3 id3", []byte("ID3\x04\x00\x00\x00\x00\x00\x00"), "audio/mpeg"},
+		{"mp3 frame", []byte{0xff, 0xfb, 0x90, 0x64, 0x00}, "audio/mpeg"},
+		{"ogg", []byte("OggS\x00\x02\x00\x00"), "audio/ogg"},
+	} {
+		mt, err := sniffMedia(tc.head)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if mt.MIME != tc.want {
+			t.Errorf("%s: sniffed as %s, want %s", tc.name, mt.MIME, tc.want)
+		}
+	}
+}
+
+func TestSniffMediaRefuses(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		head []byte
+	}{
+		{"empty", nil},
+		{"pdf", []byte("%PDF-1.7\n%\xe2\xe3\xcf\xd3")},
+		{"html", []byte("<!DOCTYPE html><html>")},
+		{"svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg">`)},
+		{"zip", []byte("PK\x03\x04\x14\x00")},
+		{"wav", []byte("RIFF\x24\x00\x00\x00WAVEfmt ")},
+		{"quicktime", ftyp("qt  ", "qt  ")},
+		{"matroska", []byte("\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x88matroska")},
+		{"truncated png", []byte("\x89PNG")},
+		{"truncated ftyp", []byte("\x00\x00\x00\x18ftypheic")},
+		{"mpeg layer ii", []byte{0xff, 0xfd, 0x90, 0x64, 0x00}},
+	} {
+		if mt, err := sniffMedia(tc.head); !errors.Is(err, errUnsupportedMedia) {
+			t.Errorf("%s: sniffed as %v, want errUnsupportedMedia", tc.name, mt)
+		}
+	}
+}
+
+func TestMediaTypeByExt(t *testing.T) {
+	for _, mt := range mediaTypes {
+		if got := mediaTypeByExt(mt.Ext); got != mt {
+			t.Errorf("mediaTypeByExt(%q) = %v", mt.Ext, got)
+		}
+	}
+	if mt := mediaTypeByExt("exe"); mt != nil {
+		t.Errorf("mediaTypeByExt(\"exe\") = %v, want nil", mt)
+	}
+}
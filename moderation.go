@@ -0,0 +1,496 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// moderation.go houses user reports and the moderation queue. Users report
+// abusive posts or users, and moderators claim reports from the queue, look
+// into them, and resolve them with one of the moderation actions:
+//   - dismiss:    take no action
+//   - hide:       hide a post from every stream
+//   - unhide:     show a hidden post again
+//   - delete:     delete a post
+//   - blockmedia: delete a post, and block its images from being posted
+//   - warn:       email a user a warning
+//   - suspend:    stop a user from posting or interacting for some days
+//   - ban:        stop a user from signing in
+//
+// Warnings, suspensions and bans given for a post apply to its author. The
+// spam filter also reports the posts it holds or shadow hides, and
+// dismissing those reports shows the post again. see: spam.go
+// The media blocklist, which blockmedia adds to, reports the posts it holds
+// for review in the same way. see: phash.go
+// Moderators can also act directly, without a report. Every action is
+// recorded in the audit trail, which is shown on the moderation page.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// maxReportsPerHour is how many reports a user may make per hour.
+	maxReportsPerHour = 20
+	// maxSuspendDays is the longest a user may be suspended for. Longer
+	// than that, and they should be banned.
+	maxSuspendDays = 365
+)
+
+// reportReasons are the reasons a user may give for a report, along with
+// their own words.
+var reportReasons = []string{"spam", "harassment", "hate", "violence", "illegal", "other"}
+
+// modActions are the actions a moderator may take. see: applyModAction()
+var modActions = []string{"dismiss", "hide", "unhide", "delete", "blockmedia", "warn", "suspend", "ban"}
+
+// suspended() reports whether the user is currently suspended.
+func suspended(u *user) bool {
+	return u.SuspendedUntil > time.Now().Unix()
+}
+
+// requireActive is used as a middleware function, inside of checkAuth(), for
+// routes suspended users may not use, such as posting or liking.
+func requireActive(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := r.Context().Value(ctxkey).(*credentials)
+		if ok && c.IsLoggedIn && suspended(c.User) {
+			w.WriteHeader(http.StatusForbidden)
+			until := time.Unix(c.User.SuspendedUntil, 0).Format(time.RFC822)
+			log.Println(status(w, "Account Suspended Until "+until, nil))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reportRequest{} is the request body sent by the client when reporting a
+// post or user. TargetType is either "post" or "user".
+type reportRequest struct {
+	TargetType string `json:"target_type"`
+	Target     string `json:"target"`
+	Reason     string `json:"reason"`
+	Text       string `json:"text"`
+}
+
+// reportHandler() is the route handler used to report a post or user to the
+// moderators.
+func reportHandler(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	if !c.IsLoggedIn {
+		log.Println(status(w, "Not Logged In", nil))
+		return
+	}
+	rr := new(reportRequest)
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(rr); err != nil {
+		log.Println(status(w, "Invalid Request", err))
+		return
+	}
+	if !slices.Contains(reportReasons, rr.Reason) {
+		log.Println(status(w, "Choose A Reason", nil))
+		return
+	}
+	if rr.Text = strings.TrimSpace(rr.Text); len(rr.Text) > 1000 {
+		log.Println(status(w, "Report Too Long", nil))
+		return
+	}
+
+	rp := &report{
+		ID:         genID(15),
+		Reporter:   c.User.ID,
+		TargetType: rr.TargetType,
+		Target:     rr.Target,
+		Reason:     rr.Reason,
+		Text:       rr.Text,
+		Created:    time.Now().Unix(),
+		Status:     "open",
+	}
+	owner := ""
+	switch rr.TargetType {
+	case "post":
+		p, err := getPost(rr.Target)
+		if err != nil || p.ID == "" {
+			log.Println(status(w, "No Such Post", err))
+			return
+		}
+		owner = p.Author
+		rp.Excerpt = excerpt(p.Text+" "+strings.Join(p.blobPaths(), " "), 280)
+	case "user":
+		u := &credentials{User: &user{ID: rr.Target}}
+		if ok, err := userExists(rr.Target); err != nil || !ok {
+			log.Println(status(w, "No Such User", err))
+			return
+		}
+		if err := scanProfile(u); err != nil {
+			log.Println(status(w, "Database Error", err))
+			return
+		}
+		owner = u.User.ID
+		rp.Excerpt = excerpt(u.User.About, 280)
+	default:
+		log.Println(status(w, "Invalid Request", nil))
+		return
+	}
+	if owner == c.User.ID {
+		log.Println(status(w, "You Can't Report Yourself", nil))
+		return
+	}
+
+	n, err := incrReportsMade(c)
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	if n > maxReportsPerHour {
+		log.Println(status(w, "Too Many Reports, Try Again Later", nil))
+		return
+	}
+	if err = addReport(rp); err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	log.Println(status(w, "success", nil))
+}
+
+// excerpt() shortens s to at most n bytes, without cutting a character in
+// half.
+func excerpt(s string, n int) string {
+	s = strings.TrimSpace(s)
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && (s[n]&0xC0) == 0x80 {
+		n--
+	}
+	return s[:n] + "…"
+}
+
+// moderationHandler() is the route handler for the moderation page, which
+// shows the queue of reports and the audit trail.
+func moderationHandler(w http.ResponseWriter, r *http.Request) {
+	reports, err := getReports(REPORTQUEUE, 0, 99)
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	actions, err := getModLog(100)
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	blocked, err := getBlockedMedia()
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	exeTmpl(w, r, &viewData{Reports: reports, ModLog: actions, BlockedMedia: blocked}, "moderation.html")
+}
+
+// claimReportHandler() is the route handler for /claimReport/[id], used by a
+// moderator to claim a report, so others know they're looking into it.
+func claimReportHandler(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	rp, err := getReport(strings.Split(r.URL.Path, "/")[2])
+	if err != nil {
+		log.Println(status(w, "No Such Report", err))
+		return
+	}
+	if rp.Status == "resolved" {
+		log.Println(status(w, "Report Already Resolved", nil))
+		return
+	}
+	ok, err := claimReport(rp.ID, c.User.ID)
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	if !ok {
+		log.Println(status(w, "Claimed By Another Moderator", nil))
+		return
+	}
+	log.Println(status(w, "success", nil))
+}
+
+// releaseReportHandler() is the route handler for /releaseReport/[id], used
+// by a moderator to return a report they claimed to the queue. Admins may
+// release any report.
+func releaseReportHandler(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	rp, err := getReport(strings.Split(r.URL.Path, "/")[2])
+	if err != nil {
+		log.Println(status(w, "No Such Report", err))
+		return
+	}
+	if rp.Status != "claimed" {
+		log.Println(status(w, "Report Not Claimed", nil))
+		return
+	}
+	if rp.Moderator != c.User.ID && !hasRole(c, roleAdmin) {
+		log.Println(status(w, "Claimed By Another Moderator", nil))
+		return
+	}
+	if err = releaseReport(rp.ID); err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	log.Println(status(w, "success", nil))
+}
+
+// modRequest{} is the request body sent by a moderator to take an action.
+// TargetType and Target are only used when acting without a report. Days is
+// how long a suspension lasts, and Reason why media is blocked, which is
+// taken from the report when there is one.
+type modRequest struct {
+	TargetType string `json:"target_type"`
+	Target     string `json:"target"`
+	Action     string `json:"action"`
+	Note       string `json:"note"`
+	Days       int    `json:"days"`
+	Reason     string `json:"reason"`
+}
+
+// marshalModRequest() decodes a modRequest{} from the request body.
+func marshalModRequest(r *http.Request) (*modRequest, error) {
+	mr := new(modRequest)
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(mr); err != nil {
+		return nil, err
+	}
+	mr.Note = excerpt(mr.Note, 1000)
+	return mr, nil
+}
+
+// resolveReportHandler() is the route handler for /resolveReport/[id], used
+// by a moderator to resolve a report they claimed, by taking an action.
+func resolveReportHandler(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	rp, err := getReport(strings.Split(r.URL.Path, "/")[2])
+	if err != nil {
+		log.Println(status(w, "No Such Report", err))
+		return
+	}
+	if rp.Status != "claimed" || rp.Moderator != c.User.ID {
+		log.Println(status(w, "Claim The Report First", nil))
+		return
+	}
+	mr, err := marshalModRequest(r)
+	if err != nil {
+		log.Println(status(w, "Invalid Request", err))
+		return
+	}
+	mr.TargetType, mr.Target, mr.Reason = rp.TargetType, rp.Target, rp.Reason
+
+	// Decisions on posts reported as spam train the spam filter, so the
+	// post is looked up before it might be deleted. see: spam.go
+	var spam post
+	if rp.Reason == "spam" && rp.TargetType == "post" {
+		if spam, err = getPost(rp.Target); err != nil {
+			log.Println(err)
+		}
+	}
+	if err = applyModAction(c, mr, rp.ID); err != nil {
+		log.Println(status(w, err.Error(), nil))
+		return
+	}
+	if spam.ID != "" {
+		trainSpamDecision(&spam, mr.Action)
+	}
+	// Dismissing a report by the spam filter, or the media blocklist,
+	// releases the post it held.
+	if (rp.Reporter == spamFilter || rp.Reporter == mediaBlocklist) && mr.Action == "dismiss" {
+		if err = setPostHidden(rp.Target, false); err != nil {
+			log.Println(status(w, "Database Error", err))
+			return
+		}
+	}
+
+	rp.Action, rp.Note, rp.Resolved = mr.Action, mr.Note, time.Now().Unix()
+	if err = resolveReport(rp); err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	log.Println(status(w, "success", nil))
+}
+
+// moderateHandler() is the route handler used by a moderator to act on a post
+// or user directly, without a report.
+func moderateHandler(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	mr, err := marshalModRequest(r)
+	if err != nil {
+		log.Println(status(w, "Invalid Request", err))
+		return
+	}
+	if mr.Action == "dismiss" {
+		log.Println(status(w, "Unknown Action", nil))
+		return
+	}
+	if err = applyModAction(c, mr, ""); err != nil {
+		log.Println(status(w, err.Error(), nil))
+		return
+	}
+	log.Println(status(w, "success", nil))
+}
+
+// applyModAction() takes a moderation action on a post or user, and records
+// it in the audit trail along with the report it resolves, if any. Moderators
+// can't act on users with a role as high as their own, or on those users
+// posts. The errors returned are suitable to show the moderator.
+func applyModAction(mod *credentials, mr *modRequest, reportID string) error {
+	if !slices.Contains(modActions, mr.Action) {
+		return errors.New("Unknown Action")
+	}
+
+	// find who the action applies to.
+	var p post
+	target := &credentials{User: &user{}}
+	switch mr.TargetType {
+	case "post":
+		var err error
+		if p, err = getPost(mr.Target); err != nil || p.ID == "" {
+			return errors.New("No Such Post")
+		}
+		target.User.ID = p.Author
+	case "user":
+		if slices.Contains([]string{"hide", "unhide", "delete", "blockmedia"}, mr.Action) {
+			return errors.New("That Action Is For Posts")
+		}
+		target.User.ID = mr.Target
+	default:
+		return errors.New("Invalid Request")
+	}
+	if target.User.ID != deletedAuthor {
+		if ok, err := userExists(target.User.ID); err != nil || !ok {
+			return errors.New("No Such User")
+		}
+		if err := scanProfile(target); err != nil {
+			log.Println(err)
+			return errors.New("Database Error")
+		}
+		if target.User.Level >= mod.User.Level {
+			return errors.New("You Can't Moderate That User")
+		}
+	}
+
+	var err error
+	switch mr.Action {
+	case "hide", "unhide":
+		err = setPostHidden(p.ID, mr.Action == "hide")
+	case "delete", "blockmedia":
+		if mr.Action == "blockmedia" {
+			if !slices.Contains(reportReasons, mr.Reason) {
+				mr.Reason = "other"
+			}
+			if err = blockPostMedia(mod, &p, mr.Reason, mr.Note); errors.Is(err, errNoImages) {
+				return errors.New("That Post Has No Images To Block")
+			}
+			if err != nil {
+				log.Println(err)
+				return errors.New("Database Error")
+			}
+		}
+		var removed bool
+		if removed, err = removePost(&p, p.Author); err == nil && removed {
+			err = forgetLikes(p.ID)
+		}
+		if err == nil {
+			releaseAttachments(p.Attachments)
+			err = refundUsage(p.Author, p.storage())
+		}
+	case "warn":
+		if _, err = incrWarnings(target.User.ID); err == nil {
+			err := mail.send(target.User.Email, "A warning from the "+AppName+" moderators",
+				"A moderator has warned you about your activity on "+AppName+
+					". Please review the rules.\n\n"+mr.Note+"\n")
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	case "suspend":
+		if mr.Days < 1 || mr.Days > maxSuspendDays {
+			return fmt.Errorf("Suspensions Must Be 1-%d Days", maxSuspendDays)
+		}
+		err = setSuspended(target.User.ID, time.Now().AddDate(0, 0, mr.Days).Unix())
+	case "ban":
+		err = setBanned(target.User.ID, true)
+	}
+	if err != nil {
+		log.Println(err)
+		return errors.New("Database Error")
+	}
+
+	note := mr.Note
+	if mr.Action == "suspend" {
+		note = fmt.Sprintf("%d days. %s", mr.Days, note)
+	}
+	err = logModAction(&modAction{
+		Time:       time.Now().Unix(),
+		Moderator:  mod.User.ID,
+		Action:     mr.Action,
+		TargetType: mr.TargetType,
+		Target:     mr.Target,
+		Report:     reportID,
+		Note:       strings.TrimSpace(note),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	return nil
+}
+
+// unblockMediaHandler() is the route handler for /unblockMedia/[hash], used
+// by a moderator to take an image off the media blocklist.
+func unblockMediaHandler(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	hash := strings.Split(r.URL.Path, "/")[2]
+	ok, err := removeBlockedMedia(hash)
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	if !ok {
+		log.Println(status(w, "Not On The Blocklist", nil))
+		return
+	}
+	err = logModAction(&modAction{
+		Time:       time.Now().Unix(),
+		Moderator:  c.User.ID,
+		Action:     "unblockmedia",
+		TargetType: "media",
+		Target:     hash,
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	log.Println(status(w, "success", nil))
+}
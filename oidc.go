@@ -0,0 +1,362 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// oidc.go houses a small, generic OpenID Connect client, used to let users
+// sign in with an external identity provider. It handles discovery, the
+// authorization code flow with PKCE, and verification of the ID token against
+// the providers published keys. The route handlers that use it are in
+// oidc_handler.go.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// oidcProvider{} is an identity provider as configured in bolt.conf.json. The
+// client secret is read from the environment variable oidc_[name] at run
+// time, the same way hmacss is.
+type oidcProvider struct {
+	// Name is used in the login and callback routes, and shown to users.
+	Name string `json:"name" redis:"name"`
+	// Issuer is the providers issuer URL, which discovery is done against.
+	Issuer   string   `json:"issuer" redis:"issuer"`
+	ClientID string   `json:"client_id" redis:"client_id"`
+	Scopes   []string `json:"scopes" redis:"scopes"`
+}
+
+// oidcDiscovery{} is the subset of the providers discovery document we use.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcState{} is what we remember about a login between redirecting the user
+// to the provider and the provider redirecting them back.
+type oidcState struct {
+	Provider string `json:"provider"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+// oidcIdentity{} is the verified identity of a user, taken from the claims of
+// their ID token.
+type oidcIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+var (
+	// oidcHTTP is used for all requests to identity providers.
+	oidcHTTP = &http.Client{Timeout: 10 * time.Second}
+
+	// oidcDocs and oidcKeys hold the discovery documents and signing keys
+	// of the providers, which are fetched the first time they're needed.
+	// oidcFetch is when each providers keys were last fetched.
+	oidcMu    sync.Mutex
+	oidcDocs  = map[string]*oidcDiscovery{}
+	oidcKeys  = map[string]map[string]any{}
+	oidcFetch = map[string]time.Time{}
+)
+
+// getOIDCProvider() returns the configured provider with the name.
+func getOIDCProvider(name string) (*oidcProvider, bool) {
+	for i := range appConf.OIDC {
+		if appConf.OIDC[i].Name == name {
+			return &appConf.OIDC[i], true
+		}
+	}
+	return nil, false
+}
+
+// oidcRedirectURL() returns the callback URL registered with the provider.
+func oidcRedirectURL(p *oidcProvider) string {
+	return siteURL() + "/oidc/callback/" + p.Name
+}
+
+// discover() fetches, and caches, the providers discovery document.
+func (p *oidcProvider) discover() (*oidcDiscovery, error) {
+	oidcMu.Lock()
+	d, ok := oidcDocs[p.Name]
+	oidcMu.Unlock()
+	if ok {
+		return d, nil
+	}
+
+	d = new(oidcDiscovery)
+	wk := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := getJSON(wk, d); err != nil {
+		return nil, err
+	}
+	if d.Issuer != p.Issuer {
+		return nil, fmt.Errorf("oidc: issuer mismatch %q != %q", d.Issuer, p.Issuer)
+	}
+
+	oidcMu.Lock()
+	oidcDocs[p.Name] = d
+	oidcMu.Unlock()
+	return d, nil
+}
+
+// authURL() returns the URL to send the user to in order to sign in with the
+// provider, along with the state we need to remember until they come back.
+func (p *oidcProvider) authURL() (string, string, *oidcState, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", "", nil, err
+	}
+	st := &oidcState{Provider: p.Name}
+	state, err := randomToken()
+	if err != nil {
+		return "", "", nil, err
+	}
+	if st.Nonce, err = randomToken(); err != nil {
+		return "", "", nil, err
+	}
+	if st.Verifier, err = randomToken(); err != nil {
+		return "", "", nil, err
+	}
+	challenge := sha256.Sum256([]byte(st.Verifier))
+
+	scopes := p.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email"}
+	}
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.ClientID)
+	v.Set("redirect_uri", oidcRedirectURL(p))
+	v.Set("scope", strings.Join(scopes, " "))
+	v.Set("state", state)
+	v.Set("nonce", st.Nonce)
+	v.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	v.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + v.Encode(), state, st, nil
+}
+
+// exchange() trades an authorization code for tokens at the providers token
+// endpoint, and returns the verified identity from the ID token.
+func (p *oidcProvider) exchange(code string, st *oidcState) (*oidcIdentity, error) {
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	v := url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", oidcRedirectURL(p))
+	v.Set("client_id", p.ClientID)
+	v.Set("code_verifier", st.Verifier)
+	if secret := os.Getenv("oidc_" + p.Name); secret != "" {
+		v.Set("client_secret", secret)
+	}
+
+	res, err := oidcHTTP.PostForm(d.TokenEndpoint, v)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc: token endpoint returned %s", res.Status)
+	}
+	var tok struct {
+		IDToken string `json:"id_token"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&tok); err != nil {
+		return nil, err
+	}
+	if tok.IDToken == "" {
+		return nil, errors.New("oidc: no id_token in response")
+	}
+	return p.verifyIDToken(d, tok.IDToken, st.Nonce)
+}
+
+// verifyIDToken() checks the ID tokens signature against the providers keys,
+// along with its issuer, audience, expiry and nonce.
+func (p *oidcProvider) verifyIDToken(d *oidcDiscovery, raw, nonce string) (*oidcIdentity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		switch t.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("oidc: unexpected signing method %v", t.Header["alg"])
+		}
+		kid, _ := t.Header["kid"].(string)
+		return p.key(d, kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !claims.VerifyIssuer(d.Issuer, true) {
+		return nil, errors.New("oidc: bad issuer")
+	}
+	if !claims.VerifyAudience(p.ClientID, true) {
+		return nil, errors.New("oidc: bad audience")
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, errors.New("oidc: token expired")
+	}
+	if n, _ := claims["nonce"].(string); n == "" || n != nonce {
+		return nil, errors.New("oidc: bad nonce")
+	}
+
+	id := &oidcIdentity{}
+	id.Subject, _ = claims["sub"].(string)
+	id.Email, _ = claims["email"].(string)
+	id.EmailVerified, _ = claims["email_verified"].(bool)
+	if id.Subject == "" {
+		return nil, errors.New("oidc: no subject")
+	}
+	return id, nil
+}
+
+// key() returns the providers public key with the key ID. The key set is
+// re-fetched when an unknown key ID shows up, since providers rotate keys,
+// but no more than once a minute.
+func (p *oidcProvider) key(d *oidcDiscovery, kid string) (any, error) {
+	oidcMu.Lock()
+	k, ok := oidcKeys[p.Name][kid]
+	stale := time.Since(oidcFetch[p.Name]) > time.Minute
+	oidcMu.Unlock()
+	if ok {
+		return k, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("oidc: unknown key %q", kid)
+	}
+
+	keys, err := fetchJWKS(d.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	oidcMu.Lock()
+	oidcKeys[p.Name] = keys
+	oidcFetch[p.Name] = time.Now()
+	oidcMu.Unlock()
+
+	if k, ok = keys[kid]; !ok {
+		return nil, fmt.Errorf("oidc: unknown key %q", kid)
+	}
+	return k, nil
+}
+
+// fetchJWKS() fetches a JSON Web Key Set and returns the RSA and P-256 keys
+// it contains, by key ID.
+func fetchJWKS(uri string) (map[string]any, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := getJSON(uri, &set); err != nil {
+		return nil, err
+	}
+
+	b64 := func(s string) *big.Int {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil
+		}
+		return new(big.Int).SetBytes(b)
+	}
+	keys := map[string]any{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch {
+		case k.Kty == "RSA":
+			n, e := b64(k.N), b64(k.E)
+			if n == nil || e == nil || !e.IsInt64() {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, y := b64(k.X), b64(k.Y)
+			if x == nil || y == nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		}
+	}
+	return keys, nil
+}
+
+// getJSON() fetches a URL and decodes the JSON response into v.
+func getJSON(uri string, v any) error {
+	res, err := oidcHTTP.Get(uri)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: %s returned %s", uri, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// randomToken() returns 32 random bytes, base64url encoded, for use as a
+// state, nonce or PKCE verifier.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
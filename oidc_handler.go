@@ -0,0 +1,305 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// oidc_handler.go houses the route handlers for signing in with an external
+// identity provider. The OpenID Connect client its self is in oidc.go.
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// oidcLogin() is the route handler for /oidc/login/[provider]. It redirects
+// the user to the provider to sign in. If the user is already signed in, the
+// provider identity they come back with is linked to their account.
+func oidcLogin(w http.ResponseWriter, r *http.Request) {
+	p, ok := getOIDCProvider(strings.Split(r.URL.Path, "/")[3])
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	uri, state, st, err := p.authURL()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Identity Provider Error", http.StatusBadGateway)
+		return
+	}
+	if err = setOIDCState(state, st); err != nil {
+		log.Println(err)
+		http.Error(w, "Database Error", http.StatusInternalServerError)
+		return
+	}
+
+	// The state is also kept in a cookie, so a callback can only be
+	// completed by the browser that started the login.
+	http.SetCookie(w, &http.Cookie{
+		Name:     "oidc_state",
+		Value:    state,
+		Path:     "/oidc/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   appConf.App.TLSEnabled,
+		SameSite: http.SameSiteLaxMode,
+	})
+	// An invite code is kept until the callback, in case the user signs
+	// up. see: invite.go
+	if code := r.URL.Query().Get("invite"); code != "" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     "invite",
+			Value:    code,
+			Path:     "/oidc/",
+			MaxAge:   600,
+			HttpOnly: true,
+			Secure:   appConf.App.TLSEnabled,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	http.Redirect(w, r, uri, http.StatusFound)
+}
+
+// oidcCallback() is the route handler for /oidc/callback/[provider], where
+// the provider sends the user back to after they sign in. The identity is
+// verified, and then either:
+//   - the user linked to it is signed in,
+//   - it's linked to the signed in user, or
+//   - a new account is created for it.
+func oidcCallback(w http.ResponseWriter, r *http.Request) {
+	p, ok := getOIDCProvider(strings.Split(r.URL.Path, "/")[3])
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		log.Println(e, q.Get("error_description"))
+		http.Error(w, "Sign In Cancelled", http.StatusBadRequest)
+		return
+	}
+
+	// Make sure the callback belongs to a login this browser started.
+	cookie, err := r.Cookie("oidc_state")
+	if err != nil || cookie.Value == "" || cookie.Value != q.Get("state") {
+		log.Println(err)
+		http.Error(w, "Invalid State", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: "oidc_state", Path: "/oidc/", MaxAge: -1})
+	st, err := takeOIDCState(cookie.Value)
+	if err != nil || st.Provider != p.Name {
+		log.Println(err)
+		http.Error(w, "Invalid State", http.StatusBadRequest)
+		return
+	}
+
+	id, err := p.exchange(q.Get("code"), st)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Identity Provider Error", http.StatusBadGateway)
+		return
+	}
+
+	c := r.Context().Value(ctxkey).(*credentials)
+	userID, err := getOIDCLink(p.Name, id.Subject)
+	switch {
+	case err != nil:
+		log.Println(err)
+		http.Error(w, "Database Error", http.StatusInternalServerError)
+	case userID != "" && c.IsLoggedIn && userID != c.User.ID:
+		http.Error(w, "Already linked to another account", http.StatusConflict)
+	case userID != "":
+		oidcSignin(w, r, userID)
+	case c.IsLoggedIn:
+		// link the identity to the signed in user.
+		if ok, err = linkOIDC(p.Name, id.Subject, c.User.ID); err != nil || !ok {
+			log.Println(err)
+			http.Error(w, "Couldn't link account", http.StatusConflict)
+			return
+		}
+		http.Redirect(w, r, "/user/"+c.User.ID, http.StatusSeeOther)
+	default:
+		oidcSignup(w, r, p, id)
+	}
+}
+
+// oidcSignup() creates a new account for an identity that isn't linked to
+// anyone yet. We require a verified email from the provider, and refuse to
+// take over an existing account with the same email; its owner can sign in
+// with their password and link the provider instead.
+//
+// There's no proof-of-work challenge, as the signup arrives as a redirect
+// from the provider, which can't carry one. Instead each account costs an
+// account with the provider, with a verified email, which the provider does
+// its own bot checks for, and it shares the signup rate limit with password
+// signups. see: pow.go
+func oidcSignup(w http.ResponseWriter, r *http.Request, p *oidcProvider, id *oidcIdentity) {
+	email := strings.ToLower(id.Email)
+	if !id.EmailVerified || !validEmail(email) {
+		http.Error(w, "A verified email is required", http.StatusBadRequest)
+		return
+	}
+	ok, wait, err := takeToken("signup", "IP:"+clientIP(r), budget("signup", nil))
+	if err != nil {
+		log.Println(err)
+	}
+	if err == nil && !ok {
+		w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Too many signups, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	c := &credentials{Name: email, User: &user{
+		ID:         genID(15),
+		Email:      email,
+		Joined:     time.Now(),
+		ProfileBG:  "public/media/hubble.jpg",
+		ProfilePic: "public/media/ndt.jpg",
+	}}
+	if cookie, err := r.Cookie("invite"); err == nil {
+		c.Invite = cookie.Value
+		http.SetCookie(w, &http.Cookie{Name: "invite", Path: "/oidc/", MaxAge: -1})
+	}
+	inv, refused := admitSignup(c)
+	if refused != "" {
+		http.Error(w, refused, http.StatusForbidden)
+		return
+	}
+	ok, err = claimEmail(email, c.User.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Database Error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "An account with this email already exists. Sign in "+
+			"with your password to link it.", http.StatusConflict)
+		return
+	}
+
+	// From here on, a signup which fails is undone, so the email and
+	// identity aren't left claimed by an account that doesn't work.
+	linked, done := false, false
+	defer func() {
+		if done {
+			return
+		}
+		if err := abandonSignup(c, p.Name, id.Subject, linked); err != nil {
+			log.Println(err)
+		}
+	}()
+	if inv != nil {
+		if ok, err = useInvite(inv, c); err != nil || !ok {
+			log.Println(err)
+			http.Error(w, "Invalid Invite Code", http.StatusForbidden)
+			return
+		}
+	}
+	if linked, err = linkOIDC(p.Name, id.Subject, c.User.ID); err != nil || !linked {
+		log.Println(err)
+		http.Error(w, "Couldn't link account", http.StatusConflict)
+		return
+	}
+	if _, err = zaddUsers(c); err != nil {
+		log.Println(err)
+		http.Error(w, "Database Error", http.StatusInternalServerError)
+		return
+	}
+	if err = incrSignups(); err != nil {
+		log.Println(err)
+	}
+	if err = createProfile(c); err != nil {
+		log.Println(err)
+		http.Error(w, "Database Error", http.StatusInternalServerError)
+		return
+	}
+	if c.User.Waitlisted {
+		if err = addToWaitlist(c); err != nil {
+			log.Println(err)
+			http.Error(w, "Database Error", http.StatusInternalServerError)
+			return
+		}
+		done = true
+		http.Error(w, "You're on the waitlist, we'll email you once you're in.", http.StatusAccepted)
+		return
+	}
+
+	// The account is complete now, so if the token can't be issued the
+	// user can still sign in again.
+	done = true
+	if _, err = renewToken(w, r, c); err != nil {
+		log.Println(err)
+		http.Error(w, "Token Error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// oidcSignin() signs in the user linked to an identity. Users with two-factor
+// authentication enabled are sent back to the home page with a challenge, so
+// the client can finish signing in with a code. see: signinTOTP()
+func oidcSignin(w http.ResponseWriter, r *http.Request, id string) {
+	c := &credentials{User: &user{ID: id}}
+	if err := scanProfile(c); err != nil {
+		log.Println(err)
+		http.Error(w, "Scan Profile Error", http.StatusInternalServerError)
+		return
+	}
+	if c.User.Waitlisted {
+		http.Error(w, "You're still on the waitlist", http.StatusForbidden)
+		return
+	}
+	twoFactor, err := hasTOTP(c)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Database Error", http.StatusInternalServerError)
+		return
+	}
+	if twoFactor {
+		challenge, err := signChallengeToken(id)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Token Error", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/#2fa="+url.QueryEscape(challenge), http.StatusSeeOther)
+		return
+	}
+	c.Name = c.User.Email
+	if _, err := renewToken(w, r, c); err != nil {
+		log.Println(err)
+		http.Error(w, "Token Error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
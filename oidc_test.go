@@ -0,0 +1,281 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// mockProvider is a stand in for an OpenID Connect identity provider. It
+// publishes a discovery document and key set, and its token endpoint hands
+// out ID tokens with the claims set by the test, once the PKCE verifier
+// checks out.
+type mockProvider struct {
+	*httptest.Server
+	t      *testing.T
+	mu     sync.Mutex
+	key    *rsa.PrivateKey
+	kid    string
+	claims jwt.MapClaims
+	// challenges are the PKCE challenges sent with each authorization
+	// request, by authorization code.
+	challenges map[string]string
+	jwksHits   int
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	m := &mockProvider{t: t, kid: "k1", challenges: map[string]string{}}
+	m.key = newRSAKey(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                m.URL,
+			AuthorizationEndpoint: m.URL + "/authorize",
+			TokenEndpoint:         m.URL + "/token",
+			JWKSURI:               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.jwksHits++
+		b64 := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "kid": m.kid, "use": "sig",
+			"n": b64(m.key.N.Bytes()),
+			"e": b64(big.NewInt(int64(m.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		m.mu.Lock()
+		challenge, ok := m.challenges[r.PostForm.Get("code")]
+		m.mu.Unlock()
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": m.sign(m.key, m.kid, m.claims)})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// sign() returns an ID token with the claims, signed with key.
+func (m *mockProvider) sign(key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	tok.Header["kid"] = kid
+	s, err := tok.SignedString(key)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	return s
+}
+
+// provider() returns an oidcProvider{} for the mock provider, under a name
+// of its own so nothing is shared with other tests through the caches.
+func (m *mockProvider) provider() *oidcProvider {
+	return &oidcProvider{Name: "mock" + strings.ReplaceAll(m.t.Name(), "/", "_"),
+		Issuer: m.URL, ClientID: "tagmachine"}
+}
+
+// authorize() plays the part of the user signing in with the provider. It
+// starts a login, checks the URL the user is sent to, and returns the code
+// the provider would send them back with, and the state to exchange it with.
+func (m *mockProvider) authorize(p *oidcProvider) (string, *oidcState) {
+	uri, state, st, err := p.authURL()
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Path != "/authorize" || q.Get("client_id") != p.ClientID ||
+		q.Get("state") != state || q.Get("nonce") != st.Nonce ||
+		q.Get("code_challenge_method") != "S256" || q.Get("response_type") != "code" {
+		m.t.Fatalf("bad authorization URL %s", uri)
+	}
+	code := "code-" + state
+	m.mu.Lock()
+	m.challenges[code] = q.Get("code_challenge")
+	m.claims = jwt.MapClaims{
+		"iss":            m.URL,
+		"aud":            p.ClientID,
+		"sub":            "subject-1",
+		"email":          "user@example.com",
+		"email_verified": true,
+		"nonce":          st.Nonce,
+		"exp":            time.Now().Add(time.Hour).Unix(),
+	}
+	m.mu.Unlock()
+	return code, st
+}
+
+func TestOIDCExchange(t *testing.T) {
+	m := newMockProvider(t)
+	p := m.provider()
+	code, st := m.authorize(p)
+	id, err := p.exchange(code, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Subject != "subject-1" || id.Email != "user@example.com" || !id.EmailVerified {
+		t.Errorf("got identity %+v", id)
+	}
+}
+
+func TestOIDCExchangeRefuses(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		change func(m *mockProvider, st *oidcState)
+	}{
+		{"wrong verifier", func(m *mockProvider, st *oidcState) { st.Verifier = "guessed" }},
+		{"wrong nonce", func(m *mockProvider, st *oidcState) { st.Nonce = "replayed" }},
+		{"no nonce", func(m *mockProvider, st *oidcState) { delete(m.claims, "nonce") }},
+		{"wrong issuer", func(m *mockProvider, st *oidcState) { m.claims["iss"] = "https://evil.example" }},
+		{"wrong audience", func(m *mockProvider, st *oidcState) { m.claims["aud"] = "someone-else" }},
+		{"expired", func(m *mockProvider, st *oidcState) {
+			m.claims["exp"] = time.Now().Add(-time.Minute).Unix()
+		}},
+		{"no subject", func(m *mockProvider, st *oidcState) { delete(m.claims, "sub") }},
+		{"signed by another key", func(m *mockProvider, st *oidcState) { m.key = newRSAKey(m.t) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockProvider(t)
+			p := m.provider()
+			code, st := m.authorize(p)
+			// The keys are fetched with the original key, so the
+			// token signed by another key doesn't match them.
+			if _, err := p.key(mustDiscover(t, p), m.kid); err != nil {
+				t.Fatal(err)
+			}
+			tc.change(m, st)
+			if id, err := p.exchange(code, st); err == nil {
+				t.Errorf("got identity %+v, want an error", id)
+			}
+		})
+	}
+}
+
+func TestOIDCRefusesUnsignedTokens(t *testing.T) {
+	m := newMockProvider(t)
+	p := m.provider()
+	_, st := m.authorize(p)
+	for alg, method := range map[string]jwt.SigningMethod{
+		"none":  jwt.SigningMethodNone,
+		"HS256": jwt.SigningMethodHS256,
+	} {
+		tok := jwt.NewWithClaims(method, m.claims)
+		tok.Header["kid"] = m.kid
+		var key any = jwt.UnsafeAllowNoneSignatureType
+		if alg == "HS256" {
+			key = []byte("secret")
+		}
+		raw, err := tok.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id, err := p.verifyIDToken(mustDiscover(t, p), raw, st.Nonce); err == nil {
+			t.Errorf("%s: got identity %+v, want an error", alg, id)
+		}
+	}
+}
+
+// TestOIDCKeyRotation checks an unknown key ID makes us fetch the key set
+// again, but no more than once a minute.
+func TestOIDCKeyRotation(t *testing.T) {
+	m := newMockProvider(t)
+	p := m.provider()
+	code, st := m.authorize(p)
+	if _, err := p.exchange(code, st); err != nil {
+		t.Fatal(err)
+	}
+
+	m.mu.Lock()
+	m.key, m.kid = newRSAKey(t), "k2"
+	m.mu.Unlock()
+	code, st = m.authorize(p)
+	if _, err := p.exchange(code, st); err == nil {
+		t.Fatal("keys were fetched again within a minute")
+	}
+
+	oidcMu.Lock()
+	oidcFetch[p.Name] = time.Now().Add(-2 * time.Minute)
+	oidcMu.Unlock()
+	code, st = m.authorize(p)
+	if _, err := p.exchange(code, st); err != nil {
+		t.Fatal(err)
+	}
+	if m.jwksHits != 2 {
+		t.Errorf("key set fetched %d times, want 2", m.jwksHits)
+	}
+}
+
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	m := newMockProvider(t)
+	p := m.provider()
+	p.Issuer = m.URL + "/"
+	if _, err := p.discover(); err == nil {
+		t.Error("discovery document for another issuer was accepted")
+	}
+}
+
+func mustDiscover(t *testing.T, p *oidcProvider) *oidcDiscovery {
+	d, err := p.discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
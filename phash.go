@@ -0,0 +1,239 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// phash.go houses the media blocklist. Each uploaded image gets a perceptual
+// hash, a dHash, made by shrinking it to 9x8 grey pixels and recording
+// whether each pixel is brighter than the one to its right. Unlike a
+// cryptographic hash, it barely changes when an image is resized,
+// re-encoded, or lightly edited, so the number of bits two hashes differ by
+// (their Hamming distance) says how alike the images look.
+//
+// Moderators add the hashes of a posts images to the blocklist with the
+// "blockmedia" action. Uploads within Distance bits of a blocked hash are
+// rejected, or, if Action is "flag" in bolt.conf.json, held for review with a
+// report in the moderation queue. see: moderation.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// mediaBlocklist is the reporter of the reports made for uploads
+	// like blocked images.
+	mediaBlocklist = "media-blocklist"
+	// defaultBlockDistance is the most bits an upload may differ from a
+	// blocked hash by and still match, when Distance isn't set.
+	defaultBlockDistance = 6
+	// minHashBits is the fewest bits a hash must have set, and unset, to
+	// be blocked. Plain images and smooth gradients hash to nearly all 0s
+	// or all 1s, and blocking one would block all of them.
+	minHashBits = 8
+)
+
+var (
+	// errBlockedMedia is returned for uploads like a blocked image, when
+	// they're rejected.
+	errBlockedMedia = errors.New("blocked media")
+	// errNoImages is returned when blocking the media of a post without
+	// any images, or with only plain ones. see: minHashBits
+	errNoImages = errors.New("no images to block")
+)
+
+// dhash() returns the perceptual hash of img, as 16 hex digits.
+func dhash(img image.Image) string {
+	small := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+	var h uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			h <<= 1
+			if small.GrayAt(x, y).Y > small.GrayAt(x+1, y).Y {
+				h |= 1
+			}
+		}
+	}
+	return fmt.Sprintf("%016x", h)
+}
+
+// hashDistance() returns the number of bits the hashes a and b differ by, or
+// -1 if either isn't a hash.
+func hashDistance(a, b string) int {
+	x, err := strconv.ParseUint(a, 16, 64)
+	if err != nil {
+		return -1
+	}
+	y, err := strconv.ParseUint(b, 16, 64)
+	if err != nil {
+		return -1
+	}
+	return bits.OnesCount64(x ^ y)
+}
+
+// plainHash() reports whether h is the hash of a plain image, which is too
+// much like too many others to block.
+func plainHash(h string) bool {
+	n := hashDistance(h, "0000000000000000")
+	return n < minHashBits || n > 64-minHashBits
+}
+
+// blockDistance() returns the most bits an upload may differ from a blocked
+// hash by and still match.
+func blockDistance() int {
+	if appConf.MediaBlocklist.Distance <= 0 {
+		return defaultBlockDistance
+	}
+	return appConf.MediaBlocklist.Distance
+}
+
+// blockMatch{} is an attachment like a blocked image.
+type blockMatch struct {
+	Attachment *attachment
+	Blocked    *blockedMedia
+	Distance   int
+}
+
+// matchBlocklist() returns the closest match between the posts attachments
+// and the blocklist, or nil if none are within blockDistance().
+func matchBlocklist(p *post) (*blockMatch, error) {
+	var hashes []string
+	for _, a := range p.Attachments {
+		if a.PHash != "" {
+			hashes = append(hashes, a.PHash)
+		}
+	}
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+	blocked, err := getBlockedMedia()
+	if err != nil {
+		return nil, err
+	}
+	var match *blockMatch
+	for _, a := range p.Attachments {
+		for _, b := range blocked {
+			d := hashDistance(a.PHash, b.Hash)
+			if d < 0 || d > blockDistance() || (match != nil && d >= match.Distance) {
+				continue
+			}
+			match = &blockMatch{Attachment: a, Blocked: b, Distance: d}
+		}
+	}
+	return match, nil
+}
+
+// screenMedia() checks a new posts attachments against the blocklist, before
+// it's stored. Posts which match are refused with errBlockedMedia, or held
+// for review when the blocklist is set to "flag", in which case the match is
+// passed to reportBlockedMedia() once the post is stored.
+func screenMedia(p *post) (*blockMatch, error) {
+	match, err := matchBlocklist(p)
+	if err != nil || match == nil {
+		return nil, err
+	}
+	if appConf.MediaBlocklist.Action != "flag" {
+		return nil, errBlockedMedia
+	}
+	p.Hidden = true
+	return match, nil
+}
+
+// reportBlockedMedia() files a report for a post held for being like a
+// blocked image, so a moderator reviews it.
+func reportBlockedMedia(p *post, m *blockMatch) {
+	if m == nil {
+		return
+	}
+	err := addReport(&report{
+		ID:         genID(15),
+		Reporter:   mediaBlocklist,
+		TargetType: "post",
+		Target:     p.ID,
+		Reason:     m.Blocked.Reason,
+		Text: fmt.Sprintf("held for review, %s is %d bits from blocked image %s",
+			m.Attachment.Blob, m.Distance, m.Blocked.Hash),
+		Excerpt: excerpt(p.Text+" "+strings.Join(p.blobPaths(), " "), 280),
+		Created: time.Now().Unix(),
+		Status:  "open",
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// attachmentPHash() returns the perceptual hash of an image attachment,
+// reading it from the store if it was uploaded before they were recorded.
+func attachmentPHash(a *attachment) string {
+	if a.PHash != "" || a.Kind != "img" {
+		return a.PHash
+	}
+	f, err := openUpload(a.Blob)
+	if err != nil {
+		log.Println(err)
+		return ""
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		log.Println(a.Blob, err)
+		return ""
+	}
+	// hashed the same way as uploads. see: processImage()
+	return dhash(scaleImage(img, blurhashSample, 1))
+}
+
+// blockPostMedia() adds the images attached to a post to the blocklist, for
+// the given reason. see: applyModAction()
+func blockPostMedia(mod *credentials, p *post, reason, note string) error {
+	var blocked []*blockedMedia
+	for _, a := range p.Attachments {
+		if h := attachmentPHash(a); h != "" && !plainHash(h) {
+			blocked = append(blocked, &blockedMedia{
+				Hash:      h,
+				Moderator: mod.User.ID,
+				Post:      p.ID,
+				Reason:    reason,
+				Note:      note,
+				Added:     time.Now().Unix(),
+			})
+		}
+	}
+	if len(blocked) == 0 {
+		return errNoImages
+	}
+	return addBlockedMedia(blocked...)
+}
@@ -0,0 +1,199 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// pow.go houses the proof-of-work challenge, which makes each signup, and
+// optionally each post from a new account, cost the client some work, so
+// bots can't make them as fast as the server can handle them. It works like
+// hashcash:
+//  1. the client asks /challenge for a challenge for the action,
+//  2. it searches for a nonce where the SHA-256 hash of challenge:nonce
+//     starts with the challenges number of zero bits, and
+//  3. it sends the challenge and nonce along with the request, in the
+//     X-PoW-Challenge and X-PoW-Nonce headers.
+//
+// Challenges are signed by the server, so they don't need to be stored until
+// they're used, and each may only be used once. The signup challenge gets
+// harder as more users sign up.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// challengeTTL is how long a challenge may be used for.
+	challengeTTL = 10 * time.Minute
+	// defaultPoWMinBits and defaultPoWMaxBits bound the difficulty when
+	// they aren't set in bolt.conf.json. Each bit doubles the work.
+	defaultPoWMinBits = 16
+	defaultPoWMaxBits = 24
+	// signupsPerBit is how many signups over the last two hours add a
+	// bit of difficulty, doubling each time.
+	signupsPerBit = 10
+	// powNewAccount is how long an account is new for, when posts from
+	// new accounts are challenged.
+	powNewAccount = 7 * 24 * time.Hour
+)
+
+// powBits() returns the difficulty of the challenge the user must solve for
+// action, or 0 if they needn't solve one.
+func powBits(action string, c *credentials) int {
+	lo, hi := appConf.PoW.MinBits, appConf.PoW.MaxBits
+	if lo <= 0 {
+		lo = defaultPoWMinBits
+	}
+	if hi < lo {
+		hi = max(lo, defaultPoWMaxBits)
+	}
+
+	switch action {
+	case "signup":
+		n, err := getRecentSignups()
+		if err != nil {
+			log.Println(err)
+		}
+		return min(lo+int(math.Log2(1+float64(n)/signupsPerBit)), hi)
+	case "post":
+		if !appConf.PoW.NewAccounts || c == nil || !c.IsLoggedIn ||
+			c.User.Level >= roleTrusted || c.User.Joined.IsZero() ||
+			time.Since(c.User.Joined) > powNewAccount {
+			return 0
+		}
+		return lo
+	}
+	return 0
+}
+
+// signChallenge() returns a new challenge for action, of the given
+// difficulty. It holds the action, difficulty, expiry and a random ID, and
+// the servers signature of them.
+func signChallenge(action string, difficulty int) string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	body := fmt.Sprintf("%s.%d.%d.%s", action, difficulty,
+		time.Now().Add(challengeTTL).Unix(), hex.EncodeToString(b))
+	mac := hmac.New(sha256.New, hmacSampleSecret)
+	mac.Write([]byte("pow:" + body))
+	return body + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkChallenge() reports whether nonce solves the challenge, which must
+// have been signed by the server for action, and not have expired or been
+// used before. It's spent once checked.
+func checkChallenge(challenge, nonce, action string) (bool, error) {
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 5 || parts[0] != action || len(nonce) > 32 {
+		return false, nil
+	}
+	body := strings.Join(parts[:4], ".")
+	mac := hmac.New(sha256.New, hmacSampleSecret)
+	mac.Write([]byte("pow:" + body))
+	if !hmac.Equal([]byte(parts[4]), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		return false, nil
+	}
+	difficulty, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false, nil
+	}
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false, nil
+	}
+	if leadingZeros(sha256.Sum256([]byte(challenge+":"+nonce))) < difficulty {
+		return false, nil
+	}
+	return spendChallenge(parts[3], time.Until(time.Unix(expires, 0)))
+}
+
+// leadingZeros() counts the zero bits at the start of a hash.
+func leadingZeros(sum [32]byte) int {
+	n := 0
+	for _, b := range sum {
+		n += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return n
+}
+
+// challengeHandler() is the route handler for /challenge?action=[action],
+// which issues a challenge for the action. The challenge is empty if the user
+// needn't solve one.
+func challengeHandler(w http.ResponseWriter, r *http.Request) {
+	action := r.URL.Query().Get("action")
+	if action != "signup" && action != "post" {
+		log.Println(status(w, "Unknown Action", nil))
+		return
+	}
+	c, _ := r.Context().Value(ctxkey).(*credentials)
+	difficulty, challenge := powBits(action, c), ""
+	if difficulty > 0 {
+		challenge = signChallenge(action, difficulty)
+	}
+	ajaxResponse(w, map[string]string{
+		"status":    "success",
+		"challenge": challenge,
+		"bits":      fmt.Sprint(difficulty),
+	})
+}
+
+// requirePoW is used as a middleware function for routes which need a solved
+// challenge for action, when powBits() says the user must solve one.
+func requirePoW(action string, next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, _ := r.Context().Value(ctxkey).(*credentials)
+		if powBits(action, c) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ok, err := checkChallenge(r.Header.Get("X-PoW-Challenge"),
+			r.Header.Get("X-PoW-Nonce"), action)
+		if err != nil {
+			log.Println(status(w, "Database Error", err))
+			return
+		}
+		if !ok {
+			w.WriteHeader(http.StatusForbidden)
+			log.Println(status(w, "Invalid Challenge, Please Try Again", nil))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,173 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// probe.go reads the dimensions and duration of uploads the image pipeline
+// doesn't decode, for their attachment{}. Images are read with the image
+// package, where it has a decoder, and MP4 videos from their movie header
+// and track headers. Other formats are left without.
+package main
+
+import (
+	"encoding/binary"
+	"image"
+	"io"
+	"os"
+)
+
+// maxMoovSize is the largest MP4 movie box we'll read, which holds the
+// headers. It's usually tens of kilobytes.
+const maxMoovSize = 16 << 20
+
+// probeMedia() returns the width, height and duration in seconds of the file
+// at path, as far as they can be read.
+func probeMedia(path string, mt *mediaType) (int, int, float64) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, 0
+	}
+	defer f.Close()
+	switch {
+	case mt.Kind == "img":
+		if cfg, _, err := image.DecodeConfig(f); err == nil {
+			return cfg.Width, cfg.Height, 0
+		}
+	case mt.MIME == "video/mp4":
+		return probeMP4(f)
+	}
+	return 0, 0, 0
+}
+
+// probeMP4() finds the moov box of an MP4, which may be at the start or the
+// end of the file, and reads the duration from its mvhd box, and the size
+// from the tkhd box of the first track with one.
+func probeMP4(f io.ReadSeeker) (w, h int, dur float64) {
+	moov := findBox(f, "moov", maxMoovSize)
+	if moov == nil {
+		return 0, 0, 0
+	}
+	eachBox(moov, func(typ string, body []byte) {
+		switch typ {
+		case "mvhd":
+			dur = mvhdDuration(body)
+		case "trak":
+			eachBox(body, func(typ string, body []byte) {
+				if typ == "tkhd" && w == 0 {
+					w, h = tkhdSize(body)
+				}
+			})
+		}
+	})
+	return w, h, dur
+}
+
+// findBox() returns the body of the top level box typ, if it's no larger
+// than limit.
+func findBox(f io.ReadSeeker, typ string, limit int64) []byte {
+	var head [16]byte
+	for {
+		if _, err := io.ReadFull(f, head[:8]); err != nil {
+			return nil
+		}
+		size, hdr := int64(binary.BigEndian.Uint32(head[:4])), int64(8)
+		if size == 1 {
+			if _, err := io.ReadFull(f, head[8:16]); err != nil {
+				return nil
+			}
+			size, hdr = int64(binary.BigEndian.Uint64(head[8:16])), 16
+		}
+		if size != 0 && size < hdr {
+			return nil
+		}
+		if string(head[4:8]) == typ {
+			if size == 0 || size-hdr > limit {
+				return nil
+			}
+			body := make([]byte, size-hdr)
+			if _, err := io.ReadFull(f, body); err != nil {
+				return nil
+			}
+			return body
+		}
+		// a size of 0 means the box runs to the end of the file.
+		if size == 0 {
+			return nil
+		}
+		if _, err := f.Seek(size-hdr, io.SeekCurrent); err != nil {
+			return nil
+		}
+	}
+}
+
+// eachBox() calls fn with the type and body of each box in b.
+func eachBox(b []byte, fn func(typ string, body []byte)) {
+	for len(b) >= 8 {
+		size, hdr := uint64(binary.BigEndian.Uint32(b)), uint64(8)
+		if size == 1 && len(b) >= 16 {
+			size, hdr = binary.BigEndian.Uint64(b[8:]), 16
+		}
+		if size == 0 {
+			size = uint64(len(b))
+		}
+		if size < hdr || size > uint64(len(b)) {
+			return
+		}
+		fn(string(b[4:8]), b[hdr:size])
+		b = b[size:]
+	}
+}
+
+// mvhdDuration() returns the duration of a movie in seconds, from the body
+// of its mvhd box, which comes in 32 and 64 bit versions.
+func mvhdDuration(b []byte) float64 {
+	var scale uint32
+	var dur uint64
+	switch {
+	case len(b) >= 20 && b[0] == 0:
+		scale, dur = binary.BigEndian.Uint32(b[12:]), uint64(binary.BigEndian.Uint32(b[16:]))
+	case len(b) >= 32 && b[0] == 1:
+		scale, dur = binary.BigEndian.Uint32(b[20:]), binary.BigEndian.Uint64(b[24:])
+	}
+	if scale == 0 {
+		return 0
+	}
+	return float64(dur) / float64(scale)
+}
+
+// tkhdSize() returns the width and height of a track, from the body of its
+// tkhd box, where they're the last two fields, as 16.16 fixed point numbers.
+// Tracks without a picture, such as audio, have a size of 0.
+func tkhdSize(b []byte) (int, int) {
+	if len(b) < 84 || (b[0] == 1 && len(b) < 96) {
+		return 0, 0
+	}
+	end := 84
+	if b[0] == 1 {
+		end = 96
+	}
+	return int(binary.BigEndian.Uint32(b[end-8:]) >> 16), int(binary.BigEndian.Uint32(b[end-4:]) >> 16)
+}
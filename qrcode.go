@@ -0,0 +1,495 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// qrcode.go is a small QR code encoder, used to display the otpauth:// URI
+// when a user enrolls in two-factor authentication. It only does what we need:
+// byte mode, error correction level M, and versions 1 through 10, which is
+// plenty for a URI of a couple hundred characters. The output is an SVG that
+// can be dropped straight into the page.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// qrBlocks describes the error correction block structure of a QR version at
+// level M: the number of EC codewords per block, and the number of data
+// codewords in each block.
+type qrBlocks struct {
+	ec   int
+	data []int
+}
+
+// qrVersions holds the level M block structure for versions 1 through 10,
+// indexed by version.
+var qrVersions = []qrBlocks{
+	{},
+	{10, []int{16}},
+	{16, []int{28}},
+	{26, []int{44}},
+	{18, []int{32, 32}},
+	{24, []int{43, 43}},
+	{16, []int{27, 27, 27, 27}},
+	{18, []int{31, 31, 31, 31}},
+	{22, []int{38, 38, 39, 39}},
+	{22, []int{36, 36, 36, 37, 37}},
+	{26, []int{43, 43, 43, 43, 44}},
+}
+
+// qrAlignment holds the alignment pattern center coordinates for versions 1
+// through 10, indexed by version.
+var qrAlignment = [][]int{
+	{}, {}, {6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34},
+	{6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50},
+}
+
+// qrCode is an encoded QR symbol. modules[y][x] is true for dark modules.
+type qrCode struct {
+	size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+// qrSVG() encodes text as a QR code and returns it as an SVG image.
+func qrSVG(text string) (string, error) {
+	q, err := qrEncode([]byte(text))
+	if err != nil {
+		return "", err
+	}
+	// Leave a four module quiet zone around the symbol.
+	var b strings.Builder
+	dim := q.size + 8
+	fmt.Fprintf(&b, "<svg xmlns='http://www.w3.org/2000/svg' "+
+		"viewBox='0 0 %d %d' shape-rendering='crispEdges'>"+
+		"<rect width='100%%' height='100%%' fill='#fff'/><path d='", dim, dim)
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				fmt.Fprintf(&b, "M%d,%dh1v1h-1z", x+4, y+4)
+			}
+		}
+	}
+	b.WriteString("' fill='#000'/></svg>")
+	return b.String(), nil
+}
+
+// qrEncode() encodes data in byte mode using the smallest version that fits,
+// and the mask with the lowest penalty.
+func qrEncode(data []byte) (*qrCode, error) {
+	version := 0
+	for v := 1; v < len(qrVersions); v++ {
+		capacity := 0
+		for _, n := range qrVersions[v].data {
+			capacity += n
+		}
+		// mode indicator (4 bits) + character count + data.
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+len(data)*8 <= capacity*8 {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, errors.New("qr: data too long")
+	}
+
+	q := &qrCode{size: version*4 + 17}
+	q.modules = make([][]bool, q.size)
+	q.function = make([][]bool, q.size)
+	for i := range q.modules {
+		q.modules[i] = make([]bool, q.size)
+		q.function[i] = make([]bool, q.size)
+	}
+	q.drawFunctionPatterns(version)
+	q.drawCodewords(qrCodewords(data, version))
+
+	// Try each mask, keeping the one with the lowest penalty.
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormat(mask)
+		if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		q.applyMask(mask) // masks are their own inverse.
+	}
+	q.applyMask(best)
+	q.drawFormat(best)
+	return q, nil
+}
+
+// qrCodewords() builds the data codewords for the version, splits them into
+// blocks, appends the error correction codewords, and interleaves the result.
+func qrCodewords(data []byte, version int) []byte {
+	blocks := qrVersions[version]
+	capacity := 0
+	for _, n := range blocks.data {
+		capacity += n
+	}
+
+	// Mode indicator, character count, data, then terminator and padding.
+	var bits []bool
+	put := func(v, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, (v>>i)&1 == 1)
+		}
+	}
+	put(0x4, 4)
+	if version >= 10 {
+		put(len(data), 16)
+	} else {
+		put(len(data), 8)
+	}
+	for _, c := range data {
+		put(int(c), 8)
+	}
+	put(0, min(4, capacity*8-len(bits)))
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+	codewords := make([]byte, 0, capacity)
+	for i := 0; i < len(bits); i += 8 {
+		var c byte
+		for j := 0; j < 8; j++ {
+			if bits[i+j] {
+				c |= 1 << (7 - j)
+			}
+		}
+		codewords = append(codewords, c)
+	}
+	for pad := byte(0xEC); len(codewords) < capacity; pad ^= 0xEC ^ 0x11 {
+		codewords = append(codewords, pad)
+	}
+
+	// Split into blocks and compute the error correction for each.
+	divisor := rsDivisor(blocks.ec)
+	var dataBlocks, ecBlocks [][]byte
+	for _, n := range blocks.data {
+		dataBlocks = append(dataBlocks, codewords[:n])
+		ecBlocks = append(ecBlocks, rsRemainder(codewords[:n], divisor))
+		codewords = codewords[n:]
+	}
+
+	// Interleave the data codewords, then the EC codewords.
+	var out []byte
+	longest := blocks.data[len(blocks.data)-1]
+	for i := 0; i < longest; i++ {
+		for _, b := range dataBlocks {
+			if i < len(b) {
+				out = append(out, b[i])
+			}
+		}
+	}
+	for i := 0; i < blocks.ec; i++ {
+		for _, b := range ecBlocks {
+			out = append(out, b[i])
+		}
+	}
+	return out
+}
+
+// rsMultiply() multiplies two elements of GF(2^8) modulo x^8+x^4+x^3+x^2+1.
+func rsMultiply(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// rsDivisor() returns the Reed-Solomon generator polynomial of the degree,
+// highest coefficient first, with the leading 1 omitted.
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = rsMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = rsMultiply(root, 0x02)
+	}
+	return result
+}
+
+// rsRemainder() returns the Reed-Solomon error correction codewords for data.
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i := range result {
+			result[i] ^= rsMultiply(divisor[i], factor)
+		}
+	}
+	return result
+}
+
+// set() sets a function module, which data and masking will skip over.
+func (q *qrCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+// drawFunctionPatterns() draws the finder, timing and alignment patterns,
+// reserves the format area, and draws the version information if needed.
+func (q *qrCode) drawFunctionPatterns(version int) {
+	for i := 0; i < q.size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+
+	for _, c := range [][2]int{{3, 3}, {q.size - 4, 3}, {3, q.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x < 0 || y < 0 || x >= q.size || y >= q.size {
+					continue
+				}
+				d := max(abs(dx), abs(dy))
+				q.set(x, y, d != 2 && d != 4)
+			}
+		}
+	}
+
+	pos := qrAlignment[version]
+	for i, cx := range pos {
+		for j, cy := range pos {
+			// skip the three corners occupied by finder patterns.
+			last := len(pos) - 1
+			if (i == 0 && j == 0) || (i == 0 && j == last) ||
+				(i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(cx+dx, cy+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// reserve the format area, it's filled in by drawFormat().
+	q.drawFormat(0)
+
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := (bits>>i)&1 == 1
+			a, b := q.size-11+i%3, i/3
+			q.set(a, b, dark)
+			q.set(b, a, dark)
+		}
+	}
+}
+
+// drawFormat() draws both copies of the format information for error
+// correction level M and the mask, along with the dark module.
+func (q *qrCode) drawFormat(mask int) {
+	data := 0<<3 | mask // level M is 00.
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>i)&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true)
+}
+
+// drawCodewords() places the codewords in the zigzag order, skipping over
+// function modules.
+func (q *qrCode) drawCodewords(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if !q.function[y][x] && i < len(data)*8 {
+					q.modules[y][x] = (data[i>>3]>>(7-i&7))&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask() XORs the data modules with the mask pattern.
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty() scores the symbol using the four penalty rules from the
+// specification. Lower is better.
+func (q *qrCode) penalty() (p int) {
+	at := func(x, y int, row bool) bool {
+		if row {
+			return q.modules[y][x]
+		}
+		return q.modules[x][y]
+	}
+	finder := []bool{true, false, true, true, true, false, true}
+	for _, row := range []bool{true, false} {
+		for a := 0; a < q.size; a++ {
+			// Rule 1: runs of five or more same colored modules.
+			run := 1
+			for b := 1; b < q.size; b++ {
+				if at(b, a, row) == at(b-1, a, row) {
+					run++
+					if run == 5 {
+						p += 3
+					} else if run > 5 {
+						p++
+					}
+				} else {
+					run = 1
+				}
+			}
+			// Rule 3: finder-like patterns with four light modules
+			// on either side.
+			for b := 0; b+7 <= q.size; b++ {
+				match := true
+				for k, dark := range finder {
+					if at(b+k, a, row) != dark {
+						match = false
+						break
+					}
+				}
+				if match && (q.light(b-4, b, a, row) ||
+					q.light(b+7, b+11, a, row)) {
+					p += 40
+				}
+			}
+		}
+	}
+
+	// Rule 2: 2x2 blocks of the same color.
+	dark := 0
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < q.size && y+1 < q.size {
+				c := q.modules[y][x]
+				if c == q.modules[y][x+1] && c == q.modules[y+1][x] &&
+					c == q.modules[y+1][x+1] {
+					p += 3
+				}
+			}
+		}
+	}
+
+	// Rule 4: the balance of dark and light modules.
+	total := q.size * q.size
+	k := (abs(dark*20-total*10) + total - 1) / total
+	return p + (k-1)*10
+}
+
+// light() reports whether the modules from a to b (exclusive) along the row
+// or column are all light. Modules outside the symbol count as light.
+func (q *qrCode) light(a, b, line int, row bool) bool {
+	for i := a; i < b; i++ {
+		if i < 0 || i >= q.size {
+			continue
+		}
+		if row && q.modules[line][i] || !row && q.modules[i][line] {
+			return false
+		}
+	}
+	return true
+}
+
+// abs() returns the absolute value of an int.
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
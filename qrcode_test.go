@@ -0,0 +1,155 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// qrWant is the symbol for qrURI, made by rsc.io/qr at version 7, level M,
+// with mask 7, which has the lowest penalty. '#' is a dark module.
+var qrWant = []string{
+	"#######...##..#....##.....###.#.##..#.#######",
+	"#.....#....####..#...##...#.###..#.#..#.....#",
+	"#.###.#..#.#...#...#.##.#......#...#..#.###.#",
+	"#.###.#....##.#.##.###.#..#..#.....##.#.###.#",
+	"#.###.#..##...#.##.######.#..####.###.#.###.#",
+	"#.....#.#####..##..##...#.#...#.#.....#.....#",
+	"#######.#.#.#.#.#.#.#.#.#.#.#.#.#.#.#.#######",
+	".........##..#.....##...#....####..#.........",
+	"#..#.##.##.###..###.#####..#####.#...#.#.....",
+	"###....#.###..#......###.........#..........#",
+	"..#######...##...#####.#.#.##...#.##...#.##.#",
+	"........####..####......##..#..#.#...##.##...",
+	".#..####.#..#.#.#.#....#..#.#.####....####.#.",
+	"##..##.#.#......#.########.....#..#..#..#...#",
+	"....#.#....#.#..##.####.#.#..##....#..######.",
+	"..#.#...##.##.#.#..#.#.##..##.#.#...#..##...#",
+	".##..##.#.##.##..##.##..##.#.#..##...#...#.##",
+	".##.#.....#######.#...#...##.#.##.....####...",
+	"##....######.###..#...####.#..###......######",
+	"..###......##..###.#..#.#........#####.....#.",
+	"##..#####.###.#.###.#####..##..#.#.#######..#",
+	".#.##...#.##..##.##.#...#.......#..##...#..##",
+	"#####.#.##..#...##..#.#.#.#.#..###.##.#.#.#.#",
+	"##..#...#...#..#..###...#..##..##.#.#...##.##",
+	"#.#.#######.#.##.#..#####.########..######..#",
+	"#.##.......###..##.###.#.#..#..#..#.....###.#",
+	"..###.#.##.#.####.#.#.##..#.##.###.....#####.",
+	"...###.#...#.....#........##...##.#.#.#.#...#",
+	"..#.#####.#..#.#..##......##.##.###...###..##",
+	".#..#....#.#.##.##.##.#.####.#.....#.##......",
+	"###.####.##.###...#..#..##..#.##....######.##",
+	"#####..##..##..#..#....#...#...##.#...####..#",
+	"###.#.#..#.#.#..##..#####..##.##.###.##....#.",
+	".##....###....#..#...###...#....#..###...#.##",
+	"....#.###.##.#.###.#####.#...#...##...#.##..#",
+	".####...###...###..#.###.#.####....#.#.#.#...",
+	"#..##.#.#.##.###.#..#####.####..##..######.##",
+	"........#...###..#..#...##.#...#..###...##.##",
+	"#######..##.....#..##.#.##..#...#####.#.###..",
+	"#.....#.#..#.###...##...#..##.#.#..##...#..#.",
+	"#.###.#..##...#..########.##.####..######...#",
+	"#.###.#.##...#.##...#.##.###.#.#.....#..#....",
+	"#.###.#..#...###.#..#.####...#..#..####.#####",
+	"#.....#..##..##..##.##...##.#####....#..#....",
+	"#######.#.#...#.#.##.##.##.####..##..###.#.#.",
+}
+
+// qrURI is an enrollment URI like those from totpURI().
+const qrURI = "otpauth://totp/Example:alice%40example.com?algorithm=SHA1" +
+	"&digits=6&issuer=Example&period=30&secret=JBSWY3DPEHPK3PXP"
+
+func TestQREncode(t *testing.T) {
+	q, err := qrEncode([]byte(qrURI))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.size != len(qrWant) {
+		t.Fatalf("size = %d, want %d", q.size, len(qrWant))
+	}
+	for y, row := range q.modules {
+		var b strings.Builder
+		for _, dark := range row {
+			if dark {
+				b.WriteByte('#')
+			} else {
+				b.WriteByte('.')
+			}
+		}
+		if got := b.String(); got != qrWant[y] {
+			t.Errorf("row %d:\n got %s\nwant %s", y, got, qrWant[y])
+		}
+	}
+}
+
+// TestQRVersion checks the smallest version which fits is used, at the
+// byte mode capacities for level M.
+func TestQRVersion(t *testing.T) {
+	for _, tt := range []struct {
+		n, size int
+	}{
+		{1, 21},
+		{14, 21},
+		{15, 25},
+		{26, 25},
+		{27, 29},
+		{213, 57},
+	} {
+		q, err := qrEncode([]byte(strings.Repeat("a", tt.n)))
+		if err != nil {
+			t.Errorf("%d bytes: %v", tt.n, err)
+			continue
+		}
+		if q.size != tt.size {
+			t.Errorf("%d bytes: size = %d, want %d", tt.n, q.size, tt.size)
+		}
+	}
+	if _, err := qrEncode([]byte(strings.Repeat("a", 214))); err == nil {
+		t.Error("214 bytes: no error")
+	}
+}
+
+func TestQRSVG(t *testing.T) {
+	svg, err := qrSVG(qrURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The symbol, plus a four module quiet zone either side.
+	if !strings.Contains(svg, "viewBox='0 0 53 53'") {
+		t.Errorf("svg has the wrong size: %.80s", svg)
+	}
+	dark := 0
+	for _, row := range qrWant {
+		dark += strings.Count(row, "#")
+	}
+	if n := strings.Count(svg, "h1v1h-1z"); n != dark {
+		t.Errorf("svg has %d dark modules, want %d", n, dark)
+	}
+}
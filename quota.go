@@ -0,0 +1,151 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// quota.go houses per-user storage accounting. Each user's usage, the bytes
+// and number of files they've uploaded, is kept in redis, charged when a post
+// with attachments is saved and refunded when it's removed. Files shared
+// with other posts are charged to each, as each user uploaded them.
+//
+// Quotas are set by role, and may be changed for each role in the "quotas"
+// section of bolt.conf.json. A limit of zero means no limit.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// storage{} is an amount of storage, either used or allowed.
+type storage struct {
+	Bytes int64 `json:"bytes" redis:"bytes"`
+	Files int64 `json:"files" redis:"files"`
+}
+
+// defaultQuotas are the quotas for each role, unless bolt.conf.json sets
+// them.
+var defaultQuotas = map[string]storage{
+	"user":      {Bytes: 1 << 30, Files: 1000},
+	"trusted":   {Bytes: 5 << 30, Files: 5000},
+	"moderator": {Bytes: 20 << 30, Files: 20000},
+	"admin":     {},
+}
+
+// errQuotaExceeded is returned for uploads which would take a user over
+// their quota.
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// quotaFor() returns the quota for the users role.
+func quotaFor(u *user) storage {
+	name := roleName(u.Level)
+	if q, ok := appConf.Quotas[name]; ok {
+		return q
+	}
+	return defaultQuotas[name]
+}
+
+// fits() reports whether used plus more is within the quota q.
+func (q storage) fits(used, more storage) bool {
+	return (q.Bytes <= 0 || used.Bytes+more.Bytes <= q.Bytes) &&
+		(q.Files <= 0 || used.Files+more.Files <= q.Files)
+}
+
+// storage() returns the storage used by the posts attachments.
+func (p *post) storage() storage {
+	var s storage
+	for _, a := range p.Attachments {
+		s.Bytes += a.Size
+		s.Files++
+	}
+	return s
+}
+
+// checkQuota() returns errQuotaExceeded if more won't fit in the users
+// quota, along with their unfinished resumable uploads. It's checked before
+// an upload is accepted, and the usage charged once it's been stored.
+// see: chargeUsage()
+func checkQuota(c *credentials, more storage) error {
+	used, err := usedWithPending(c.User.ID)
+	if err != nil {
+		return err
+	}
+	if !quotaFor(c.User).fits(used, more) {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// usedWithPending() returns the storage the user is using, plus what their
+// unfinished resumable uploads have reserved.
+func usedWithPending(id string) (storage, error) {
+	used, err := getUsage(id)
+	if err != nil {
+		return used, err
+	}
+	pending, err := getPendingUsage(id)
+	used.Bytes += pending.Bytes
+	used.Files += pending.Files
+	return used, err
+}
+
+// quotaMessage() tells the user which of their limits more would exceed.
+func quotaMessage(c *credentials, more storage) string {
+	q := quotaFor(c.User)
+	used, err := usedWithPending(c.User.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	if q.Files > 0 && used.Files+more.Files > q.Files {
+		return fmt.Sprintf("Out Of Storage, You've Uploaded %d Of %d Files", used.Files, q.Files)
+	}
+	return fmt.Sprintf("Out Of Storage, You've Used %dMB Of %dMB", used.Bytes>>20, q.Bytes>>20)
+}
+
+// storageHandler() is the route handler which tells a user how much storage
+// they've used, and their quota. see: userprofile.js
+func storageHandler(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	if !c.IsLoggedIn {
+		log.Println(status(w, "Not Logged In", nil))
+		return
+	}
+	used, err := getUsage(c.User.ID)
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	ajaxResponse(w, map[string]string{
+		"status":      "success",
+		"role":        roleName(c.User.Level),
+		"bytes":       fmt.Sprint(used.Bytes),
+		"files":       fmt.Sprint(used.Files),
+		"quota_bytes": fmt.Sprint(quotaFor(c.User).Bytes),
+		"quota_files": fmt.Sprint(quotaFor(c.User).Files),
+	})
+}
@@ -0,0 +1,146 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// ratelimit.go houses the per-user rate limiter. Each action a user can take
+// has a token bucket in redis, which holds up to Burst tokens and refills at
+// a steady rate, so Burst actions may be taken every Per. Each action takes a
+// token, and once the bucket is empty the user must wait for it to refill.
+//
+// Budgets grow with the users role, and can be adjusted for a single user by
+// an admin with user.Throttle. Actions taken before signing in, such as
+// signup and signin, are limited by IP address instead.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+// maxThrottle is the most an admin may raise a users budgets, as a percentage.
+const maxThrottle = 1000
+
+// rateLimit{} is the budget for an action.
+type rateLimit struct {
+	Burst int
+	Per   time.Duration
+}
+
+// rateLimits are the budgets for each action, for users with the "user"
+// role.
+var rateLimits = map[string]rateLimit{
+	"post":   {10, time.Hour},
+	"reply":  {30, time.Hour},
+	"like":   {120, time.Hour},
+	"follow": {60, time.Hour},
+	"signup": {5, time.Hour},
+	"signin": {30, 10 * time.Minute},
+	"upload": {20, time.Hour},
+	// Large uploads are sent in many chunks. see: resumable.go
+	"chunk": {1000, time.Hour},
+}
+
+// roleRateMultipliers scale the budgets by role, indexed by level.
+var roleRateMultipliers = []float64{1, 3, 10, 10}
+
+// budget() returns the budget for the user taking action. Throttle, if set,
+// is a percentage of the normal budget: 50 halves it, and 200 doubles it.
+func budget(action string, u *user) rateLimit {
+	l := rateLimits[action]
+	if u == nil {
+		return l
+	}
+	m := roleRateMultipliers[max(roleUser, min(u.Level, roleAdmin))]
+	if u.Throttle > 0 {
+		m *= float64(u.Throttle) / 100
+	}
+	l.Burst = max(1, int(math.Round(float64(l.Burst)*m)))
+	return l
+}
+
+// rateLimited is used as a middleware function, inside of checkAuth() when
+// there is one, for routes that take action. Requests over budget are
+// answered with 429 Too Many Requests, and a Retry-After header saying how
+// many seconds to wait.
+func rateLimited(action string, next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subject, u := "IP:"+clientIP(r), (*user)(nil)
+		if c, ok := r.Context().Value(ctxkey).(*credentials); ok && c.IsLoggedIn {
+			subject, u = c.User.ID, c.User
+		}
+
+		ok, wait, err := takeToken(action, subject, budget(action, u))
+		if err != nil {
+			// let the request through rather than take the site
+			// down with redis.
+			log.Println(err)
+		}
+		if err == nil && !ok {
+			secs := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", fmt.Sprint(secs))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			ajaxResponse(w, map[string]string{
+				"status":      fmt.Sprintf("Slow Down, Try Again In %ds", secs),
+				"retry_after": fmt.Sprint(secs),
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// throttleChange{} is the request body sent by an admin to adjust a users
+// rate limits.
+type throttleChange struct {
+	ID       string `json:"id"`
+	Throttle int    `json:"throttle"`
+}
+
+// setThrottleHandler() is the route handler used by admins to adjust a users
+// rate limits, as a percentage of the budgets for their role.
+func setThrottleHandler(w http.ResponseWriter, r *http.Request) {
+	tc := new(throttleChange)
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(tc); err != nil {
+		log.Println(status(w, "Invalid Request", err))
+		return
+	}
+	if tc.Throttle < 0 || tc.Throttle > maxThrottle {
+		log.Println(status(w, fmt.Sprintf("Throttle Must Be 0-%d%%", maxThrottle), nil))
+		return
+	}
+	if err := setThrottle(tc.ID, tc.Throttle); err != nil {
+		log.Println(status(w, "Couldn't Set Throttle", err))
+		return
+	}
+	log.Println(status(w, "success", nil))
+}
@@ -0,0 +1,346 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// resumable.go houses the route handlers for resumable uploads, used for
+// large files, which often fail partway over a poor connection. The client
+// starts an upload with its size, then sends it in chunks, each saying where
+// in the file it starts. If a chunk fails, the client asks how much arrived
+// and carries on from there. Once it's all arrived, the post is submitted
+// to /uploadItem as usual, with the uploads ID in place of the file.
+// Uploads are kept in uploadDir, out of public view, and are abandoned
+// after uploadTTL without a chunk.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// uploadDir is where resumable uploads are kept while they arrive.
+	uploadDir = "uploads"
+	// uploadTTL is how long an upload is kept after its last chunk.
+	uploadTTL = 24 * time.Hour
+	// maxChunkSize is the largest chunk we accept, and the size the
+	// client sends.
+	maxChunkSize = 8 << 20
+	// chunkLockTTL is how long a chunk may take to arrive, before another
+	// attempt at it may be written.
+	chunkLockTTL = 5 * time.Minute
+)
+
+// errUploadUnfinished is returned when a post is submitted with an upload
+// which hasn't all arrived, or doesn't exist.
+var errUploadUnfinished = errors.New("upload unfinished")
+
+// startRequest{} is the request body sent by the client when starting a
+// resumable upload.
+type startRequest struct {
+	Size int64 `json:"size"`
+}
+
+// startUpload() is the route handler for /startUpload. It makes room for an
+// upload of the size given, and responds with its ID.
+func startUpload(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	var sr startRequest
+	if err := json.NewDecoder(r.Body).Decode(&sr); err != nil {
+		log.Println(status(w, "Invalid Request", err))
+		return
+	}
+	if sr.Size <= 0 || sr.Size > maxUploadSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		log.Println(status(w, fmt.Sprintf("File Too Large, The Limit Is %dMB", maxUploadSize>>20), nil))
+		return
+	}
+
+	u := &resumable{
+		ID:      genID(15),
+		Owner:   c.User.ID,
+		Size:    sr.Size,
+		Created: time.Now().Unix(),
+	}
+
+	// The size of the upload is reserved from the users quota while it's
+	// sent, so uploads started together can't add up to more than it.
+	// Uploads which won't fit are refused before they're sent.
+	// see: quota.go
+	ok, err := reserveUploadUsage(u, quotaFor(c.User), uploadTTL)
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	if !ok {
+		more := storage{Bytes: sr.Size, Files: 1}
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		log.Println(status(w, quotaMessage(c, more), errQuotaExceeded))
+		return
+	}
+	if err = os.MkdirAll(uploadDir, 0700); err != nil {
+		abandonUpload(u)
+		log.Println(status(w, "Upload Error", err))
+		return
+	}
+	f, err := os.Create(filepath.Join(uploadDir, u.ID))
+	if err != nil {
+		abandonUpload(u)
+		log.Println(status(w, "Upload Error", err))
+		return
+	}
+	f.Close()
+	if err = setUpload(u, uploadTTL); err != nil {
+		abandonUpload(u)
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	ajaxResponse(w, map[string]string{
+		"status":     "success",
+		"id":         u.ID,
+		"offset":     "0",
+		"chunk_size": strconv.Itoa(maxChunkSize),
+	})
+}
+
+// ownUpload() returns the upload with the ID at the end of the path, if it
+// belongs to the user. Anyone else is told it doesn't exist.
+func ownUpload(w http.ResponseWriter, r *http.Request) (*credentials, *resumable, bool) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	if !c.IsLoggedIn {
+		log.Println(status(w, "Not Logged In", nil))
+		return nil, nil, false
+	}
+	id := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	u, err := getUpload(id)
+	if err == redis.Nil || (err == nil && u.Owner != c.User.ID) {
+		w.WriteHeader(http.StatusNotFound)
+		log.Println(status(w, "Upload Not Found", nil))
+		return nil, nil, false
+	}
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return nil, nil, false
+	}
+	return c, u, true
+}
+
+// uploadChunk() is the route handler for /uploadChunk/[id]. The chunk is the
+// request body, and the Upload-Offset header says where in the file it
+// starts, which must be where the last one ended. Whatever part of a chunk
+// arrives is kept, even if the connection drops partway through it.
+func uploadChunk(w http.ResponseWriter, r *http.Request) {
+	_, u, ok := ownUpload(w, r)
+	if !ok {
+		return
+	}
+	if ok, err := lockUpload(u.ID, chunkLockTTL); err != nil || !ok {
+		w.WriteHeader(http.StatusConflict)
+		log.Println(status(w, "Upload In Progress", err))
+		return
+	}
+	defer func() {
+		if err := unlockUpload(u.ID); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != u.Offset {
+		// The client tells where it thinks the upload is up to, and
+		// carries on from where it actually is.
+		w.WriteHeader(http.StatusConflict)
+		ajaxResponse(w, map[string]string{
+			"status": "Wrong Offset",
+			"offset": strconv.FormatInt(u.Offset, 10),
+		})
+		return
+	}
+
+	f, err := os.OpenFile(filepath.Join(uploadDir, u.ID), os.O_WRONLY, 0)
+	if err != nil {
+		log.Println(status(w, "Upload Error", err))
+		return
+	}
+	defer f.Close()
+	// Drop anything past the offset, left by a chunk which was written
+	// but never recorded.
+	if err = f.Truncate(offset); err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		log.Println(status(w, "Upload Error", err))
+		return
+	}
+	n, err := io.Copy(f, io.LimitReader(r.Body, u.Size-offset+1))
+	if offset+n > u.Size {
+		f.Truncate(offset)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		log.Println(status(w, "Upload Larger Than Its Size", nil))
+		return
+	}
+	if aerr := advanceUpload(u, offset+n, uploadTTL); aerr != nil {
+		log.Println(status(w, "Database Error", aerr))
+		return
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		log.Println(status(w, fmt.Sprintf("Chunk Too Large, The Limit Is %dMB", maxChunkSize>>20), err))
+		return
+	}
+	if err != nil {
+		log.Println(status(w, "Upload Error", err))
+		return
+	}
+	ajaxResponse(w, map[string]string{
+		"status": "success",
+		"offset": strconv.FormatInt(offset+n, 10),
+	})
+}
+
+// uploadStatus() is the route handler for /uploadStatus/[id], which the
+// client uses to find where to resume an upload from.
+func uploadStatus(w http.ResponseWriter, r *http.Request) {
+	_, u, ok := ownUpload(w, r)
+	if !ok {
+		return
+	}
+	ajaxResponse(w, map[string]string{
+		"status": "success",
+		"offset": strconv.FormatInt(u.Offset, 10),
+		"size":   strconv.FormatInt(u.Size, 10),
+	})
+}
+
+// cancelUpload() is the route handler for /cancelUpload/[id], used when the
+// user gives up on an upload.
+func cancelUpload(w http.ResponseWriter, r *http.Request) {
+	_, u, ok := ownUpload(w, r)
+	if !ok {
+		return
+	}
+	if _, err := deleteUpload(u.ID); err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	abandonUpload(u)
+	log.Println(status(w, "success", nil))
+}
+
+// abandonUpload() removes an upload which won't be finished, and gives back
+// the quota it reserved.
+func abandonUpload(u *resumable) {
+	if err := releaseUploadUsage(u); err != nil {
+		log.Println(err)
+	}
+	err := os.Remove(filepath.Join(uploadDir, u.ID))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Println(err)
+	}
+}
+
+// finishUpload() is used by parseForm() for posts submitted with the ID of a
+// resumable upload, in place of a file. Once the upload has all arrived, it
+// is checked and stored like any other, and its attachment{} returned.
+// see: handleFile()
+func finishUpload(c *credentials, id string) (*attachment, error) {
+	u, err := getUpload(id)
+	if err == redis.Nil || (err == nil && (u.Owner != c.User.ID || u.Offset != u.Size)) {
+		return nil, errUploadUnfinished
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The upload is forgotten first, so it can't be used twice. Its
+	// reservation is let go, as the post is charged for what's stored.
+	// see: uploadHandler()
+	if ok, err := deleteUpload(id); err != nil || !ok {
+		if err == nil {
+			err = errUploadUnfinished
+		}
+		return nil, err
+	}
+	if err = releaseUploadUsage(u); err != nil {
+		log.Println(err)
+	}
+	path := filepath.Join(uploadDir, u.ID)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	f.Close()
+	if err != nil && err != io.ErrUnexpectedEOF {
+		os.Remove(path)
+		return nil, err
+	}
+	// Only the media types in the registry are accepted. see: media.go
+	mt, err := sniffMedia(head[:n])
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	if err = os.Rename(path, path+"."+mt.Ext); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return storeMedia(path+"."+mt.Ext, mt)
+}
+
+// cleanUploads() removes uploads abandoned for uploadTTL. It's run
+// periodically from main().
+func cleanUploads() {
+	entries, err := os.ReadDir(uploadDir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Println(err)
+		}
+		return
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < uploadTTL {
+			continue
+		}
+		if err = os.Remove(filepath.Join(uploadDir, e.Name())); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// roles.go houses role-based access control. Each user has a role, stored as
+// user.Level, which decides what they're allowed to do. Roles are ordered, so
+// each role may do everything the roles below it may:
+//   - user:      anyone who signed up
+//   - trusted:   users in good standing, who get looser limits
+//   - moderator: users who act on reports and moderate posts
+//   - admin:     users who manage roles and the site
+//
+// The first admin is granted from the command line:
+//
+//	./tagmachine grant-admin someone@example.com
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const (
+	roleUser int = iota
+	roleTrusted
+	roleModerator
+	roleAdmin
+)
+
+// roleNames are the names of the roles, indexed by their level.
+var roleNames = []string{"user", "trusted", "moderator", "admin"}
+
+// roleName() returns the name of the role at level, clamping unknown levels
+// to the nearest role.
+func roleName(level int) string {
+	return roleNames[max(roleUser, min(level, roleAdmin))]
+}
+
+// roleByName() returns the level of the named role.
+func roleByName(name string) (int, bool) {
+	level := slices.Index(roleNames, name)
+	return level, level >= 0
+}
+
+// hasRole() reports whether the user has at least the given role. Requests
+// made with an API token also need the tokens "admin" scope to act with any
+// role above user.
+func hasRole(c *credentials, role int) bool {
+	if c == nil || !c.IsLoggedIn || c.User.Level < role {
+		return false
+	}
+	return role <= roleTrusted || c.Scopes == nil || slices.Contains(c.Scopes, "admin")
+}
+
+// requireRole is used as a middleware function, inside of checkAuth(), for
+// routes only users with at least the given role may use.
+func requireRole(role int, next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := r.Context().Value(ctxkey).(*credentials)
+		if !ok || !c.IsLoggedIn {
+			w.WriteHeader(http.StatusUnauthorized)
+			log.Println(status(w, "Not Logged In", nil))
+			return
+		}
+		if !hasRole(c, role) {
+			w.WriteHeader(http.StatusForbidden)
+			log.Println(status(w, "Forbidden", nil))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminHandler() is the route handler for the admin page, which lists users
+// along with their roles, and the users on the waitlist.
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := getUsers(0, 99)
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	waitlist, err := getWaitlist(0, 99)
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	exeTmpl(w, r, &viewData{Users: users, Waitlist: waitlist}, "admin.html")
+}
+
+// roleChange{} is the request body sent by an admin to change a users role.
+type roleChange struct {
+	ID   string `json:"id"`
+	Role string `json:"role"`
+}
+
+// setRoleHandler() is the route handler used by admins to change a users
+// role. Admins can't change their own role, so there's always at least one.
+func setRoleHandler(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	rc := new(roleChange)
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(rc); err != nil {
+		log.Println(status(w, "Invalid Request", err))
+		return
+	}
+	level, ok := roleByName(rc.Role)
+	if !ok {
+		log.Println(status(w, "Unknown Role", nil))
+		return
+	}
+	if rc.ID == c.User.ID {
+		log.Println(status(w, "You Can't Change Your Own Role", nil))
+		return
+	}
+	if err := setRole(rc.ID, level); err != nil {
+		log.Println(status(w, "Couldn't Set Role", err))
+		return
+	}
+	log.Println(status(w, "success", nil))
+}
+
+// grantAdmin() makes the user with the given login email an admin. It's run
+// from the command line to bootstrap the first admin. see: main()
+func grantAdmin(email string) error {
+	email = strings.ToLower(email)
+	if !validEmail(email) {
+		return errors.New("invalid email: " + email)
+	}
+	id, err := getIDByEmail(email)
+	if err != nil {
+		return fmt.Errorf("no user with email %s: %w", email, err)
+	}
+	return setRole(id, roleAdmin)
+}
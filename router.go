@@ -44,7 +44,10 @@ func bolt() (ctx context.Context, srv *http.Server) {
 
 	// Tell the server /public is accessible to the world wide web.
 	mux.Handle("/public/", http.StripPrefix("/public/", http.FileServer(http.Dir("public"))))
-	srv = serverFromConf(mux)
+	// Media blobs are served, or redirected to, by the blobStore{}.
+	// see: storage.go
+	mux.HandleFunc("/"+blobDir+"/", mediaHandler)
+	srv = serverFromConf(checkOrigin(limitBody(mux)))
 
 	ctx, cancelCtx := context.WithCancel(context.Background())
 	go func() {
@@ -57,8 +60,9 @@ func bolt() (ctx context.Context, srv *http.Server) {
 }
 
 // serverFromConf() returns a *http.Server with a pre-defined configuration
-// using the multiplexer at the bottom of this file.
-func serverFromConf(mux *http.ServeMux) *http.Server {
+// using the multiplexer at the bottom of this file, wrapped in any middleware
+// that applies to every route.
+func serverFromConf(mux http.Handler) *http.Server {
 	return &http.Server{
 		// servicePort is in main.go, and configured in bolt.json.conf.
 		Addr:              servicePort,
@@ -71,25 +75,74 @@ func serverFromConf(mux *http.ServeMux) *http.Server {
 
 // registerRoutes registers the routes with the provided *http.ServeMux. Add
 // new routes here as necessary, wrapping the route handler with the
-// checkAuth(handler) middle ware function as needed. Keep the multiplexer at
-// the bottom of this file to allow for the programmatic insertion of routes
-// via external tools.
+// checkAuth(handler) middle ware function as needed. Routes usable with an API
+// token are wrapped with requireScope(), and account routes which aren't are
+// wrapped with requireSession(). Routes which change state are wrapped with
+// requireCSRF(), those only for some roles with requireRole(), and those
+// which take an action a script could repeat with rateLimited(), and those
+// which need a proof-of-work challenge solved with requirePoW(), inside
+// rateLimited() so a challenge isn't spent on a request that's refused. Keep
+// the multiplexer at the bottom of this file to allow for the programmatic
+// insertion of routes via external tools.
 func registerRoutes(mux *http.ServeMux) {
-	mux.HandleFunc("/", checkAuth(root))
-	mux.HandleFunc("/reply", checkAuth(reply))
+	mux.HandleFunc("/", checkAuth(requireScope("read", root)))
+	mux.HandleFunc("/reply", checkAuth(requireScope("post", requireCSRF(requireActive(rateLimited("reply", requirePoW("post", requireVerified(reply))))))))
 	mux.HandleFunc("/what", what)
-	mux.HandleFunc("/signin", signin)
-	mux.HandleFunc("/signup", signup)
-	mux.HandleFunc("/uploadItem", checkAuth(uploadHandler))
-	mux.HandleFunc("/view/", checkAuth(viewItem))
-	mux.HandleFunc("/like/", checkAuth(likeHandler))
-	mux.HandleFunc("/share/", checkAuth(shareHandler))
-	mux.HandleFunc("/addFriend/", checkAuth(addFriendHandler))
-	mux.HandleFunc("/unfriend/", checkAuth(unFriendHandler))
-	mux.HandleFunc("/tag/", checkAuth(tagHandler))
+	mux.HandleFunc("/signin", requireCSRF(rateLimited("signin", signin)))
+	mux.HandleFunc("/signinTOTP", requireCSRF(rateLimited("signin", signinTOTP)))
+	mux.HandleFunc("/challenge", checkAuth(challengeHandler))
+	mux.HandleFunc("/signup", requireCSRF(rateLimited("signup", requirePoW("signup", signup))))
+	mux.HandleFunc("/oidc/login/", checkAuth(requireSession(oidcLogin)))
+	mux.HandleFunc("/oidc/callback/", checkAuth(requireSession(oidcCallback)))
+	mux.HandleFunc("/verify", verify)
+	mux.HandleFunc("/resendVerification", checkAuth(requireSession(requireCSRF(resendVerification))))
+	mux.HandleFunc("/changePassword", checkAuth(requireSession(requireCSRF(changePassword))))
+	mux.HandleFunc("/changeEmail", checkAuth(requireSession(requireCSRF(changeEmailHandler))))
+	mux.HandleFunc("/enrollTOTP", checkAuth(requireSession(requireCSRF(enrollTOTP))))
+	mux.HandleFunc("/confirmTOTP", checkAuth(requireSession(requireCSRF(confirmTOTP))))
+	mux.HandleFunc("/disableTOTP", checkAuth(requireSession(requireCSRF(disableTOTPHandler))))
+	mux.HandleFunc("/apiTokens", checkAuth(requireSession(apiTokensHandler)))
+	mux.HandleFunc("/createToken", checkAuth(requireSession(requireCSRF(createToken))))
+	mux.HandleFunc("/revokeToken/", checkAuth(requireSession(requireCSRF(revokeToken))))
+	mux.HandleFunc("/requestExport", checkAuth(requireSession(requireCSRF(requestExport))))
+	mux.HandleFunc("/exportStatus", checkAuth(requireSession(exportStatus)))
+	mux.HandleFunc("/downloadExport", checkAuth(requireSession(downloadExport)))
+	mux.HandleFunc("/deleteAccount", checkAuth(requireSession(requireCSRF(deleteAccount))))
+	mux.HandleFunc("/admin", checkAuth(requireRole(roleAdmin, adminHandler)))
+	mux.HandleFunc("/setRole", checkAuth(requireRole(roleAdmin, requireCSRF(setRoleHandler))))
+	mux.HandleFunc("/setThrottle", checkAuth(requireRole(roleAdmin, requireCSRF(setThrottleHandler))))
+	mux.HandleFunc("/invites", checkAuth(requireSession(invitesHandler)))
+	mux.HandleFunc("/createInvite", checkAuth(requireSession(requireCSRF(requireActive(createInvite)))))
+	mux.HandleFunc("/revokeInvite/", checkAuth(requireSession(requireCSRF(revokeInvite))))
+	mux.HandleFunc("/approveSignup/", checkAuth(requireRole(roleAdmin, requireCSRF(approveSignup))))
+	mux.HandleFunc("/rejectSignup/", checkAuth(requireRole(roleAdmin, requireCSRF(rejectSignup))))
+	mux.HandleFunc("/report", checkAuth(requireScope("post", requireCSRF(requireActive(reportHandler)))))
+	mux.HandleFunc("/moderation", checkAuth(requireRole(roleModerator, moderationHandler)))
+	mux.HandleFunc("/claimReport/", checkAuth(requireRole(roleModerator, requireCSRF(claimReportHandler))))
+	mux.HandleFunc("/releaseReport/", checkAuth(requireRole(roleModerator, requireCSRF(releaseReportHandler))))
+	mux.HandleFunc("/resolveReport/", checkAuth(requireRole(roleModerator, requireCSRF(resolveReportHandler))))
+	mux.HandleFunc("/moderate", checkAuth(requireRole(roleModerator, requireCSRF(moderateHandler))))
+	mux.HandleFunc("/unblockMedia/", checkAuth(requireRole(roleModerator, requireCSRF(unblockMediaHandler))))
+	mux.HandleFunc("/block/", checkAuth(requireScope("follow", requireCSRF(rateLimited("follow", blockHandler)))))
+	mux.HandleFunc("/unblock/", checkAuth(requireScope("follow", requireCSRF(rateLimited("follow", blockHandler)))))
+	mux.HandleFunc("/mute/", checkAuth(requireScope("follow", requireCSRF(rateLimited("follow", blockHandler)))))
+	mux.HandleFunc("/unmute/", checkAuth(requireScope("follow", requireCSRF(rateLimited("follow", blockHandler)))))
+	mux.HandleFunc("/blocks", checkAuth(requireScope("read", blocksHandler)))
+	mux.HandleFunc("/storage", checkAuth(requireScope("read", storageHandler)))
+	mux.HandleFunc("/uploadItem", checkAuth(requireScope("post", requireCSRF(requireActive(rateLimited("post", requirePoW("post", requireVerified(uploadHandler))))))))
+	mux.HandleFunc("/startUpload", checkAuth(requireScope("post", requireCSRF(requireActive(rateLimited("upload", requireVerified(startUpload)))))))
+	mux.HandleFunc("/uploadChunk/", checkAuth(requireScope("post", requireCSRF(requireActive(rateLimited("chunk", requireVerified(uploadChunk)))))))
+	mux.HandleFunc("/uploadStatus/", checkAuth(requireScope("post", uploadStatus)))
+	mux.HandleFunc("/cancelUpload/", checkAuth(requireScope("post", requireCSRF(cancelUpload))))
+	mux.HandleFunc("/view/", checkAuth(requireScope("read", viewItem)))
+	mux.HandleFunc("/like/", checkAuth(requireScope("like", requireCSRF(requireActive(rateLimited("like", likeHandler))))))
+	mux.HandleFunc("/share/", checkAuth(requireScope("like", requireCSRF(requireActive(rateLimited("like", shareHandler))))))
+	mux.HandleFunc("/addFriend/", checkAuth(requireScope("follow", requireCSRF(requireActive(rateLimited("follow", addFriendHandler))))))
+	mux.HandleFunc("/unfriend/", checkAuth(requireScope("follow", requireCSRF(requireActive(rateLimited("follow", unFriendHandler))))))
+	mux.HandleFunc("/tag/", checkAuth(requireScope("read", tagHandler)))
 	mux.HandleFunc("/friends/", friendHandler)
 	mux.HandleFunc("/search/", searchHandler)
-	mux.HandleFunc("/user/", checkAuth(profileHandler))
+	mux.HandleFunc("/user/", checkAuth(requireScope("read", profileHandler)))
 	// mux.HandleFunc("/edit", checkAuth(editHandler))
 	// mux.HandleFunc("/likes/", likesHandler)
 }
@@ -0,0 +1,276 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// s3.go houses the s3Store{}, which keeps blobs with an S3-compatible object
+// storage service, such as AWS S3, or MinIO for local development. Requests
+// are signed with AWS Signature Version 4, implemented here rather than
+// pulling in an SDK for the four calls we make. The secret key should be
+// provided as an environment variable (s3secret) at run time, the same way
+// hmacss is.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unsignedPayload is used in place of the hash of request bodies, so uploads
+// can be streamed rather than hashed first.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// s3Store keeps blobs in a bucket of an S3-compatible service.
+type s3Store struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	// pathStyle puts the bucket in the path rather than the host name,
+	// which MinIO and most other stand-ins need.
+	pathStyle bool
+	// publicURL is where the bucket is served from publicly, such as a
+	// CDN, when URLs aren't signed.
+	publicURL string
+	signed    bool
+	expiry    time.Duration
+	client    *http.Client
+}
+
+// newS3Store() returns the s3Store{} described by the configuration.
+func newS3Store(c *config, expiry time.Duration) *s3Store {
+	conf := c.Media.S3
+	endpoint, err := url.Parse(conf.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		log.Panicln("invalid media.s3.endpoint:", conf.Endpoint, err)
+	}
+	region := conf.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &s3Store{
+		endpoint:  endpoint,
+		region:    region,
+		bucket:    conf.Bucket,
+		accessKey: conf.AccessKey,
+		secretKey: os.Getenv("s3secret"),
+		pathStyle: conf.PathStyle,
+		publicURL: strings.TrimSuffix(conf.PublicURL, "/"),
+		signed:    c.Media.SignedURLs,
+		expiry:    expiry,
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+// objectURL() returns the URL of the object key in the bucket.
+func (s *s3Store) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	return &u
+}
+
+// do() makes a signed request for the object key, returning an error for
+// anything but a 2xx response. Objects which don't exist return
+// os.ErrNotExist.
+func (s *s3Store) do(method, key string, body io.Reader, size int64, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(key).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, time.Now())
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 == 2 {
+		return res, nil
+	}
+	defer res.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("s3 %s %s: %w", method, key, os.ErrNotExist)
+	}
+	return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, res.Status, msg)
+}
+
+// put() uploads the blob.
+func (s *s3Store) put(key string, r io.Reader, size int64, contentType string) error {
+	res, err := s.do(http.MethodPut, key, r, size, contentType)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// open() downloads the blob.
+func (s *s3Store) open(key string) (io.ReadCloser, error) {
+	res, err := s.do(http.MethodGet, key, nil, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// remove() removes the blob. S3 doesn't mind removing what isn't there.
+func (s *s3Store) remove(key string) error {
+	res, err := s.do(http.MethodDelete, key, nil, 0, "")
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// url() returns a presigned URL for the blob, which expires, when URLs are
+// signed, or else its public URL.
+func (s *s3Store) url(key string) (string, error) {
+	if s.signed {
+		return s.presign(key, time.Now()), nil
+	}
+	if s.publicURL != "" {
+		return s.publicURL + "/" + key, nil
+	}
+	return s.objectURL(key).String(), nil
+}
+
+// sign() adds the Authorization header to a request, signing its method,
+// path, query and host, along with the x-amz-* headers.
+func (s *s3Store) sign(req *http.Request, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", unsignedPayload)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		"host:" + req.URL.Host + "\n" +
+			"x-amz-content-sha256:" + unsignedPayload + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+	scope, sig := s.signature(canonical, amzDate)
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+sig)
+}
+
+// presign() returns a URL for GETting the object key, signed in its query,
+// which expires after s.expiry.
+func (s *s3Store) presign(key string, t time.Time) string {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	u := s.objectURL(key)
+	q := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {s.accessKey + "/" + s.scope(amzDate)},
+		"X-Amz-Date":          {amzDate},
+		"X-Amz-Expires":       {strconv.Itoa(int(s.expiry.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		canonicalQuery(q),
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	_, sig := s.signature(canonical, amzDate)
+	q.Set("X-Amz-Signature", sig)
+	u.RawQuery = canonicalQuery(q)
+	return u.String()
+}
+
+// scope() returns the credential scope of requests made at amzDate.
+func (s *s3Store) scope(amzDate string) string {
+	return amzDate[:8] + "/" + s.region + "/s3/aws4_request"
+}
+
+// signature() returns the credential scope and the signature of the
+// canonical request, made at amzDate.
+func (s *s3Store) signature(canonical, amzDate string) (string, string) {
+	scope := s.scope(amzDate)
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{amzDate[:8], s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return scope, hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+// hmacSHA256() returns the HMAC-SHA256 of data with key.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery() encodes a query string the way SigV4 expects, sorted by
+// key, with spaces as %20 rather than +.
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string(nil), q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, queryEscape(k)+"="+queryEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// queryEscape() escapes everything but the unreserved characters.
+func queryEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
@@ -0,0 +1,281 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// spam.go houses the spam filter, which screens each new post and reply from
+// users below the trusted role. Each of the spamChecks scores the post, and
+// the scores are added up:
+//   - bayes:       a naive Bayes classifier, trained on moderator decisions
+//   - links:       posts with more than one link
+//   - duplicate:   text that has been posted many times in the last day
+//   - new account: accounts less than a week old
+//
+// Posts scoring at least appConf.Spam.Hold are held for review: hidden, with
+// a report in the moderation queue. Posts scoring at least appConf.Spam.Hide
+// are shadow hidden: shown to their author, and no one else, so spammers
+// don't know to try again. Moderators unhide or dismiss the report of a post
+// that isn't spam, and take any other action on one that is. Their decisions
+// on reports of spam, whoever made them, train the classifier.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// spamFilter is the reporter of the reports made by the spam filter.
+	spamFilter = "spam-filter"
+	// defaultSpamHold and defaultSpamHide are the thresholds used when
+	// they aren't set in bolt.conf.json.
+	defaultSpamHold = 1.0
+	defaultSpamHide = 2.0
+	// minSpamTraining is how many posts of each label the classifier
+	// must be trained on before it's trusted.
+	minSpamTraining = 20
+	// maxSpamTokens is how many distinct tokens of a post are classified.
+	maxSpamTokens = 200
+)
+
+// spamLabels are the labels the classifier sorts posts into.
+var spamLabels = []string{"spam", "ham"}
+
+// spamCheck{} is one step of the spam filter. Check returns a score, from 0
+// for posts that look fine, up to around 1 for posts that look like spam.
+// Errors are logged, and the check is skipped, so a check can't stop users
+// from posting.
+type spamCheck struct {
+	Name  string
+	Check func(p *post, u *user) (float64, error)
+}
+
+// spamChecks are run on each new post, in order. Add new checks here.
+var spamChecks = []spamCheck{
+	{"bayes", bayesCheck},
+	{"links", linksCheck},
+	{"duplicate", duplicateCheck},
+	{"new account", newAccountCheck},
+}
+
+// spamVerdict{} is what the spam filter decided about a post.
+type spamVerdict struct {
+	Score float64
+	// Action is "hold", "hide", or empty for posts that look fine.
+	Action  string
+	Reasons []string
+}
+
+// screenPost() runs the spam filter on a new post by the user, before it's
+// stored, hiding or shadow hiding it as needed. Once the post is stored,
+// the verdict is passed to reportSpam().
+func screenPost(c *credentials, p *post) *spamVerdict {
+	v := new(spamVerdict)
+	if c.User.Level >= roleTrusted {
+		return v
+	}
+	for _, sc := range spamChecks {
+		score, err := sc.Check(p, c.User)
+		if err != nil {
+			log.Println(sc.Name, err)
+			continue
+		}
+		if score > 0 {
+			v.Score += score
+			v.Reasons = append(v.Reasons, fmt.Sprintf("%s %.2f", sc.Name, score))
+		}
+	}
+
+	hold, hide := appConf.Spam.Hold, appConf.Spam.Hide
+	if hold <= 0 {
+		hold = defaultSpamHold
+	}
+	if hide <= 0 {
+		hide = defaultSpamHide
+	}
+	switch {
+	case v.Score >= hide:
+		v.Action, p.Shadow = "hide", true
+	case v.Score >= hold:
+		v.Action, p.Hidden = "hold", true
+	}
+	return v
+}
+
+// reportSpam() files a report for a post the spam filter held or shadow hid,
+// so a moderator reviews it.
+func reportSpam(p *post, v *spamVerdict) {
+	if v.Action == "" {
+		return
+	}
+	err := addReport(&report{
+		ID:         genID(15),
+		Reporter:   spamFilter,
+		TargetType: "post",
+		Target:     p.ID,
+		Reason:     "spam",
+		Text: fmt.Sprintf("%s, score %.2f: %s", map[string]string{
+			"hold": "held for review", "hide": "shadow hidden",
+		}[v.Action], v.Score, strings.Join(v.Reasons, ", ")),
+		Excerpt: excerpt(p.Text+" "+strings.Join(p.blobPaths(), " "), 280),
+		Created: time.Now().Unix(),
+		Status:  "open",
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// heldNotice() returns the notice shown to the author of a post held for
+// review, by the spam filter or the media blocklist. Authors aren't told
+// when their post is shadow hidden.
+func heldNotice(p *post) string {
+	if !p.Hidden || p.Shadow {
+		return ""
+	}
+	return "Your post will be shown once a moderator has reviewed it."
+}
+
+// trainSpamDecision() trains the classifier on a moderators decision about a
+// post reported as spam. Dismissing the report or unhiding the post mean it
+// isn't spam, and any other action means it is.
+func trainSpamDecision(p *post, action string) {
+	tokens := spamTokens(p.Text)
+	if len(tokens) == 0 {
+		return
+	}
+	label := "spam"
+	if action == "dismiss" || action == "unhide" {
+		label = "ham"
+	}
+	if err := trainSpam(p.ID, label, tokens); err != nil {
+		log.Println(err)
+	}
+}
+
+// linkRe matches links in the text of a post.
+var linkRe = regexp.MustCompile(`(?i)\b(?:https?://|www\.)([^\s/?#]+)\S*`)
+
+// spamTokens() splits text into the distinct, lower case words the
+// classifier works with, along with a token for the domain of each link.
+func spamTokens(text string) []string {
+	seen := map[string]bool{}
+	var tokens []string
+	add := func(t string) {
+		if !seen[t] && len(tokens) < maxSpamTokens {
+			seen[t] = true
+			tokens = append(tokens, t)
+		}
+	}
+	for _, m := range linkRe.FindAllStringSubmatch(text, -1) {
+		add("link:" + strings.ToLower(m[1]))
+	}
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for _, w := range words {
+		if len(w) > 1 && len(w) <= 40 {
+			add(w)
+		}
+	}
+	return tokens
+}
+
+// bayesCheck() scores how likely the classifier thinks the post is spam, from
+// 0 at even odds or better, up to 1.5 when it's certain.
+func bayesCheck(p *post, _ *user) (float64, error) {
+	tokens := spamTokens(p.Text)
+	if len(tokens) == 0 {
+		return 0, nil
+	}
+	docs, counts, err := getSpamCounts(tokens)
+	if err != nil {
+		return 0, err
+	}
+	if slices.ContainsFunc(spamLabels, func(l string) bool { return docs[l] < minSpamTraining }) {
+		return 0, nil
+	}
+
+	// Work in logs to avoid underflow. Each token is weighed by the share
+	// of posts of each label it appears in, smoothed so unseen tokens
+	// don't count for or against.
+	total := float64(docs["spam"] + docs["ham"])
+	logp := map[string]float64{}
+	for _, l := range spamLabels {
+		n := float64(docs[l])
+		logp[l] = math.Log(n / total)
+		for i := range tokens {
+			logp[l] += math.Log((float64(max(counts[l][i], 0)) + 1) / (n + 2))
+		}
+	}
+	prob := 1 / (1 + math.Exp(logp["ham"]-logp["spam"]))
+	return max(0, prob-0.5) * 3, nil
+}
+
+// linksCheck() scores posts by the number of links after the first.
+func linksCheck(p *post, _ *user) (float64, error) {
+	n := len(linkRe.FindAllStringIndex(p.Text, -1))
+	return min(0.25*float64(max(n-1, 0)), 1), nil
+}
+
+// duplicateCheck() scores posts whose text has been posted more than twice
+// in the last day, by anyone. Short posts are skipped.
+func duplicateCheck(p *post, _ *user) (float64, error) {
+	text := strings.Join(strings.Fields(strings.ToLower(p.Text)), " ")
+	if len(text) < 20 {
+		return 0, nil
+	}
+	sum := sha256.Sum256([]byte(text))
+	n, err := incrDuplicates(hex.EncodeToString(sum[:]))
+	if err != nil {
+		return 0, err
+	}
+	return min(0.5*float64(max(n-2, 0)), 1.5), nil
+}
+
+// newAccountCheck() scores posts from accounts less than a week old, and
+// more so from those less than a day old. Accounts made before the join time
+// was recorded are left alone.
+func newAccountCheck(_ *post, u *user) (float64, error) {
+	age := time.Since(u.Joined)
+	switch {
+	case u.Joined.IsZero():
+		return 0, nil
+	case age < 24*time.Hour:
+		return 0.5, nil
+	case age < 7*24*time.Hour:
+		return 0.25, nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,217 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// storage.go houses the blobStore{} abstraction, where blobs are kept. By
+// default they're kept on the local disk, in blobDir, which only works with
+// one app server. Configuring an S3-compatible service in bolt.conf.json
+// keeps them there instead, see: s3.go. Either way, posts keep the path of
+// their media, /public/blobs/[key], so posts don't change when the store
+// does, and pages link to the URL the store gives for it. see: mediaURL()
+//
+// When Media.SignedURLs is set, those links are signed and expire, so only
+// people shown the page can fetch the media. Requests to /public/blobs/
+// without a valid signature are refused. see: mediaHandler()
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// blobStore is anything capable of keeping blobs, by their key, which is
+// their path within blobDir, e.g. "ab/[hash].jpg".
+type blobStore interface {
+	// put() stores size bytes read from r as the blob key.
+	put(key string, r io.Reader, size int64, contentType string) error
+	// open() reads the blob key. Missing blobs return os.ErrNotExist.
+	open(key string) (io.ReadCloser, error)
+	// remove() removes the blob key, if it exists.
+	remove(key string) error
+	// url() returns the URL the blob key may be fetched from, which is
+	// signed, and expires, when Media.SignedURLs is set.
+	url(key string) (string, error)
+}
+
+// defaultURLExpiry is how long signed URLs last when Media.URLExpiry isn't
+// set.
+const defaultURLExpiry = time.Hour
+
+// urlExpiry() returns how long signed URLs last.
+func urlExpiry(c *config) time.Duration {
+	if c.Media.URLExpiry <= 0 {
+		return defaultURLExpiry
+	}
+	return time.Duration(c.Media.URLExpiry) * time.Second
+}
+
+// newBlobStore() returns the blobStore{} described by the configuration.
+func newBlobStore(c *config) blobStore {
+	expiry := urlExpiry(c)
+	if c.Media.Backend == "s3" {
+		return newS3Store(c, expiry)
+	}
+	return &localStore{dir: blobDir, signed: c.Media.SignedURLs, expiry: expiry}
+}
+
+// localStore keeps blobs in a directory on the local disk.
+type localStore struct {
+	dir    string
+	signed bool
+	expiry time.Duration
+}
+
+// put() writes the blob to a temp file beside it, and then moves it into
+// place, so it's never seen half written.
+func (s *localStore) put(key string, r io.Reader, size int64, contentType string) error {
+	path := filepath.Join(s.dir, key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".put-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// open() opens the blob.
+func (s *localStore) open(key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.dir, key))
+}
+
+// remove() removes the blob.
+func (s *localStore) remove(key string) error {
+	err := os.Remove(filepath.Join(s.dir, key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// url() returns the path the blob is served from by mediaHandler(), with
+// an expiry and signature when URLs are signed.
+func (s *localStore) url(key string) (string, error) {
+	u := "/" + blobDir + "/" + key
+	if !s.signed {
+		return u, nil
+	}
+	return u + "?" + signBlob(key, time.Now().Add(s.expiry)).Encode(), nil
+}
+
+// signBlob() returns the query which signs a URL for the blob key, until
+// expires.
+func signBlob(key string, expires time.Time) url.Values {
+	e := strconv.FormatInt(expires.Unix(), 10)
+	return url.Values{"expires": {e}, "sig": {blobSignature(key, e)}}
+}
+
+// blobSignature() returns the signature of a URL for the blob key, which
+// expires at the unix time expires.
+func blobSignature(key, expires string) string {
+	mac := hmac.New(sha256.New, hmacSampleSecret)
+	mac.Write([]byte("blob:" + key + "." + expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signedRequest() reports whether the request for the blob key carries a
+// signature made by signBlob() which hasn't expired.
+func signedRequest(r *http.Request, key string) bool {
+	q := r.URL.Query()
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(q.Get("sig")), []byte(blobSignature(key, q.Get("expires"))))
+}
+
+// mediaURL() returns the URL the media at path is shown from, which is
+// signed for the viewer when URLs are signed, so only those shown the page
+// can fetch it. It's used wherever media is rendered. Paths outside the blob
+// store, such as the default profile pictures, are served as they are.
+func mediaURL(path string) string {
+	if !isBlob(path) {
+		return "/" + path
+	}
+	u, err := blobs.url(blobKey(path))
+	if err != nil {
+		log.Println(err)
+		return "/" + path
+	}
+	return u
+}
+
+// mediaHandler() is the route handler for /public/blobs/[key]. When URLs are
+// signed, requests must carry a signature from mediaURL(), or are refused.
+// Local blobs are served directly, and anything else is redirected to the
+// URL given by the store.
+func mediaHandler(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/"+blobDir+"/")
+	if !isBlob(blobDir + "/" + key) {
+		http.NotFound(w, r)
+		return
+	}
+	if appConf.Media.SignedURLs && !signedRequest(r, key) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if s, ok := blobs.(*localStore); ok {
+		http.ServeFile(w, r, filepath.Join(s.dir, key))
+		return
+	}
+	u, err := blobs.url(key)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Storage Error", http.StatusBadGateway)
+		return
+	}
+	// The redirect may be cached, but not beyond when the URL expires.
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d",
+		int(urlExpiry(appConf).Seconds())/2))
+	http.Redirect(w, r, u, http.StatusFound)
+}
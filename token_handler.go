@@ -0,0 +1,272 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+//
+// token_handler.go houses the personal access tokens users create for their
+// scripts and bots, and the middleware that checks a tokens scopes. Tokens
+// are accepted by checkAuth() in an "Authorization: Bearer" header.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// apiTokenPrefix makes tokens easy to recognize, such as when one is
+	// accidentally committed somewhere.
+	apiTokenPrefix = "tm_"
+	// maxAPITokens is how many tokens a user may have at once.
+	maxAPITokens = 20
+	// maxAPITokenDays is the longest a token may be set to last. Tokens
+	// may also be set to never expire.
+	maxAPITokenDays = 365
+)
+
+// apiScopes are the scopes a token may be granted:
+//   - read:   view feeds, posts, tags and profiles
+//   - post:   upload posts and reply
+//   - like:   like and share posts
+//   - follow: add and remove friends
+//   - admin:  use moderation and administration routes. Only moderators and
+//     admins may create tokens with this scope. see: roles.go
+//
+// Account settings, such as the password, two-factor authentication and the
+// tokens themselves, can't be changed with a token at all.
+var apiScopes = []string{"read", "post", "like", "follow", "admin"}
+
+// hashAPIToken() returns the hash a token is stored under. Tokens are long
+// and random, so unlike passwords a fast hash is fine.
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkAPIToken() looks up the token sent in an "Authorization: Bearer"
+// header, returning the credentials of the user it belongs to, limited to the
+// tokens scopes.
+func checkAPIToken(token string) (*credentials, error) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return nil, errors.New("Malformed API Token")
+	}
+	hash := hashAPIToken(token)
+	t, err := getAPIToken(hash)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if t.Expires > 0 && now.Unix() >= t.Expires {
+		return nil, errors.New("API Token Expired")
+	}
+
+	c := &credentials{
+		IsLoggedIn: true,
+		User:       &user{ID: t.UserID},
+		Scopes:     strings.Fields(t.Scopes),
+	}
+	if err = scanProfile(c); err != nil {
+		return nil, err
+	}
+	if c.User.Banned {
+		return nil, errors.New("Account Banned")
+	}
+	c.Name = c.User.Email
+	if err = touchAPIToken(hash, now); err != nil {
+		log.Println(err)
+	}
+	return c, nil
+}
+
+// requireScope is used as a middleware function, inside of checkAuth(), for
+// routes which an API token needs the given scope to use. Requests made with
+// the "token" cookie are let through.
+func requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := r.Context().Value(ctxkey).(*credentials)
+		if ok && c.Scopes != nil && !slices.Contains(c.Scopes, scope) {
+			w.WriteHeader(http.StatusForbidden)
+			log.Println(status(w, "Token Missing Scope: "+scope, nil))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireSession is used as a middleware function, inside of checkAuth(), for
+// account routes which can't be used with an API token, only by a user who
+// signed in.
+func requireSession(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := r.Context().Value(ctxkey).(*credentials)
+		if ok && c.Scopes != nil {
+			w.WriteHeader(http.StatusForbidden)
+			log.Println(status(w, "Not Allowed With An API Token", nil))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tokenRequest{} is the request body sent by the client when creating a
+// token. ExpiresIn is in days, and zero means the token never expires.
+type tokenRequest struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn int      `json:"expires_in"`
+}
+
+// createToken() is the route handler used to create a new API token. The
+// token is only ever sent to the client this once.
+func createToken(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	if !c.IsLoggedIn {
+		log.Println(status(w, "Not Logged In", nil))
+		return
+	}
+
+	tr := new(tokenRequest)
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(tr); err != nil {
+		log.Println(status(w, "Invalid Request", err))
+		return
+	}
+	tr.Name = strings.TrimSpace(tr.Name)
+	if tr.Name == "" || len(tr.Name) > 64 {
+		log.Println(status(w, "Token Name Must Be 1-64 Characters", nil))
+		return
+	}
+	if len(tr.Scopes) == 0 {
+		log.Println(status(w, "Choose At Least One Scope", nil))
+		return
+	}
+	for _, s := range tr.Scopes {
+		if !slices.Contains(apiScopes, s) {
+			log.Println(status(w, "Unknown Scope: "+s, nil))
+			return
+		}
+		if s == "admin" && c.User.Level < roleModerator {
+			log.Println(status(w, "Only Moderators And Admins May Use The admin Scope", nil))
+			return
+		}
+	}
+	if tr.ExpiresIn < 0 || tr.ExpiresIn > maxAPITokenDays {
+		log.Println(status(w, "Invalid Expiry", nil))
+		return
+	}
+
+	n, err := countAPITokens(c)
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	if n >= maxAPITokens {
+		log.Println(status(w, "Too Many Tokens, Revoke One First", nil))
+		return
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		log.Println(status(w, "Error", err))
+		return
+	}
+	token := apiTokenPrefix + secret
+	now := time.Now()
+	slices.Sort(tr.Scopes)
+	t := &apiToken{
+		ID:      genID(8),
+		UserID:  c.User.ID,
+		Name:    tr.Name,
+		Scopes:  strings.Join(slices.Compact(tr.Scopes), " "),
+		Created: now.Unix(),
+	}
+	if tr.ExpiresIn > 0 {
+		t.Expires = now.AddDate(0, 0, tr.ExpiresIn).Unix()
+	}
+	if err = setAPIToken(hashAPIToken(token), t); err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	ajaxResponse(w, map[string]string{
+		"status": "success",
+		"id":     t.ID,
+		"token":  token,
+	})
+}
+
+// apiTokensHandler() is the route handler used to list the users API tokens,
+// including when each was last used, but never the tokens themselves.
+func apiTokensHandler(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	if !c.IsLoggedIn {
+		log.Println(status(w, "Not Logged In", nil))
+		return
+	}
+	tokens, err := getAPITokens(c)
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	slices.SortFunc(tokens, func(a, b *apiToken) int {
+		return int(b.Created - a.Created)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(struct {
+		Status string      `json:"status"`
+		Tokens []*apiToken `json:"tokens"`
+	}{"success", tokens})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// revokeToken() is the route handler for /revokeToken/[id], used to delete
+// one of the users API tokens. It stops working immediately.
+func revokeToken(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+	if !c.IsLoggedIn {
+		log.Println(status(w, "Not Logged In", nil))
+		return
+	}
+	ok, err := revokeAPIToken(c, strings.Split(r.URL.Path, "/")[2])
+	if err != nil {
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+	if !ok {
+		log.Println(status(w, "No Such Token", nil))
+		return
+	}
+	log.Println(status(w, "success", nil))
+}
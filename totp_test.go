@@ -0,0 +1,124 @@
+// Provided Under BSD (2 Clause)
+//
+// Copyright 2025 Johnathan A. Hartsfield
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS “AS IS”
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+//
+// ////////////////////////////////////////////////////////////////////////////
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 secret from RFC 6238 appendix B,
+// "12345678901234567890", base32 encoded.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// rfcVectors are the SHA-1 test vectors from RFC 6238 appendix B. The RFC
+// gives eight digit codes, and ours are their last six.
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestTOTPCode(t *testing.T) {
+	for _, tt := range rfcVectors {
+		got, err := totpCode(rfcSecret, tt.unix/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.code {
+			t.Errorf("%d: code = %s, want %s", tt.unix, got, tt.code)
+		}
+	}
+}
+
+func TestCheckTOTP(t *testing.T) {
+	for _, tt := range rfcVectors {
+		want := tt.unix / totpPeriod
+		for _, c := range []struct {
+			drift int64
+			ok    bool
+		}{
+			{0, true},
+			{-totpPeriod, true},
+			{totpPeriod, true},
+			{-2 * totpPeriod, false},
+			{2 * totpPeriod, false},
+		} {
+			if tt.unix+c.drift < 0 {
+				continue
+			}
+			step, ok := checkTOTP(rfcSecret, tt.code, time.Unix(tt.unix+c.drift, 0))
+			if ok != c.ok {
+				t.Errorf("%d%+ds: ok = %v, want %v", tt.unix, c.drift, ok, c.ok)
+			}
+			if ok && step != want {
+				t.Errorf("%d%+ds: step = %d, want %d", tt.unix, c.drift, step, want)
+			}
+		}
+	}
+
+	at := time.Unix(1111111109, 0)
+	for _, code := range []string{"", "08180", "0818040", "081805", "abcdef"} {
+		if _, ok := checkTOTP(rfcSecret, code, at); ok {
+			t.Errorf("%q accepted", code)
+		}
+	}
+	if _, ok := checkTOTP(rfcSecret, " 081804 ", at); !ok {
+		t.Error("code with spaces refused")
+	}
+	if _, ok := checkTOTP("not base32!", "081804", at); ok {
+		t.Error("bad secret accepted")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, c := range codes {
+		if len(c) != 11 || c[5] != '-' {
+			t.Errorf("code %q isn't formatted like abcde-fghij", c)
+		}
+		if seen[c] {
+			t.Errorf("code %q issued twice", c)
+		}
+		seen[c] = true
+		if hashRecoveryCode(" "+strings.ToUpper(c)+" ") != hashRecoveryCode(c) {
+			t.Errorf("code %q hashes differently as typed", c)
+		}
+	}
+}
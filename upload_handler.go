@@ -37,20 +37,136 @@ import (
 	"mime/multipart"
 	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 )
 
+const (
+	// maxUploadSize is the largest file we accept. 200<<20 shifts the bits
+	// of 200 left by 20, which multiplies it by 2**20, so it's 200MB.
+	maxUploadSize int64 = 200 << 20
+	// maxRequestSize is the largest upload request we accept, with room
+	// for as many files as a post may have and the rest of the form, and
+	// maxBodySize is the largest body any other request may have.
+	maxRequestSize = maxAttachments*maxUploadSize + 1<<20
+	maxBodySize    = 1 << 20
+)
+
+// uploadRoutes are the routes which accept file uploads, and so may have
+// bodies up to maxRequestSize.
+var uploadRoutes = []string{"/uploadItem"}
+
+// limitBody is used as a middleware function around the whole multiplexer,
+// limiting the size of request bodies. Handlers reading past the limit get
+// an *http.MaxBytesError.
+func limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := int64(maxBodySize)
+		if slices.Contains(uploadRoutes, r.URL.Path) {
+			limit = maxRequestSize
+		}
+		if strings.HasPrefix(r.URL.Path, "/uploadChunk/") {
+			limit = maxChunkSize
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// errFileTooLarge is returned when an uploaded file is over maxUploadSize.
+var errFileTooLarge = errors.New("file too large")
+
 // uploadHandler() is the entry point for post uploads and step 1 of the upload
 // process. We parse the form data sent by the client, marshal it so that we
 // may return it to the client, and respond with the appropriate ajaxResponse.
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxkey).(*credentials)
+
 	// Parse the form data sent by the client into a post{}
 	post, err := parseForm(r)
+	if errors.Is(err, errFileTooLarge) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		log.Println(status(w, fmt.Sprintf("File Too Large, The Limit Is %dMB", maxUploadSize>>20), err))
+		return
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		log.Println(status(w, fmt.Sprintf("Post Too Large, The Limit Is %dMB Of Files In Total", maxAttachments*maxUploadSize>>20), err))
+		return
+	}
+	if errors.Is(err, errImageTooLarge) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		log.Println(status(w, fmt.Sprintf("Image Too Large, The Limit Is %d Megapixels", maxImagePixels/1_000_000), err))
+		return
+	}
+	if errors.Is(err, errQuotaExceeded) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		log.Println(status(w, quotaMessage(c, storage{Files: 1}), err))
+		return
+	}
+	if errors.Is(err, errTooManyAttachments) {
+		log.Println(status(w, fmt.Sprintf("Too Many Files, The Limit Is %d", maxAttachments), err))
+		return
+	}
+	if errors.Is(err, errUploadUnfinished) {
+		w.WriteHeader(http.StatusConflict)
+		log.Println(status(w, "Upload Not Finished", err))
+		return
+	}
+	if errors.Is(err, errUnsupportedMedia) {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		log.Println(status(w, "Unsupported File Type, Try "+mediaExts(), err))
+		return
+	}
 	if err != nil {
 		log.Println(status(w, "Invalid Form", err))
+		return
+	}
+
+	// Mentions of users who can't interact with the author are dropped.
+	// see: block_handler.go
+	post.Mentions = dropBlockedMentions(c, post.Mentions)
+
+	// Images like those on the media blocklist are refused, or held for
+	// review. see: phash.go
+	match, err := screenMedia(post)
+	if err != nil {
+		releaseAttachments(post.Attachments)
+		if errors.Is(err, errBlockedMedia) {
+			w.WriteHeader(http.StatusForbidden)
+			log.Println(status(w, "That Image Isn't Allowed Here", err))
+			return
+		}
+		log.Println(status(w, "Database Error", err))
+		return
+	}
+
+	// Charge the user for the files they uploaded, now we know how large
+	// they turned out, unless another upload beat this one to the space
+	// they had left. see: quota.go
+	used := post.storage()
+	if used.Files > 0 {
+		ok, err := chargeUsage(c.User.ID, used, quotaFor(c.User))
+		if err == nil && !ok {
+			releaseAttachments(post.Attachments)
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			log.Println(status(w, quotaMessage(c, used), errQuotaExceeded))
+			return
+		}
+		if err != nil {
+			releaseAttachments(post.Attachments)
+			log.Println(status(w, "Database Error", err))
+			return
+		}
 	}
 
+	// Run the post through the spam filter, which may hold it for review
+	// or shadow hide it. see: spam.go
+	verdict := screenPost(c, post)
+
 	// Marshal the freshly parsed post{} into its JSON representation in
 	// []byte form.
 	b, err := json.Marshal(post)
@@ -60,12 +176,21 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Add the post to the database sets/maps.
 	if err = zhPost(post); err == nil {
+		// The post is added to the users own posts only once it's
+		// stored, so a refused post isn't left among them. It's live
+		// by now, so a failure here isn't reported to the user.
+		if _, err = zaddUsersPosts(c, post); err != nil {
+			log.Println(err)
+		}
+		reportSpam(post, verdict)
+		reportBlockedMedia(post, match)
 		// custom Ajax response returning the new posts ID and JSON
 		// representation (if any).
 		ajaxResponse(w, map[string]string{
 			"status":     "success",
 			"replyID":    post.ID,
 			"itemString": string(b),
+			"notice":     heldNotice(post),
 		})
 		// We cache here in development, but for production we won't be
 		// cache()ing the database after every submission, there is a
@@ -74,12 +199,16 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	log.Println(status(w, "Database Error", err))
+	releaseAttachments(post.Attachments)
+	if err = refundUsage(c.User.ID, used); err != nil {
+		log.Println(err)
+	}
 }
 
 // parseForm() parses multipart/form-data sent by the client. This is used for
 // every form except auth, but I may break it down into smaller functions
-// eventually.
-func parseForm(r *http.Request) (*post, error) {
+// eventually. If it fails, any file already saved is removed.
+func parseForm(r *http.Request) (p *post, err error) {
 	mr, err := r.MultipartReader()
 	if err != nil {
 		return nil, err
@@ -96,12 +225,12 @@ func parseForm(r *http.Request) (*post, error) {
 		Author:     c_.User.ID,
 	}
 
-	// Add the post ID to sorted set(s):
-	_, err = zaddUsersPosts(c_, post)
-	if err != nil {
-		log.Println(err)
-		return nil, err
-	}
+	defer func() {
+		if err != nil {
+			releaseAttachments(post.Attachments)
+		}
+	}()
+	var alts []string
 
 	// Read the multipart/form-data, cycling through each form part,
 	// checking the part.FormName(), and responding based on the output.
@@ -116,27 +245,50 @@ func parseForm(r *http.Request) (*post, error) {
 		if err_part == io.EOF {
 			break
 		}
+		if err_part != nil {
+			return nil, err_part
+		}
 		///////////////////////////////////////////////////////////////
 		/////////////////////////    MEDIA    /////////////////////////
 		///////////////////////////////////////////////////////////////
-		// Post media
-		if part.FormName() == "Media" { // see: upload.html
+		// Post media. Browsers send an empty part for a file input
+		// left empty, which is skipped.
+		if part.FormName() == "Media" && part.FileName() != "" { // see: upload.html
+			post.Type = "Media"
+			if err = attach(c_, post, storage{Files: 1}, func() (*attachment, error) { return handleFile(part) }); err != nil {
+				return nil, err
+			}
+		}
+		// Post media sent beforehand in chunks. see: resumable.go
+		if part.FormName() == "upload" { // see: upload.js
 			post.Type = "Media"
-			if handleFile(part, post) != nil {
+			id, err := readPart(part)
+			if err != nil {
+				return nil, err
+			}
+			if err = attach(c_, post, storage{}, func() (*attachment, error) { return finishUpload(c_, id) }); err != nil {
+				return nil, err
+			}
+		}
+		// Alt text for each attachment, in the same order.
+		if part.FormName() == "alt" { // see: upload.js
+			alt, err := readPart(part)
+			if err != nil {
 				return nil, err
 			}
+			alts = append(alts, cleanAlt(alt))
 		}
 		// Profile Pic
 		if part.FormName() == "ProfilePic" { // see: profile.html
 			post.Type = "ProfilePic"
-			if handleFile(part, post) != nil {
+			if err = attach(c_, post, storage{Files: 1}, func() (*attachment, error) { return handleFile(part) }); err != nil {
 				return nil, err
 			}
 		}
 		// Profile Background
 		if part.FormName() == "ProfileBG" { // see: profile.html
 			post.Type = "ProfileBG"
-			if handleFile(part, post) != nil {
+			if err = attach(c_, post, storage{Files: 1}, func() (*attachment, error) { return handleFile(part) }); err != nil {
 				return nil, err
 			}
 		}
@@ -203,9 +355,38 @@ func parseForm(r *http.Request) (*post, error) {
 			}
 		}
 	}
+
+	for i, a := range post.Attachments {
+		if i < len(alts) {
+			a.Alt = alts[i]
+		}
+	}
+
 	return post, nil
 }
 
+// attach() adds the attachment{} made by fn to the post, if it doesn't
+// have maxAttachments already, and the user has room for more besides the
+// posts other attachments. Resumable uploads have already reserved their
+// room, and so need no more. see: reserveUploadUsage()
+func attach(c *credentials, p *post, more storage, fn func() (*attachment, error)) error {
+	if len(p.Attachments) >= maxAttachments {
+		return errTooManyAttachments
+	}
+	s := p.storage()
+	s.Bytes += more.Bytes
+	s.Files += more.Files
+	if err := checkQuota(c, s); err != nil {
+		return err
+	}
+	a, err := fn()
+	if err != nil {
+		return err
+	}
+	p.Attachments = append(p.Attachments, a)
+	return nil
+}
+
 // readPart(*multipart.Part) is used in the parseForm() function to reduce
 // repeated code. It converts the form part to a string or returns an error if
 // it can't.
@@ -228,67 +409,86 @@ func readTagPart(part *multipart.Part) (rstring, error) {
 	return strings.Split(buf.String(), ","), nil
 }
 
-// handleFile() is used to handle file uploads.
-func handleFile(part *multipart.Part, data *post) error {
-	// Limit the file size we accept. 10<<20 is a bitwise operation,
-	// meaning no one knows what the hell it means. We look it up to find
-	// that we are "shifting bits", in this case the bits of the left
-	// operand (10). We are shifting them (bitwise), to the left (<<), by
-	// the number specified by the right operand (20). This is equivalent
-	// to multiplying the left operand by 2 raised to the power of the
-	// right operand. Therefore, 10<<20 is equivalent to: 10 * (2 ** 20)
-	// which is approximately ~10 megabytes. (note: I'm not re-writing this
-	// comment when we change this).
-	fileBytes, err := io.ReadAll(io.LimitReader(part, 200<<20)) // 200mb
+// handleFile() is used to handle file uploads, returning the attachment{}
+// made of the file. The file is streamed to a temp file as it arrives,
+// rather than held in memory, and its type is sniffed from the first 512
+// bytes. Files over maxUploadSize are refused
+// with errFileTooLarge, rather than being cut short, and files of a type we
+// don't support with errUnsupportedMedia.
+func handleFile(part *multipart.Part) (*attachment, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(part, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	// Only the media types in the registry are accepted. see: media.go
+	mt, err := sniffMedia(head)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	tempFile, err := os.CreateTemp("public/temp", "u-*."+mt.Ext)
+	if err != nil {
+		return nil, err
 	}
+	defer tempFile.Close()
 
-	log.Println(http.DetectContentType(fileBytes))
-	// fexts conception was aimed at reducing the code base, acting as a
-	// type of "switch". If a mime type is supported it "errors" with its
-	// proper extension.
-	var fexts map[string]error = map[string]error{
-		"image/png":  errors.New("png"),
-		"image/jpeg": errors.New("jpg"),
-		"image/gif":  errors.New("gif"),
-		"video/mp4":  errors.New("mp4"),
-		"video/webm": errors.New("webm"),
+	// Copy the rest of the file, reading one byte past the limit so we
+	// can tell a file that's too large from one exactly at the limit.
+	written, err := io.Copy(tempFile, io.MultiReader(bytes.NewReader(head),
+		io.LimitReader(part, maxUploadSize-int64(n)+1)))
+	if err == nil && written > maxUploadSize {
+		err = errFileTooLarge
+	}
+	if err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return nil, err
 	}
 
-	ex := fexts[http.DetectContentType(fileBytes)].Error()
-	tempFile, err := os.CreateTemp("public/temp", "u-*."+fmt.Sprint(ex))
+	tempFile.Close()
+	return storeMedia(tempFile.Name(), mt)
+}
 
-	if err == nil {
-		defer tempFile.Close()
-		if _, err = tempFile.Write(fileBytes); err == nil {
-			data.TempFileName = tempFile.Name()
-			// create the HTML element based on the file type:
-			var t string
-			switch ex {
-			case "png", "jpg", "gif":
-				t = markupMedia("img", data.TempFileName)
-			case "mp4", "webm":
-				t = markupMedia("vid", data.TempFileName)
-			}
-			data.MediaType = t
-			return nil
+// storeMedia() finishes an upload staged at path, once it's all arrived,
+// whether in one request or in chunks, returning its attachment{}.
+// see: resumable.go
+func storeMedia(path string, mt *mediaType) (*attachment, error) {
+	// Images are resized and re-encoded, which replaces the original.
+	// see: imaging.go
+	variants, hashes, err := processImage(path, mt)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	a := &attachment{Kind: mt.Kind, MIME: mt.MIME, Blurhash: hashes.Blurhash, PHash: hashes.PHash}
+	if len(variants) > 0 {
+		full := variants[len(variants)-1]
+		path, a.Width, a.Height = full.Path, full.Width, full.Height
+		a.MIME = mediaTypeByExt(strings.TrimPrefix(filepath.Ext(path), ".")).MIME
+	} else {
+		a.Width, a.Height, a.Duration = probeMedia(path, mt)
+	}
+	// Every size stored counts towards the uploaders quota. see: quota.go
+	staged := []string{path}
+	if len(variants) > 0 {
+		staged = nil
+		for _, v := range variants {
+			staged = append(staged, v.Path)
 		}
-		return err
 	}
-	return err
-}
-
-// markupMedia() is used to wrap the media element displayed in a post with
-// the appropriate html markup/tag. Images get the "img" tag, while videos get
-// the "video" tag, along with attributes "controls", "autoplay", and "mute".
-// Since it only supports images and videos, only the parameter "img" is
-// recognized as the forst parameter, anything else defaults to the video tag.
-// We also pass the path to the media as the second parameter.
-func markupMedia(typ, path string) string {
-	if typ == "img" {
-		return "<img class='item-img item-media' src='/" + path + "'/>"
-	}
-	return "<video class='item-video item-media' controls autoplay mute" +
-		" src='/" + path + "' />"
+	for _, f := range staged {
+		if fi, err := os.Stat(f); err == nil {
+			a.Size += fi.Size()
+		}
+	}
+	// The upload is moved into the blob store. see: blob.go
+	if a.Blob, variants, err = storeBlob(path, variants); err != nil {
+		return nil, err
+	}
+	if len(variants) > 1 {
+		a.Sizes = variants
+	}
+	return a, nil
 }